@@ -1,15 +1,29 @@
 package main
 
 import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/nunchistudio/blacksmith"
 	"github.com/nunchistudio/blacksmith/adapter/pubsub"
 	"github.com/nunchistudio/blacksmith/adapter/store"
+	"github.com/nunchistudio/blacksmith/flow"
 	"github.com/nunchistudio/blacksmith/flow/destination"
 	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
 	"github.com/nunchistudio/blacksmith/service"
 
+	"github.com/nunchistudio/smithy/flows"
+	"github.com/nunchistudio/smithy/sources"
 	"github.com/nunchistudio/smithy/sources/api"
+	"github.com/nunchistudio/smithy/sources/files"
+	"github.com/nunchistudio/smithy/sources/nats"
 	spg "github.com/nunchistudio/smithy/sources/postgres"
+	"github.com/nunchistudio/smithy/sources/rest"
+	"github.com/nunchistudio/smithy/sources/s3"
 
 	"github.com/nunchistudio/smithy/destinations/crm"
 	dpg "github.com/nunchistudio/smithy/destinations/postgres"
@@ -22,9 +36,150 @@ from the events and adapters.
 */
 func Init() *blacksmith.Options {
 
+	// Requests sent to the api source must be signed only if shared secrets are
+	// set. Several secrets can be active at once, separated by commas, so they can
+	// be rotated without downtime. Empty secrets are ignored, and the application
+	// does not start if no secret remains.
+	var signature *api.Signature
+	if secrets := os.Getenv("API_SIGNING_SECRETS"); secrets != "" {
+		signature = &api.Signature{
+			Secrets: list(secrets),
+		}
+
+		err := signature.Validate()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Clients of the api source must send an API key only if enabled. Keys are
+	// stored in the "smithy.api_keys" table.
+	var keys *api.Keys
+	if os.Getenv("API_KEYS_ENABLED") == "true" {
+		keys = &api.Keys{}
+	}
+
+	// Clients can send an "Idempotency-Key" header to deduplicate the events they
+	// retry. A key is valid for 24 hours.
+	idempotency := &api.Idempotency{
+		Window: 24 * time.Hour,
+	}
+
+	// Timestamps of the events sent by devices to the api source are corrected
+	// given the clock of the devices. Events sent by devices with a clock too far
+	// ahead or behind are flagged. Other sources use timestamps set on the server
+	// side, such as the commit time of a transaction, which must not be corrected.
+	clock := &sources.SkewCorrection{
+		MaxAhead:  10 * time.Minute,
+		MaxBehind: 7 * 24 * time.Hour,
+		Reject:    false,
+	}
+
+	// Events of the api source go through a chain of middlewares once extracted.
+	// The location of the clients is resolved from their IP address only if a
+	// MaxMind database file is provided. The file is reloaded when modified.
+	apiMiddlewares := sources.Chain{clock}
+	if path := os.Getenv("GEOIP_DATABASE_PATH"); path != "" {
+		apiMiddlewares = append(apiMiddlewares, &sources.GeoIP{
+			Path: path,
+		})
+	}
+
+	// Flows can also be declared in a YAML file instead of Go, only if its path is
+	// set. They are added to the events by the last middleware of every sources,
+	// and resolved against the sources and destinations once the options are built
+	// so invalid flows prevent the application from starting.
+	middlewares := sources.Chain{}
+	var declared *flows.Registry
+	if path := os.Getenv("FLOWS_PATH"); path != "" {
+		var err error
+		declared, err = flows.Load(path)
+		if err != nil {
+			panic(err)
+		}
+
+		apiMiddlewares = append(apiMiddlewares, declared)
+		middlewares = append(middlewares, declared)
+	}
+
+	// Users registered are sent to the CRM only if the domain of their email address
+	// is not blocked, and only for the percentage of users set in
+	// "CRM_SAMPLE_PERCENT", if any. They are always saved in the warehouse. The
+	// destinations skipped are recorded in the "smithy.unrouted" table. The context
+	// of the events is kept in the flows by the last middleware so it can be
+	// evaluated as well.
+	crmConditions := []flows.Condition{
+		&flows.EmailDomains{
+			Block: list(os.Getenv("CRM_BLOCKED_DOMAINS")),
+		},
+	}
+
+	if percent, err := strconv.ParseFloat(os.Getenv("CRM_SAMPLE_PERCENT"), 64); err == nil {
+		crmConditions = append(crmConditions, &flows.Sample{
+			Percent: percent,
+		})
+	}
+
+	flows.OnRegisterRouter.Branches = []*flows.Branch{
+		{Destination: "crm", Conditions: crmConditions},
+		{Destination: "postgres"},
+	}
+
+	// Flows, or a single destination of a flow, can be disabled at runtime using the
+	// toggles of the "smithy.toggles" table, or of the file set in "TOGGLES_PATH"
+	// if any. Disabled flows are kept by the last middleware of every sources, and
+	// replayed every minute by the postgres source once enabled again.
+	flows.Switches.Path = os.Getenv("TOGGLES_PATH")
+
+	apiMiddlewares = append(apiMiddlewares, flows.KeepContext, flows.Switches)
+	middlewares = append(middlewares, flows.KeepContext, flows.Switches)
+
+	// Changes of the application's tables are also captured using a logical
+	// replication slot only if enabled. It requires the "wal_level" of the database
+	// to be "logical". Existing rows can be exported first when the slot is created.
+	var replication *spg.Replication
+	if os.Getenv("POSTGRES_REPLICATION_ENABLED") == "true" {
+		replication = &spg.Replication{
+			Slot:        "smithy",
+			Publication: "smithy",
+			Include:     list(os.Getenv("POSTGRES_SOURCE_TABLES")),
+			Exclude:     list(os.Getenv("POSTGRES_SOURCE_EXCLUDE")),
+		}
+
+		if os.Getenv("POSTGRES_REPLICATION_SNAPSHOT") == "true" {
+			replication.Snapshot = &spg.Snapshot{
+				ChunkSize: 1000,
+			}
+		}
+	}
+
+	// Changes of the columns of the tables set in "POSTGRES_SCHEMA_TABLES" are
+	// detected every minute only if set.
+	var schema *spg.Schema
+	if tables := list(os.Getenv("POSTGRES_SCHEMA_TABLES")); len(tables) > 0 {
+		schema = &spg.Schema{
+			Tables:   tables,
+			Interval: time.Minute,
+		}
+	}
+
+	// Rows added or updated in the tables set in "POSTGRES_SOURCE_SYNCS" are read
+	// incrementally, every minute, given their "updated_at" and "id" columns.
+	syncs := []*spg.Sync{}
+	for _, table := range list(os.Getenv("POSTGRES_SOURCE_SYNCS")) {
+		syncs = append(syncs, &spg.Sync{
+			Table:    table,
+			Cursor:   "updated_at",
+			Key:      "id",
+			PageSize: 500,
+			Interval: time.Minute,
+		})
+	}
+
 	var options = &blacksmith.Options{
 
 		Gateway: &service.Options{
+			Middleware: api.Middleware,
 			// KeyFile:  "server.key",
 			// CertFile: "server.crt",
 		},
@@ -53,10 +208,36 @@ func Init() *blacksmith.Options {
 
 		Sources: []*source.Options{
 			{
-				Load: api.New(),
+				Load: api.New(&api.Options{
+					Signature:   signature,
+					Keys:        keys,
+					Idempotency: idempotency,
+					RateLimits: map[string]*api.RateLimit{
+						"register": {By: "ip", Rate: 1, Burst: 10},
+						"batch":    {By: "ip", Rate: 0.2, Burst: 2},
+					},
+					Limiter:        &api.PostgresLimiter{},
+					TrustedProxies: list(os.Getenv("API_TRUSTED_PROXIES")),
+					Middlewares:    apiMiddlewares,
+				}),
 			},
 			{
-				Load: spg.New(),
+				Load: spg.New(&spg.Options{
+					Connection: os.Getenv("POSTGRES_SOURCE_URL"),
+					Listen: &spg.Listen{
+						Channels: []string{"smithy_changes"},
+						Tables:   list(os.Getenv("POSTGRES_SOURCE_TABLES")),
+					},
+					Replication: replication,
+					Schema:      schema,
+					Canary: &spg.Canary{
+						Timeout: 5 * time.Minute,
+						Email:   os.Getenv("CANARY_ALERT_EMAIL"),
+					},
+					Replay:      &spg.Replay{},
+					Syncs:       syncs,
+					Middlewares: middlewares,
+				}),
 			},
 		},
 
@@ -70,5 +251,159 @@ func Init() *blacksmith.Options {
 		},
 	}
 
+	// Partners can drop files of users in a folder, ingested only if the folder is
+	// set. Their columns are named after the fields of the users.
+	if directory := os.Getenv("FILES_DIRECTORY"); directory != "" {
+		options.Sources = append(options.Sources, &source.Options{
+			Load: files.New(&files.Options{
+				Directory:   directory,
+				Mapping:     &files.Mapping{},
+				Middlewares: middlewares,
+			}),
+		})
+	}
+
+	// Partners can also drop files of users in a bucket of an S3-compatible service,
+	// ingested only if the bucket is set.
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		options.Sources = append(options.Sources, &source.Options{
+			Load: s3.New(&s3.Options{
+				Endpoint:        os.Getenv("S3_ENDPOINT"),
+				AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+				Secure:          os.Getenv("S3_SECURE") == "true",
+				Region:          os.Getenv("S3_REGION"),
+				Bucket:          bucket,
+				Prefix:          os.Getenv("S3_PREFIX"),
+				Mapping:         &files.Mapping{},
+				Middlewares:     middlewares,
+			}),
+		})
+	}
+
+	// Internal services publish their domain events to NATS. The subjects set in
+	// "NATS_SOURCE_SUBJECTS" are consumed by a queue group, so each message is
+	// consumed by a single gateway, using JetStream durable consumers if enabled.
+	// Users registered by other services run the "OnRegister" flow.
+	if subjects := os.Getenv("NATS_SOURCE_SUBJECTS"); subjects != "" {
+		subscriptions := []*nats.Subscription{}
+		for i, subject := range strings.Split(subjects, ",") {
+			sub := &nats.Subscription{
+				Subject: subject,
+				Queue:   "smithy",
+			}
+
+			// Each subscription needs its own durable consumer.
+			if durable := os.Getenv("NATS_SOURCE_DURABLE"); durable != "" {
+				sub.Durable = durable + "_" + strconv.Itoa(i)
+			}
+
+			subscriptions = append(subscriptions, sub)
+		}
+
+		options.Sources = append(options.Sources, &source.Options{
+			Load: nats.New(&nats.Options{
+				URL:           os.Getenv("NATS_SERVER_URL"),
+				Subscriptions: subscriptions,
+				JetStream:     os.Getenv("NATS_SOURCE_JETSTREAM") == "true",
+				Routes: []*nats.Route{
+					{
+						Subject: "users.registered",
+						Flows: func(m *nats.Message) ([]flow.Flow, error) {
+							return registered(m.Data, m.Context, m.SentAt)
+						},
+					},
+				},
+				Middlewares: middlewares,
+			}),
+		})
+	}
+
+	// Users are also listed from the REST endpoint of a third-party tool, only if
+	// its URL is set. Its pages are followed using the "Link" header, and only the
+	// users updated since the last ones seen are listed once every pages have been
+	// read.
+	if endpoint := os.Getenv("REST_SOURCE_URL"); endpoint != "" {
+		options.Sources = append(options.Sources, &source.Options{
+			Load: rest.New(&rest.Options{
+				Endpoints: []*rest.Endpoint{
+					{
+						Name: "users",
+						URL:  endpoint,
+						Headers: map[string]string{
+							"Authorization": "Bearer " + os.Getenv("REST_SOURCE_TOKEN"),
+						},
+						Items:      "data",
+						Pagination: rest.PaginationLink,
+						PageSize:   100,
+						Timestamp:  "updated_at",
+						Flows: func(item *rest.Item) ([]flow.Flow, error) {
+							return registered(item.Data, item.Context, item.SentAt)
+						},
+					},
+				},
+				Middlewares: middlewares,
+			}),
+		})
+	}
+
+	if declared != nil {
+		err := declared.Resolve(options.Sources, options.Destinations)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	return options
 }
+
+/*
+registered returns the "OnRegister" flow of a user received as JSON by a source,
+given the context and the timestamp of the event. A 400 error is returned along
+with the validation errors if the user is not valid.
+*/
+func registered(data json.RawMessage, ctx *sources.Context, sentAt *time.Time) ([]flow.Flow, error) {
+	var u api.User
+	err := json.Unmarshal(data, &u)
+	if err != nil {
+		return nil, &errors.Error{
+			StatusCode: 400,
+			Message:    "Bad Request",
+			Validations: []errors.Validation{
+				{
+					Message: "Data must be a user: " + err.Error(),
+					Path:    []string{"data"},
+				},
+			},
+		}
+	}
+
+	v := &sources.Validator{}
+	u.Validate(v, "data")
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := u.Flows(ctx, sentAt)
+	if err != nil {
+		v.Add(sources.Path("data"), "User can not be mapped: "+err.Error())
+		return nil, v.Err()
+	}
+
+	return f, nil
+}
+
+/*
+list returns the values of a list separated by commas, such as the one of an
+environment variable. Values are trimmed, and the empty ones are dropped.
+*/
+func list(values string) []string {
+	trimmed := []string{}
+	for _, value := range strings.Split(values, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			trimmed = append(trimmed, value)
+		}
+	}
+
+	return trimmed
+}
@@ -0,0 +1,88 @@
+package destinations
+
+import (
+	"encoding/json"
+
+	"github.com/nunchistudio/blacksmith/adapter/store"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Canary splits the jobs of a queue between the ones of canary events and the
+others. It returns the IDs of the canary jobs, and a new queue containing only
+the other jobs.
+
+Actions must inform the scheduler the canary jobs have succeeded without loading
+them, so the canary trigger can check the whole pipeline without side effects.
+*/
+func Canary(queue *store.Queue) ([]string, *store.Queue) {
+	return split(queue, func(ctx *sources.Context) bool {
+		return ctx.Canary != ""
+	})
+}
+
+/*
+Jobs returns the IDs of the jobs of a queue.
+*/
+func Jobs(queue *store.Queue) []string {
+	ids := []string{}
+	for _, event := range queue.Events {
+		for _, job := range event.Jobs {
+			ids = append(ids, job.ID)
+		}
+	}
+
+	return ids
+}
+
+/*
+split splits the jobs of a queue between the ones matching a function and the
+others. The function receives the context of the event, overridden by the one of
+the job. It returns the IDs of the jobs matching, and a new queue containing only
+the other jobs.
+*/
+func split(queue *store.Queue, match func(*sources.Context) bool) ([]string, *store.Queue) {
+	matched := []string{}
+	rest := &store.Queue{
+		Events: []*store.Event{},
+	}
+
+	for _, event := range queue.Events {
+		eventCtx := unmarshal(event.Context)
+		jobs := []*store.Job{}
+		for _, job := range event.Jobs {
+			if match(eventCtx.Merge(unmarshal(job.Context))) {
+				matched = append(matched, job.ID)
+				continue
+			}
+
+			jobs = append(jobs, job)
+		}
+
+		if len(jobs) > 0 {
+			e := *event
+			e.Jobs = jobs
+			rest.Events = append(rest.Events, &e)
+		}
+	}
+
+	return matched, rest
+}
+
+/*
+unmarshal returns a marshaled context, or nil if it is empty or not valid.
+*/
+func unmarshal(b []byte) *sources.Context {
+	if len(b) == 0 {
+		return nil
+	}
+
+	var ctx *sources.Context
+	err := json.Unmarshal(b, &ctx)
+	if err != nil {
+		return nil
+	}
+
+	return ctx
+}
@@ -0,0 +1,46 @@
+package destinations
+
+import (
+	"github.com/nunchistudio/blacksmith/adapter/store"
+	"github.com/nunchistudio/blacksmith/flow/destination"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Consenting is implemented by the actions requiring the consent of the users, such
+as the ones sending users to a CRM. Flows do not run these actions for the users
+who have not granted every categories required.
+*/
+type Consenting interface {
+
+	// Consent returns the consent categories required by the action, such as
+	// "marketing".
+	Consent() []string
+}
+
+/*
+Required returns the consent categories required by an action, if any.
+*/
+func Required(action destination.Action) []string {
+	consenting, ok := action.(Consenting)
+	if !ok {
+		return nil
+	}
+
+	return consenting.Consent()
+}
+
+/*
+Unconsented splits the jobs of a queue between the ones of users who have not
+granted every consent categories required, and the others. It returns the IDs of
+the jobs without consent, and a new queue containing only the other jobs.
+
+Flows already skip the actions without consent, but actions requiring a consent
+must not load the jobs created otherwise, such as before the consent was required.
+*/
+func Unconsented(queue *store.Queue, required []string) ([]string, *store.Queue) {
+	return split(queue, func(ctx *sources.Context) bool {
+		return ctx.Canary == "" && len(ctx.Consent.Missing(required)) > 0
+	})
+}
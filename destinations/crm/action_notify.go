@@ -8,6 +8,7 @@ import (
 	"github.com/nunchistudio/blacksmith/adapter/store"
 	"github.com/nunchistudio/blacksmith/flow/destination"
 
+	"github.com/nunchistudio/smithy/destinations"
 	"github.com/nunchistudio/smithy/sources"
 )
 
@@ -90,6 +91,20 @@ In this case, since there is no error returned, the load will be a success.
 */
 func (a ActionNotify) Load(tk *destination.Toolkit, queue *store.Queue, then chan<- destination.Then) {
 
+	// Jobs of canary events are marked as succeeded right away, without being
+	// loaded into the destination.
+	canaries, queue := destinations.Canary(queue)
+	if len(canaries) > 0 {
+		then <- destination.Then{
+			Jobs: canaries,
+		}
+	}
+
+	jobs := destinations.Jobs(queue)
+	if len(jobs) == 0 {
+		return
+	}
+
 	// We can go through every events received from the queue and their related
 	// jobs. The jobs present in the events are specific to this action only.
 	var notifications = []Notification{}
@@ -107,15 +122,16 @@ func (a ActionNotify) Load(tk *destination.Toolkit, queue *store.Queue, then cha
 
 	// Whenever we are ready, we inform the scheduler about the jobs status.
 	// Since we do not do anything but to print a message, we inform the scheduler
-	// only once, with no error and no job IDs. When no job IDs are provided, the
-	// scheduler will mark every jobs from the queue as "succeeded", "failed", or
-	// "discarded".
+	// only once, with no error and the IDs of the remaining jobs. When no job IDs
+	// are provided, the scheduler would mark every jobs from the queue as
+	// "succeeded", "failed", or "discarded", including the canary ones.
 	//
 	// In this case since Error is nil every jobs will be marked as "succeeded".
 	// Otherwise, the scheduler will mark each job as "failed" or "discarded"
 	// given the current attempt number of the job and the max retries allowed by
 	// the action.
 	then <- destination.Then{
+		Jobs:  jobs,
 		Error: nil,
 	}
 }
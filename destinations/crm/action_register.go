@@ -8,6 +8,7 @@ import (
 	"github.com/nunchistudio/blacksmith/flow/destination"
 	"github.com/nunchistudio/blacksmith/helper/errors"
 
+	"github.com/nunchistudio/smithy/destinations"
 	"github.com/nunchistudio/smithy/sources"
 )
 
@@ -44,6 +45,14 @@ func (a ActionRegister) String() string {
 	return "register"
 }
 
+/*
+Consent returns the consent categories required by the action. Users are only
+sent to the CRM if they consented to marketing.
+*/
+func (a ActionRegister) Consent() []string {
+	return []string{"marketing"}
+}
+
 /*
 Schedule allows the action to override the schedule options of its destination.
 
@@ -68,13 +77,22 @@ func (a ActionRegister) Marshal(tk *destination.Toolkit) (*destination.Payload,
 		return nil, err
 	}
 
-	// Create a payload with the data. Since the 'Context' key is not set, the one
-	// from the event will automatically be applied.
+	// Create a payload with the data. If the flow did not set the "Context" key,
+	// the one from the event will automatically be applied.
 	p := &destination.Payload{
 		Data:   data,
 		SentAt: a.SentAt,
 	}
 
+	// Marshal the context if the flow passed a specific one, such as the context
+	// of an item received within a batch.
+	if a.Context != nil {
+		p.Context, err = json.Marshal(a.Context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Return the payload with the marshaled data.
 	return p, nil
 }
@@ -88,6 +106,39 @@ In this case, since there is no error returned, the load will be a success.
 */
 func (a ActionRegister) Load(tk *destination.Toolkit, queue *store.Queue, then chan<- destination.Then) {
 
+	// Jobs of canary events are marked as succeeded right away, without being
+	// loaded into the destination.
+	canaries, queue := destinations.Canary(queue)
+	if len(canaries) > 0 {
+		then <- destination.Then{
+			Jobs: canaries,
+		}
+	}
+
+	// Jobs of users who have not consented to marketing are discarded without
+	// being loaded nor notified. Flows do not create such jobs, but they may have
+	// been created before the consent was required.
+	unconsented, queue := destinations.Unconsented(queue, a.Consent())
+	if len(unconsented) > 0 {
+		then <- destination.Then{
+			Jobs: unconsented,
+			Error: &errors.Error{
+				StatusCode: 403,
+				Message:    "Consent is missing",
+				Validations: []errors.Validation{
+					{
+						Message: "User has not consented to marketing",
+						Path:    []string{"request", "payload", "context", "consent", "categories"},
+					},
+				},
+			},
+			ForceDiscard: true,
+			OnFailed:     []destination.Action{},
+			OnDiscarded:  []destination.Action{},
+			OnSucceeded:  []destination.Action{},
+		}
+	}
+
 	// We can go through every events received from the queue and their related
 	// jobs. The jobs present in the events are specific to this action only.
 	for _, event := range queue.Events {
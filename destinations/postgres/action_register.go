@@ -7,6 +7,7 @@ import (
 	"github.com/nunchistudio/blacksmith/adapter/store"
 	"github.com/nunchistudio/blacksmith/flow/destination"
 
+	"github.com/nunchistudio/smithy/destinations"
 	"github.com/nunchistudio/smithy/sources"
 )
 
@@ -71,13 +72,22 @@ func (a ActionRegister) Marshal(tk *destination.Toolkit) (*destination.Payload,
 		return nil, err
 	}
 
-	// Create a payload with the data. Since the "Context" key is not set, the one
-	// from the event will automatically be applied.
+	// Create a payload with the data. If the flow did not set the "Context" key,
+	// the one from the event will automatically be applied.
 	p := &destination.Payload{
 		Data:   buff,
 		SentAt: a.SentAt,
 	}
 
+	// Marshal the context if the flow passed a specific one, such as the context
+	// of an item received within a batch.
+	if a.Context != nil {
+		p.Context, err = json.Marshal(a.Context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Return the payload with the marshaled data.
 	return p, nil
 }
@@ -91,18 +101,34 @@ In this case, since there is no error returned, the load will be a success.
 */
 func (a ActionRegister) Load(tk *destination.Toolkit, queue *store.Queue, then chan<- destination.Then) {
 
+	// Jobs of canary events are marked as succeeded right away, without being
+	// loaded into the destination.
+	canaries, queue := destinations.Canary(queue)
+	if len(canaries) > 0 {
+		then <- destination.Then{
+			Jobs: canaries,
+		}
+	}
+
+	jobs := destinations.Jobs(queue)
+	if len(jobs) == 0 {
+		return
+	}
+
 	// Do something...
 
 	// Whenever we are ready, we inform the scheduler about the jobs status.
 	// Since we do not do anything, we inform the scheduler only once, with no
-	// error and no job IDs. When no job IDs are provided, the scheduler will mark
-	// every jobs from the queue as "succeeded", "failed", or "discarded".
+	// error and the IDs of the remaining jobs. When no job IDs are provided, the
+	// scheduler would mark every jobs from the queue as "succeeded", "failed", or
+	// "discarded", including the canary ones.
 	//
 	// In this case since Error is nil every jobs will be marked as "succeeded".
 	// Otherwise, the scheduler will mark each job as "failed" or "discarded"
 	// given the current attempt number of the job and the max retries allowed by
 	// the action.
 	then <- destination.Then{
+		Jobs:  jobs,
 		Error: nil,
 	}
 }
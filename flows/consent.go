@@ -0,0 +1,78 @@
+package flows
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/destination"
+
+	"github.com/nunchistudio/smithy/destinations"
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Consented returns the actions of a flow the user has consented to, given the
+consent of the context. Actions requiring consent categories the user has not
+granted are not run, so no job is created for them. They are recorded in the
+"smithy.unconsented" table along the reason instead, so they can be audited.
+
+Canary events are never filtered so the canary checks every action.
+*/
+func Consented(tk *flow.Toolkit, name string, ctx *sources.Context, actions destination.Actions) destination.Actions {
+	if ctx != nil && ctx.Canary != "" {
+		return actions
+	}
+
+	var consent *sources.Consent
+	if ctx != nil {
+		consent = ctx.Consent
+	}
+
+	consented := destination.Actions{}
+	for dest, list := range actions {
+		for _, action := range list {
+			missing := consent.Missing(destinations.Required(action))
+			if len(missing) == 0 {
+				consented[dest] = append(consented[dest], action)
+				continue
+			}
+
+			err := unconsented(name, dest, action, missing, consent)
+			if err != nil {
+				tk.Logger.Error(name + ": Failed to record action without consent: " + err.Error())
+			}
+		}
+	}
+
+	return consented
+}
+
+/*
+unconsented records an action skipped because the user has not granted every
+consent categories it requires.
+*/
+func unconsented(name string, dest string, action destination.Action, missing []string, consent *sources.Consent) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	given, err := json.Marshal(consent)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+
+	reason := "Consent to \"" + strings.Join(missing, "\", \"") + "\" is missing"
+	_, err = db.Exec(`
+		INSERT INTO smithy.unconsented (flow, destination, action, missing, reason, consent, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);
+	`, name, dest, action.String(), pq.Array(missing), reason, given, data)
+	return err
+}
@@ -0,0 +1,245 @@
+package expr
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+Type is the type of the value of an expression, as known when type-checking it.
+Its string representation is used in the error messages.
+*/
+type Type string
+
+/*
+The types of the values of the expressions. Dates are kept as strings at runtime,
+the way they are marshaled in JSON. Any is used when the type can only be known
+at runtime, such as within raw JSON.
+*/
+const (
+	Any    Type = "unknown"
+	Null   Type = "null"
+	String Type = "a string"
+	Number Type = "a number"
+	Bool   Type = "a boolean"
+	Time   Type = "a date"
+	List   Type = "a list"
+	Object Type = "an object"
+)
+
+/*
+Scope is what an expression is type-checked against.
+*/
+type Scope struct {
+
+	// Resolve returns the type of the value at a path, such as "data.email". It
+	// returns false if the path does not exist.
+	Resolve func(path []string) (Type, bool)
+
+	// Lookups are the lookup tables the expression can use with the "lookup"
+	// function, by name.
+	Lookups map[string]map[string]string
+}
+
+/*
+Env is what an expression is evaluated against.
+*/
+type Env struct {
+
+	// Doc is the JSON document the paths of the expression are read from.
+	Doc map[string]interface{}
+
+	// Timezone is the timezone dates are formatted in, such as the one of the
+	// context of the event. Dates are formatted in UTC if empty or unknown.
+	Timezone string
+}
+
+/*
+Expression is an expression parsed once, and evaluated for every event. It is
+sandboxed: it can only read the values of its environment and call the functions
+of the language.
+*/
+type Expression struct {
+	source string
+	root   node
+}
+
+/*
+Error is the error returned when an expression can not be parsed, type-checked,
+or evaluated.
+*/
+type Error struct {
+
+	// Expression is the source of the expression.
+	Expression string
+
+	// Position is the position of the error in the expression, starting at 1. It
+	// is 0 if the error does not relate to a position.
+	Position int
+
+	// Message is the reason of the error.
+	Message string
+}
+
+/*
+Error returns the message of the error along the expression.
+*/
+func (err *Error) Error() string {
+	message := "Expression `" + err.Expression + "`: " + err.Message
+	if err.Position > 0 {
+		message += " at position " + strconv.Itoa(err.Position)
+	}
+
+	return message
+}
+
+/*
+Parse parses an expression. An error is returned if the expression is not
+syntactically valid.
+*/
+func Parse(source string) (*Expression, error) {
+	p := &parser{
+		source: source,
+	}
+
+	x := &Expression{
+		source: source,
+	}
+
+	err := p.tokenize()
+	if err != nil {
+		return nil, x.wrap(err)
+	}
+
+	x.root, err = p.parse()
+	if err != nil {
+		return nil, x.wrap(err)
+	}
+
+	return x, nil
+}
+
+/*
+Compile parses an expression and type-checks it against a scope. It returns the
+type of the value of the expression.
+*/
+func Compile(source string, scope *Scope) (*Expression, Type, error) {
+	x, err := Parse(source)
+	if err != nil {
+		return nil, Any, err
+	}
+
+	t, err := x.Check(scope)
+	if err != nil {
+		return nil, Any, err
+	}
+
+	return x, t, nil
+}
+
+/*
+Check type-checks the expression against a scope, and returns the type of its
+value. Lookup tables are bound to the expression when checked.
+*/
+func (x *Expression) Check(scope *Scope) (Type, error) {
+	if scope == nil {
+		scope = &Scope{}
+	}
+
+	t, err := x.root.check(scope)
+	if err != nil {
+		return Any, x.wrap(err)
+	}
+
+	return t, nil
+}
+
+/*
+Eval evaluates the expression against an environment. Paths missing from the
+environment evaluate to nil.
+*/
+func (x *Expression) Eval(env *Env) (interface{}, error) {
+	if env == nil {
+		env = &Env{}
+	}
+
+	value, err := x.root.eval(env)
+	if err != nil {
+		return nil, x.wrap(err)
+	}
+
+	return value, nil
+}
+
+/*
+String returns the source of the expression.
+*/
+func (x *Expression) String() string {
+	return x.source
+}
+
+/*
+Path returns the path read by the expression if it is nothing more than a path,
+such as "data.email".
+*/
+func (x *Expression) Path() (string, bool) {
+	p, ok := x.root.(*path)
+	if !ok {
+		return "", false
+	}
+
+	return strings.Join(p.keys, "."), true
+}
+
+/*
+wrap sets the source of the expression to an error.
+*/
+func (x *Expression) wrap(err error) error {
+	if e, ok := err.(*Error); ok {
+		e.Expression = x.source
+		return e
+	}
+
+	return &Error{
+		Expression: x.source,
+		Message:    err.Error(),
+	}
+}
+
+/*
+Assignable returns whether a value of a type can be assigned to a field of another
+type. Unknown types are always assignable, as well as null. Dates can be assigned
+to strings since they are strings at runtime.
+*/
+func Assignable(from Type, to Type) bool {
+	return from == Any || to == Any || from == Null || from == to || (from == Time && to == String)
+}
+
+/*
+unify returns the type of a value being either one of two types, such as the
+branches of a condition. It returns false if the types are not compatible.
+*/
+func unify(a Type, b Type) (Type, bool) {
+	switch {
+	case a == b:
+		return a, true
+	case a == Null:
+		return b, true
+	case b == Null:
+		return a, true
+	case a == Any || b == Any:
+		return Any, true
+	case (a == Time && b == String) || (a == String && b == Time):
+		return String, true
+	}
+
+	return Any, false
+}
+
+/*
+accepts returns whether a value of a type can be passed where another type is
+expected. Strings are accepted as dates, since dates are strings at runtime.
+*/
+func accepts(expected Type, t Type) bool {
+	return expected == Any || t == Any || t == Null || expected == t || (expected == Time && t == String) || (expected == String && t == Time)
+}
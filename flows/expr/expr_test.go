@@ -0,0 +1,214 @@
+package expr
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	doc := map[string]interface{}{
+		"data": map[string]interface{}{
+			"first_name": "jane",
+			"last_name":  "doe",
+			"email":      "Jane@Example.COM",
+			"age":        float64(42),
+		},
+	}
+
+	tests := map[string]interface{}{
+		`upper(data.last_name)`:                         "DOE",
+		`lower(data.email)`:                             "jane@example.com",
+		`title(data.first_name) + " " + data.last_name`: "Jane doe",
+		`data.age + 1`:                                  float64(43),
+		`data.age >= 18 ? "adult" : "minor"`:            "adult",
+		`default(data.missing, "none")`:                 "none",
+		`len(data.first_name)`:                          float64(4),
+		`contains(data.email, "@")`:                     true,
+		`data.missing`:                                  nil,
+	}
+
+	for source, expected := range tests {
+		t.Run(source, func(t *testing.T) {
+			x, err := Parse(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, err := x.Eval(&Env{Doc: doc})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(value, expected) {
+				t.Fatalf("expected %#v, got %#v", expected, value)
+			}
+		})
+	}
+}
+
+func TestSubstr(t *testing.T) {
+	x, err := Parse(`substr(data.value, data.start, data.length)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		start    float64
+		length   float64
+		expected string
+	}{
+		"within bounds":     {1, 3, "éll"},
+		"negative start":    {-2, 2, "hé"},
+		"start too large":   {10, 2, ""},
+		"negative length":   {1, -2, ""},
+		"length too large":  {2, 10, "llo"},
+		"huge length":       {1, 1e300, "éllo"},
+		"huge start":        {1e300, 1e300, ""},
+		"max int length":    {1, float64(math.MaxInt64), "éllo"},
+		"negative huge":     {-1e300, -1e300, ""},
+		"fractional values": {1.9, 2.9, "él"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value, err := x.Eval(&Env{Doc: map[string]interface{}{
+				"data": map[string]interface{}{
+					"value":  "héllo",
+					"start":  test.start,
+					"length": test.length,
+				},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if value != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, value)
+			}
+		})
+	}
+
+	for _, invalid := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := x.Eval(&Env{Doc: map[string]interface{}{
+			"data": map[string]interface{}{
+				"value":  "héllo",
+				"start":  float64(0),
+				"length": invalid,
+			},
+		}})
+		if err == nil || !strings.Contains(err.Error(), "finite") {
+			t.Fatalf("expected an error for %v, got %v", invalid, err)
+		}
+	}
+}
+
+type source struct {
+	Name     string            `json:"name"`
+	Nickname string            `json:"nickname,omitempty"`
+	Age      int               `json:"age"`
+	Score    *float64          `json:"score"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	At       time.Time         `json:"at"`
+	Given    *time.Time        `json:"given,omitempty"`
+	Raw      json.RawMessage   `json:"raw,omitempty"`
+	Nested   *source           `json:"nested,omitempty"`
+	Ignored  string            `json:"-"`
+	hidden   string
+}
+
+type target struct {
+	Name  string      `json:"name"`
+	Age   int8        `json:"age"`
+	Score *float64    `json:"score"`
+	Tags  []string    `json:"tags"`
+	At    *time.Time  `json:"at"`
+	Any   interface{} `json:"any"`
+}
+
+func TestDocument(t *testing.T) {
+	score := 9.5
+	given := time.Date(2020, 8, 17, 10, 30, 0, 0, time.FixedZone("CEST", 2*3600))
+	values := []*source{
+		{},
+		{
+			Name:    "jane",
+			Age:     42,
+			Score:   &score,
+			Tags:    []string{"a", "b"},
+			Labels:  map[string]string{"plan": "pro"},
+			At:      time.Date(2020, 8, 17, 8, 30, 0, 123, time.UTC),
+			Given:   &given,
+			Nested:  &source{Name: "john", Nickname: "jo"},
+			Ignored: "ignored",
+			hidden:  "hidden",
+		},
+		{Raw: json.RawMessage(`{"key":[1,"two"]}`)},
+	}
+
+	for i, value := range values {
+		doc, err := Document(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]interface{}{}
+		err = unmarshal(value, &expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(doc, expected) {
+			t.Fatalf("value %d: expected %#v, got %#v", i, expected, doc)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	m, err := NewMapping(map[string]string{
+		"name":  `upper(name)`,
+		"age":   `age + 1`,
+		"score": `score`,
+		"tags":  `tags`,
+		"at":    `at`,
+		"any":   `nested.name`,
+	}, reflect.TypeOf(source{}), reflect.TypeOf(target{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	score := 9.5
+	at := time.Date(2020, 8, 17, 8, 30, 0, 0, time.UTC)
+	s := &source{
+		Name:   "jane",
+		Age:    41,
+		Score:  &score,
+		Tags:   []string{"a"},
+		At:     at,
+		Nested: &source{Name: "john"},
+	}
+
+	var applied target
+	err = m.Apply(s, &applied, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if applied.Name != "JANE" || applied.Age != 42 || applied.Score == nil || *applied.Score != 9.5 {
+		t.Fatalf("unexpected target: %+v", applied)
+	}
+
+	if !reflect.DeepEqual(applied.Tags, []string{"a"}) || applied.At == nil || !applied.At.Equal(at) || applied.Any != "john" {
+		t.Fatalf("unexpected target: %+v", applied)
+	}
+
+	s.Age = 200
+	err = m.Apply(s, &applied, "")
+	if err == nil || !strings.Contains(err.Error(), "age") {
+		t.Fatalf("expected an error for a number not fitting in the field, got %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package expr
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+function is a function of the language. Its result is either a fixed type, or
+computed given the types of its arguments.
+*/
+type function struct {
+	params  []Type
+	returns Type
+	result  func([]Type) (Type, error)
+	call    func(*Env, []interface{}) (interface{}, error)
+}
+
+/*
+functions are the functions of the language, by name. The "lookup" function is
+not listed since its first argument must be known when type-checking.
+*/
+var functions = map[string]*function{
+	"upper": {
+		params:  []Type{String},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.ToUpper(toString(args[0])), nil
+		},
+	},
+	"lower": {
+		params:  []Type{String},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.ToLower(toString(args[0])), nil
+		},
+	},
+	"trim": {
+		params:  []Type{String},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.TrimSpace(toString(args[0])), nil
+		},
+	},
+	"title": {
+		params:  []Type{String},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.Title(strings.ToLower(toString(args[0]))), nil
+		},
+	},
+	"replace": {
+		params:  []Type{String, String, String},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.ReplaceAll(toString(args[0]), toString(args[1]), toString(args[2])), nil
+		},
+	},
+	"substr": {
+		params:  []Type{String, Number, Number},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			runes := []rune(toString(args[0]))
+			start, _ := args[1].(float64)
+			length, _ := args[2].(float64)
+			if !finite(start) || !finite(length) {
+				return nil, &Error{Message: "Start and length must be finite numbers"}
+			}
+
+			// The length is bounded before being added to the start, so it can not
+			// overflow.
+			from := bound(start, len(runes))
+			to := from + bound(length, len(runes)-from)
+			return string(runes[from:to]), nil
+		},
+	},
+	"len": {
+		params:  []Type{Any},
+		returns: Number,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			switch value := args[0].(type) {
+			case []interface{}:
+				return float64(len(value)), nil
+			case map[string]interface{}:
+				return float64(len(value)), nil
+			}
+
+			return float64(utf8.RuneCountInString(toString(args[0]))), nil
+		},
+	},
+	"contains": {
+		params:  []Type{String, String},
+		returns: Bool,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.Contains(toString(args[0]), toString(args[1])), nil
+		},
+	},
+	"starts_with": {
+		params:  []Type{String, String},
+		returns: Bool,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.HasPrefix(toString(args[0]), toString(args[1])), nil
+		},
+	},
+	"ends_with": {
+		params:  []Type{String, String},
+		returns: Bool,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return strings.HasSuffix(toString(args[0]), toString(args[1])), nil
+		},
+	},
+	"string": {
+		params:  []Type{Any},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			return toString(args[0]), nil
+		},
+	},
+	"default": {
+		params: []Type{Any, Any},
+		result: func(types []Type) (Type, error) {
+			t, ok := unify(types[0], types[1])
+			if !ok {
+				return Any, &Error{
+					Message: "Both values of function \"default\" must have the same type, but are " + string(types[0]) + " and " + string(types[1]),
+				}
+			}
+
+			return t, nil
+		},
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			if args[0] == nil || args[0] == "" {
+				return args[1], nil
+			}
+
+			return args[0], nil
+		},
+	},
+	"date": {
+		params:  []Type{Time, String},
+		returns: String,
+		call: func(env *Env, args []interface{}) (interface{}, error) {
+			if args[0] == nil || args[0] == "" {
+				return nil, nil
+			}
+
+			t, err := time.Parse(time.RFC3339Nano, toString(args[0]))
+			if err != nil {
+				return nil, err
+			}
+
+			return t.In(location(env.Timezone)).Format(toString(args[1])), nil
+		},
+	},
+}
+
+/*
+lookup reads the value of a key in a lookup table, such as
+"lookup('countries', context.location.country)". It evaluates to null if the key
+is missing, so a value can be set using "default".
+*/
+type lookup struct {
+	position int
+	table    string
+	key      node
+	values   map[string]string
+}
+
+/*
+newLookup returns a call to the "lookup" function. The name of the table must be
+a string, so the table can be known when type-checking.
+*/
+func newLookup(position int, args []node) (node, error) {
+	if len(args) != 2 {
+		return nil, &Error{
+			Position: position,
+			Message:  "Function \"lookup\" expects " + arguments(2) + " but got " + strconv.Itoa(len(args)),
+		}
+	}
+
+	table, ok := args[0].(*literal)
+	if !ok || table.typ != String {
+		return nil, &Error{
+			Position: position,
+			Message:  "Argument 1 of function \"lookup\" must be the name of a table, within quotes",
+		}
+	}
+
+	return &lookup{
+		position: position,
+		table:    table.value.(string),
+		key:      args[1],
+	}, nil
+}
+
+func (n *lookup) check(s *Scope) (Type, error) {
+	values, exists := s.Lookups[n.table]
+	if !exists {
+		return Any, &Error{
+			Position: n.position,
+			Message:  "Lookup table \"" + n.table + "\" does not exist",
+		}
+	}
+
+	t, err := n.key.check(s)
+	if err != nil {
+		return Any, err
+	}
+
+	if !accepts(String, t) && t != Number {
+		return Any, &Error{
+			Position: n.position,
+			Message:  "Argument 2 of function \"lookup\" must be a string but is " + string(t),
+		}
+	}
+
+	n.values = values
+	return String, nil
+}
+
+func (n *lookup) eval(env *Env) (interface{}, error) {
+	if n.values == nil {
+		return nil, &Error{
+			Position: n.position,
+			Message:  "Lookup table \"" + n.table + "\" has not been checked",
+		}
+	}
+
+	key, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	value, exists := n.values[toString(key)]
+	if !exists {
+		return nil, nil
+	}
+
+	return value, nil
+}
+
+/*
+locations caches the timezones loaded, by name.
+*/
+var locations sync.Map
+
+/*
+location returns the timezone of a name, or UTC if the name is empty or unknown.
+*/
+func location(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+
+	if loc, exists := locations.Load(name); exists {
+		return loc.(*time.Location)
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	locations.Store(name, loc)
+	return loc
+}
+
+/*
+truthy returns whether a value is considered as true in a condition. Null, false,
+zero, and empty strings are false.
+*/
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+
+	return true
+}
+
+/*
+toString returns the string representation of a value. Null is an empty string.
+*/
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+/*
+typeOf returns the type of a value at runtime.
+*/
+func typeOf(value interface{}) Type {
+	switch value.(type) {
+	case nil:
+		return Null
+	case string:
+		return String
+	case float64:
+		return Number
+	case bool:
+		return Bool
+	case []interface{}:
+		return List
+	case map[string]interface{}:
+		return Object
+	}
+
+	return Any
+}
+
+/*
+finite returns whether a number is neither NaN nor infinite.
+*/
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+/*
+bound returns a number as an index within the bounds of a list of a length. The
+number is bounded before being converted, so large numbers do not overflow.
+*/
+func bound(f float64, length int) int {
+	if f <= 0 {
+		return 0
+	}
+
+	if f >= float64(length) {
+		return length
+	}
+
+	return int(f)
+}
@@ -0,0 +1,177 @@
+package expr
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+/*
+Mapping is a set of expressions, each one computing a field of a target from the
+fields of a source. It is compiled and type-checked once, and evaluated for every
+event.
+*/
+type Mapping struct {
+	fields      []string
+	expressions map[string]*Expression
+}
+
+/*
+NewMapping compiles the expressions of a mapping, by field of the target. The
+expressions are type-checked against the source, and their values against the
+fields of the target.
+*/
+func NewMapping(expressions map[string]string, from reflect.Type, to reflect.Type, lookups map[string]map[string]string) (*Mapping, error) {
+	m := &Mapping{
+		fields:      []string{},
+		expressions: map[string]*Expression{},
+	}
+
+	scope := &Scope{
+		Resolve: Resolver(from),
+		Lookups: lookups,
+	}
+
+	target := Resolver(to)
+	for field, source := range expressions {
+		m.fields = append(m.fields, field)
+		x, t, err := Compile(source, scope)
+		if err != nil {
+			return nil, err
+		}
+
+		expected, exists := target([]string{field})
+		if !exists {
+			return nil, &Error{
+				Expression: source,
+				Message:    "Field \"" + field + "\" does not exist in the target",
+			}
+		}
+
+		if !Assignable(t, expected) {
+			return nil, &Error{
+				Expression: source,
+				Message:    "Value is " + string(t) + " but field \"" + field + "\" is " + string(expected),
+			}
+		}
+
+		m.expressions[field] = x
+	}
+
+	sort.Strings(m.fields)
+	return m, nil
+}
+
+/*
+MustMapping is like NewMapping but panics if the mapping is not valid. It allows
+mappings declared in Go to fail when the application starts.
+*/
+func MustMapping(expressions map[string]string, from reflect.Type, to reflect.Type, lookups map[string]map[string]string) *Mapping {
+	m, err := NewMapping(expressions, from, to, lookups)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+/*
+Eval evaluates the mapping against an environment. It returns the values of the
+fields, except the null ones.
+*/
+func (m *Mapping) Eval(env *Env) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, field := range m.fields {
+		value, err := m.expressions[field].Eval(env)
+		if err != nil {
+			return nil, err
+		}
+
+		if value != nil {
+			values[field] = value
+		}
+	}
+
+	return values, nil
+}
+
+/*
+Apply evaluates the mapping against a source, and sets the values of the fields
+to the target. The source and the target are converted using their JSON keys.
+They are read and set directly, and only marshaled when their types can not be
+converted this way, such as when they marshal themselves.
+*/
+func (m *Mapping) Apply(source interface{}, target interface{}, timezone string) error {
+	doc, err := Document(source)
+	if err != nil {
+		return err
+	}
+
+	values, err := m.Eval(&Env{
+		Doc:      doc,
+		Timezone: timezone,
+	})
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return unmarshal(values, target)
+	}
+
+	v = v.Elem()
+	for _, field := range m.fields {
+		value, exists := values[field]
+		if !exists {
+			continue
+		}
+
+		i, found := indexByKey(v.Type(), field)
+		if !found {
+			continue
+		}
+
+		set, err := setValue(v.Field(i), value)
+		if !set {
+			err = unmarshal(value, v.Field(i).Addr().Interface())
+		}
+
+		if err != nil {
+			return &Error{
+				Expression: m.expressions[field].String(),
+				Message:    "Value can not be set to field \"" + field + "\": " + err.Error(),
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Document returns a value as a JSON document, so its paths can be read by the
+expressions.
+*/
+func Document(value interface{}) (map[string]interface{}, error) {
+	if converted, ok := valueOf(reflect.ValueOf(value)); ok {
+		if doc, ok := converted.(map[string]interface{}); ok {
+			return doc, nil
+		}
+	}
+
+	doc := map[string]interface{}{}
+	err := unmarshal(value, &doc)
+	return doc, err
+}
+
+/*
+unmarshal sets a value to a target by marshaling it in JSON.
+*/
+func unmarshal(value interface{}, target interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, target)
+}
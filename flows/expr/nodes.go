@@ -0,0 +1,401 @@
+package expr
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+node is a node of the tree of an expression.
+*/
+type node interface {
+
+	// check returns the type of the value of the node.
+	check(*Scope) (Type, error)
+
+	// eval returns the value of the node.
+	eval(*Env) (interface{}, error)
+}
+
+/*
+literal is a string, a number, a boolean, or null.
+*/
+type literal struct {
+	value interface{}
+	typ   Type
+}
+
+func (n *literal) check(s *Scope) (Type, error) {
+	return n.typ, nil
+}
+
+func (n *literal) eval(env *Env) (interface{}, error) {
+	return n.value, nil
+}
+
+/*
+path reads a value of the environment, such as "data.email".
+*/
+type path struct {
+	position int
+	keys     []string
+}
+
+func (n *path) check(s *Scope) (Type, error) {
+	if s.Resolve == nil {
+		return Any, nil
+	}
+
+	t, exists := s.Resolve(n.keys)
+	if !exists {
+		return Any, &Error{
+			Position: n.position,
+			Message:  "Field \"" + strings.Join(n.keys, ".") + "\" does not exist",
+		}
+	}
+
+	return t, nil
+}
+
+func (n *path) eval(env *Env) (interface{}, error) {
+	var value interface{} = env.Doc
+	for _, key := range n.keys {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+
+		value = object[key]
+	}
+
+	return value, nil
+}
+
+/*
+not negates a boolean.
+*/
+type not struct {
+	position int
+	operand  node
+}
+
+func (n *not) check(s *Scope) (Type, error) {
+	t, err := n.operand.check(s)
+	if err != nil {
+		return Any, err
+	}
+
+	if !accepts(Bool, t) {
+		return Any, &Error{
+			Position: n.position,
+			Message:  "Operator '!' expects a boolean but got " + string(t),
+		}
+	}
+
+	return Bool, nil
+}
+
+func (n *not) eval(env *Env) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	return !truthy(value), nil
+}
+
+/*
+ternary returns one of two values given a condition, such as "a ? b : c".
+*/
+type ternary struct {
+	cond      node
+	then      node
+	otherwise node
+}
+
+func (n *ternary) check(s *Scope) (Type, error) {
+	cond, err := n.cond.check(s)
+	if err != nil {
+		return Any, err
+	}
+
+	if !accepts(Bool, cond) {
+		return Any, &Error{
+			Message: "Condition must be a boolean but is " + string(cond),
+		}
+	}
+
+	then, err := n.then.check(s)
+	if err != nil {
+		return Any, err
+	}
+
+	otherwise, err := n.otherwise.check(s)
+	if err != nil {
+		return Any, err
+	}
+
+	t, ok := unify(then, otherwise)
+	if !ok {
+		return Any, &Error{
+			Message: "Both values of a condition must have the same type, but are " + string(then) + " and " + string(otherwise),
+		}
+	}
+
+	return t, nil
+}
+
+func (n *ternary) eval(env *Env) (interface{}, error) {
+	cond, err := n.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if truthy(cond) {
+		return n.then.eval(env)
+	}
+
+	return n.otherwise.eval(env)
+}
+
+/*
+binary is an operation between two values, such as "a + b" or "a == b".
+*/
+type binary struct {
+	operator string
+	position int
+	left     node
+	right    node
+}
+
+func (n *binary) check(s *Scope) (Type, error) {
+	left, err := n.left.check(s)
+	if err != nil {
+		return Any, err
+	}
+
+	right, err := n.right.check(s)
+	if err != nil {
+		return Any, err
+	}
+
+	mismatch := &Error{
+		Position: n.position,
+		Message:  "Operator '" + n.operator + "' can not be used between " + string(left) + " and " + string(right),
+	}
+
+	switch n.operator {
+	case "&&", "||":
+		if !accepts(Bool, left) || !accepts(Bool, right) {
+			return Any, mismatch
+		}
+
+		return Bool, nil
+
+	case "==", "!=":
+		if _, ok := unify(left, right); !ok {
+			return Any, mismatch
+		}
+
+		return Bool, nil
+
+	case "<", "<=", ">", ">=":
+		t, ok := unify(left, right)
+		if !ok || (t != Number && t != String && t != Any) {
+			return Any, mismatch
+		}
+
+		return Bool, nil
+	}
+
+	// The "+" operator adds numbers, and concatenates strings. Numbers must be
+	// converted to strings explicitly to be concatenated.
+	switch {
+	case left == Number && right == Number:
+		return Number, nil
+	case (left == Number && right == Any) || (left == Any && right == Number):
+		return Any, nil
+	case textual(left) && textual(right):
+		return String, nil
+	}
+
+	return Any, mismatch
+}
+
+func (n *binary) eval(env *Env) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Boolean operators do not evaluate their right operand if not needed.
+	switch n.operator {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.operator {
+	case "&&", "||":
+		return truthy(right), nil
+
+	case "==":
+		return equal(left, right), nil
+
+	case "!=":
+		return !equal(left, right), nil
+
+	case "<", "<=", ">", ">=":
+		return compare(n.operator, left, right)
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if lok && rok {
+		return l + r, nil
+	}
+
+	return toString(left) + toString(right), nil
+}
+
+/*
+call calls a function of the language.
+*/
+type call struct {
+	position int
+	name     string
+	fn       *function
+	args     []node
+}
+
+func (n *call) check(s *Scope) (Type, error) {
+	types := make([]Type, len(n.args))
+	for i, arg := range n.args {
+		t, err := arg.check(s)
+		if err != nil {
+			return Any, err
+		}
+
+		if !accepts(n.fn.params[i], t) {
+			return Any, &Error{
+				Position: n.position,
+				Message:  "Argument " + ordinal(i) + " of function \"" + n.name + "\" must be " + string(n.fn.params[i]) + " but is " + string(t),
+			}
+		}
+
+		types[i] = t
+	}
+
+	if n.fn.result != nil {
+		return n.fn.result(types)
+	}
+
+	return n.fn.returns, nil
+}
+
+func (n *call) eval(env *Env) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = value
+	}
+
+	value, err := n.fn.call(env, args)
+	if err != nil {
+		return nil, &Error{
+			Position: n.position,
+			Message:  "Function \"" + n.name + "\" failed: " + err.Error(),
+		}
+	}
+
+	return value, nil
+}
+
+/*
+equal returns whether two values are equal.
+*/
+func equal(a interface{}, b interface{}) bool {
+	switch a.(type) {
+	case map[string]interface{}, []interface{}:
+		return reflect.DeepEqual(a, b)
+	}
+
+	switch b.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+
+	return a == b
+}
+
+/*
+compare compares two numbers or two strings.
+*/
+func compare(operator string, a interface{}, b interface{}) (bool, error) {
+	var diff int
+	switch l := a.(type) {
+	case float64:
+		r, ok := b.(float64)
+		if !ok {
+			return false, &Error{Message: "Can not compare a number with " + string(typeOf(b))}
+		}
+
+		switch {
+		case l < r:
+			diff = -1
+		case l > r:
+			diff = 1
+		}
+
+	case string:
+		r, ok := b.(string)
+		if !ok {
+			return false, &Error{Message: "Can not compare a string with " + string(typeOf(b))}
+		}
+
+		diff = strings.Compare(l, r)
+
+	default:
+		return false, &Error{Message: "Can not compare " + string(typeOf(a))}
+	}
+
+	switch operator {
+	case "<":
+		return diff < 0, nil
+	case "<=":
+		return diff <= 0, nil
+	case ">":
+		return diff > 0, nil
+	}
+
+	return diff >= 0, nil
+}
+
+/*
+textual returns whether a type can be concatenated as a string.
+*/
+func textual(t Type) bool {
+	return t == String || t == Time || t == Null || t == Any
+}
+
+/*
+ordinal returns the position of an argument, starting at 1.
+*/
+func ordinal(i int) string {
+	return strconv.Itoa(i + 1)
+}
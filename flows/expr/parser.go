@@ -0,0 +1,466 @@
+package expr
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+token is a token of an expression. Its position starts at 1.
+*/
+type token struct {
+	kind     string
+	text     string
+	position int
+}
+
+/*
+The kinds of the tokens.
+*/
+const (
+	tokenEnd    = "end"
+	tokenIdent  = "identifier"
+	tokenString = "string"
+	tokenNumber = "number"
+	tokenSymbol = "symbol"
+)
+
+/*
+symbols are the symbols of the language. Symbols of two characters are listed
+first so they are matched before the ones of a single character.
+*/
+var symbols = []string{
+	"==", "!=", "<=", ">=", "&&", "||",
+	"(", ")", ",", ".", "?", ":", "+", "!", "<", ">",
+}
+
+/*
+parser parses an expression using a recursive descent, from the operators with
+the lowest precedence to the ones with the highest:
+
+	condition ? then : else
+	||
+	&&
+	==  !=
+	<  <=  >  >=
+	+
+	!
+*/
+type parser struct {
+	source  string
+	tokens  []token
+	current int
+}
+
+/*
+tokenize splits the source of the expression into tokens.
+*/
+func (p *parser) tokenize() error {
+	src := p.source
+	i := 0
+
+next:
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"' || c == '\'':
+			start := i
+			text, end, err := p.unquote(i)
+			if err != nil {
+				return err
+			}
+
+			p.tokens = append(p.tokens, token{tokenString, text, start + 1})
+			i = end
+
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && ((src[i] >= '0' && src[i] <= '9') || src[i] == '.') {
+				i++
+			}
+
+			p.tokens = append(p.tokens, token{tokenNumber, src[start:i], start + 1})
+
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(src) && (src[i] == '_' || (src[i] >= 'a' && src[i] <= 'z') || (src[i] >= 'A' && src[i] <= 'Z') || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+
+			p.tokens = append(p.tokens, token{tokenIdent, src[start:i], start + 1})
+
+		default:
+			for _, symbol := range symbols {
+				if strings.HasPrefix(src[i:], symbol) {
+					p.tokens = append(p.tokens, token{tokenSymbol, symbol, i + 1})
+					i += len(symbol)
+					continue next
+				}
+			}
+
+			return &Error{
+				Position: i + 1,
+				Message:  "Unexpected character '" + string(c) + "'",
+			}
+		}
+	}
+
+	p.tokens = append(p.tokens, token{tokenEnd, "", len(src) + 1})
+	return nil
+}
+
+/*
+unquote reads the string starting at a quote. It returns the string and the
+position following its closing quote.
+*/
+func (p *parser) unquote(start int) (string, int, error) {
+	src := p.source
+	quote := src[start]
+	var b strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case quote:
+			return b.String(), i + 1, nil
+
+		case '\\':
+			i++
+			if i == len(src) {
+				break
+			}
+
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '\'':
+				b.WriteByte(src[i])
+			default:
+				return "", 0, &Error{
+					Position: i,
+					Message:  "Unknown escape sequence '\\" + string(src[i]) + "'",
+				}
+			}
+
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+
+	return "", 0, &Error{
+		Position: start + 1,
+		Message:  "String is not closed",
+	}
+}
+
+/*
+parse parses the tokens into the tree of the expression.
+*/
+func (p *parser) parse() (node, error) {
+	if p.peek().kind == tokenEnd {
+		return nil, &Error{
+			Position: 1,
+			Message:  "Expression is empty",
+		}
+	}
+
+	root, err := p.condition()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, unexpected(t)
+	}
+
+	return root, nil
+}
+
+/*
+condition parses a condition, such as "a ? b : c".
+*/
+func (p *parser) condition() (node, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+
+	then, err := p.condition()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	otherwise, err := p.condition()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ternary{cond, then, otherwise}, nil
+}
+
+/*
+precedence lists the binary operators from the lowest precedence to the highest.
+*/
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+"},
+}
+
+/*
+binary parses the binary operators of a level of precedence, and the ones with
+a higher precedence.
+*/
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenSymbol || !contains(precedence[level], t.text) {
+			return left, nil
+		}
+
+		p.current++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binary{t.text, t.position, left, right}
+	}
+}
+
+/*
+unary parses a negation, such as "!a".
+*/
+func (p *parser) unary() (node, error) {
+	t := p.peek()
+	if !p.accept("!") {
+		return p.primary()
+	}
+
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &not{t.position, operand}, nil
+}
+
+/*
+primary parses a literal, a path, a function call, or an expression within
+parentheses.
+*/
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return &literal{t.text, String}, nil
+
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &Error{
+				Position: t.position,
+				Message:  "Number \"" + t.text + "\" is not valid",
+			}
+		}
+
+		return &literal{n, Number}, nil
+
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literal{true, Bool}, nil
+		case "false":
+			return &literal{false, Bool}, nil
+		case "null":
+			return &literal{nil, Null}, nil
+		}
+
+		if p.accept("(") {
+			return p.call(t)
+		}
+
+		keys := []string{t.text}
+		for p.accept(".") {
+			key := p.next()
+			if key.kind != tokenIdent {
+				return nil, unexpected(key)
+			}
+
+			keys = append(keys, key.text)
+		}
+
+		return &path{t.position, keys}, nil
+
+	case tokenSymbol:
+		if t.text == "(" {
+			inner, err := p.condition()
+			if err != nil {
+				return nil, err
+			}
+
+			return inner, p.expect(")")
+		}
+	}
+
+	return nil, unexpected(t)
+}
+
+/*
+call parses the arguments of a function call, once its opening parenthesis has
+been read.
+*/
+func (p *parser) call(name token) (node, error) {
+	args := []node{}
+	if !p.accept(")") {
+		for {
+			arg, err := p.condition()
+			if err != nil {
+				return nil, err
+			}
+
+			args = append(args, arg)
+			if p.accept(")") {
+				break
+			}
+
+			if err = p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if name.text == "lookup" {
+		return newLookup(name.position, args)
+	}
+
+	fn, exists := functions[name.text]
+	if !exists {
+		return nil, &Error{
+			Position: name.position,
+			Message:  "Function \"" + name.text + "\" does not exist",
+		}
+	}
+
+	if len(args) != len(fn.params) {
+		return nil, &Error{
+			Position: name.position,
+			Message:  "Function \"" + name.text + "\" expects " + arguments(len(fn.params)) + " but got " + strconv.Itoa(len(args)),
+		}
+	}
+
+	return &call{name.position, name.text, fn, args}, nil
+}
+
+/*
+peek returns the current token without consuming it.
+*/
+func (p *parser) peek() token {
+	return p.tokens[p.current]
+}
+
+/*
+next consumes the current token.
+*/
+func (p *parser) next() token {
+	t := p.tokens[p.current]
+	if t.kind != tokenEnd {
+		p.current++
+	}
+
+	return t
+}
+
+/*
+accept consumes the current token only if it is the given symbol.
+*/
+func (p *parser) accept(symbol string) bool {
+	t := p.peek()
+	if t.kind != tokenSymbol || t.text != symbol {
+		return false
+	}
+
+	p.current++
+	return true
+}
+
+/*
+expect consumes the current token, which must be the given symbol.
+*/
+func (p *parser) expect(symbol string) error {
+	if p.accept(symbol) {
+		return nil
+	}
+
+	t := p.peek()
+	if t.kind == tokenEnd {
+		return &Error{
+			Position: t.position,
+			Message:  "Expected '" + symbol + "' but the expression ended",
+		}
+	}
+
+	return &Error{
+		Position: t.position,
+		Message:  "Expected '" + symbol + "' but got '" + t.text + "'",
+	}
+}
+
+/*
+unexpected returns the error of an unexpected token.
+*/
+func unexpected(t token) error {
+	if t.kind == tokenEnd {
+		return &Error{
+			Position: t.position,
+			Message:  "Unexpected end of expression",
+		}
+	}
+
+	return &Error{
+		Position: t.position,
+		Message:  "Unexpected " + t.kind + " '" + t.text + "'",
+	}
+}
+
+/*
+arguments returns a number of arguments, such as "1 argument" or "2 arguments".
+*/
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+
+	return strconv.Itoa(n) + " arguments"
+}
+
+/*
+contains returns whether a list contains a value.
+*/
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
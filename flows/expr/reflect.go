@@ -0,0 +1,437 @@
+package expr
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+TypeOf returns the type of the values of a Go type once marshaled in JSON.
+*/
+func TypeOf(t reflect.Type) Type {
+	if t == nil {
+		return Any
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case unknown(t):
+		return Any
+	case t == reflect.TypeOf(time.Time{}):
+		return Time
+	case t.Kind() == reflect.String:
+		return String
+	case t.Kind() == reflect.Bool:
+		return Bool
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Float64:
+		return Number
+	case t.Kind() == reflect.Slice, t.Kind() == reflect.Array:
+		return List
+	}
+
+	return Object
+}
+
+/*
+Resolver returns the function resolving the type of the value at a path of a Go
+type, given the JSON keys of its fields. Paths within raw JSON or interfaces can
+not be known and resolve to Any.
+*/
+func Resolver(t reflect.Type) func(path []string) (Type, bool) {
+	return func(path []string) (Type, bool) {
+		field, exists := typeAt(t, path)
+		if !exists {
+			return Any, false
+		}
+
+		return TypeOf(field), true
+	}
+}
+
+/*
+typeAt returns the Go type at a path, or nil if it can not be known. It returns
+false if the path does not exist.
+*/
+func typeAt(t reflect.Type, path []string) (reflect.Type, bool) {
+	for _, key := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		if unknown(t) {
+			return nil, true
+		}
+
+		if t.Kind() == reflect.Map {
+			t = t.Elem()
+			continue
+		}
+
+		if t.Kind() != reflect.Struct || t == reflect.TypeOf(time.Time{}) {
+			return nil, false
+		}
+
+		field, found := fieldByKey(t, key)
+		if !found {
+			return nil, false
+		}
+
+		t = field
+	}
+
+	return t, true
+}
+
+/*
+fieldByKey returns the type of the field of a struct given its JSON key.
+*/
+func fieldByKey(t reflect.Type, key string) (reflect.Type, bool) {
+	i, found := indexByKey(t, key)
+	if !found {
+		return nil, false
+	}
+
+	return t.Field(i).Type, true
+}
+
+/*
+indexByKey returns the index of the field of a struct given its JSON key.
+*/
+func indexByKey(t reflect.Type, key string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		if name == key {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+/*
+valueOf returns a Go value as it would be once marshaled in JSON and unmarshaled
+in an interface, without marshaling it. It returns false if the value can not be
+converted this way, such as when its type marshals itself.
+*/
+func valueOf(v reflect.Value) (interface{}, bool) {
+	if !v.IsValid() {
+		return nil, true
+	}
+
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, true
+		}
+
+		if v.Kind() == reflect.Interface || !marshals(v.Type()) || v.Elem().Type() == reflect.TypeOf(time.Time{}) {
+			return valueOf(v.Elem())
+		}
+
+		return nil, false
+	}
+
+	if v.Type() == reflect.TypeOf(time.Time{}) {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), true
+	}
+
+	if marshals(v.Type()) {
+		return nil, false
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+
+	case reflect.Bool:
+		return v.Bool(), true
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, true
+		}
+
+		// Bytes are encoded in base64.
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil, false
+		}
+
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			value, ok := valueOf(v.Index(i))
+			if !ok {
+				return nil, false
+			}
+
+			list[i] = value
+		}
+
+		return list, true
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+
+		if v.IsNil() {
+			return nil, true
+		}
+
+		object := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value, ok := valueOf(iter.Value())
+			if !ok {
+				return nil, false
+			}
+
+			object[iter.Key().String()] = value
+		}
+
+		return object, true
+
+	case reflect.Struct:
+		return objectOf(v)
+	}
+
+	return nil, false
+}
+
+/*
+objectOf returns the fields of a struct by JSON key, omitting the empty ones if
+the key has the "omitempty" option. Embedded structs and fields encoded as
+strings are not supported.
+*/
+func objectOf(v reflect.Value) (interface{}, bool) {
+	t := v.Type()
+	object := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			return nil, false
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		options := strings.Split(field.Tag.Get("json"), ",")
+		name := options[0]
+		if name == "-" && len(options) == 1 {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		omitempty := false
+		for _, option := range options[1:] {
+			switch option {
+			case "omitempty":
+				omitempty = true
+			case "string":
+				return nil, false
+			}
+		}
+
+		if omitempty && empty(v.Field(i)) {
+			continue
+		}
+
+		value, ok := valueOf(v.Field(i))
+		if !ok {
+			return nil, false
+		}
+
+		object[name] = value
+	}
+
+	return object, true
+}
+
+/*
+setValue sets a value evaluated by an expression to a Go value, the same way it
+would be unmarshaled from JSON. It returns false if the value can not be set this
+way, such as when its type unmarshals itself.
+*/
+func setValue(v reflect.Value, value interface{}) (bool, error) {
+	if v.Type() == reflect.TypeOf(time.Time{}) {
+		s, ok := value.(string)
+		if !ok {
+			return false, nil
+		}
+
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return true, err
+		}
+
+		v.Set(reflect.ValueOf(t))
+		return true, nil
+	}
+
+	if unmarshals(v.Type()) {
+		return false, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		set, err := setValue(elem.Elem(), value)
+		if set && err == nil {
+			v.Set(elem)
+		}
+
+		return set, err
+
+	case reflect.Interface:
+		if v.NumMethod() > 0 || value == nil {
+			return false, nil
+		}
+
+		v.Set(reflect.ValueOf(value))
+		return true, nil
+
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return false, nil
+		}
+
+		v.SetString(s)
+		return true, nil
+
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return false, nil
+		}
+
+		v.SetBool(b)
+		return true, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, ok := value.(float64)
+		if !ok {
+			return false, nil
+		}
+
+		if f != math.Trunc(f) || v.OverflowInt(int64(f)) {
+			return true, errors.New("Number " + strconv.FormatFloat(f, 'f', -1, 64) + " does not fit in " + v.Type().String())
+		}
+
+		v.SetInt(int64(f))
+		return true, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f, ok := value.(float64)
+		if !ok {
+			return false, nil
+		}
+
+		if f < 0 || f != math.Trunc(f) || v.OverflowUint(uint64(f)) {
+			return true, errors.New("Number " + strconv.FormatFloat(f, 'f', -1, 64) + " does not fit in " + v.Type().String())
+		}
+
+		v.SetUint(uint64(f))
+		return true, nil
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := value.(float64)
+		if !ok {
+			return false, nil
+		}
+
+		if v.OverflowFloat(f) {
+			return true, errors.New("Number " + strconv.FormatFloat(f, 'f', -1, 64) + " does not fit in " + v.Type().String())
+		}
+
+		v.SetFloat(f)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+/*
+marshals returns whether a type marshals itself in JSON.
+*/
+func marshals(t reflect.Type) bool {
+	return t.Implements(marshaler) || t.Implements(textMarshaler) ||
+		(t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(marshaler))
+}
+
+/*
+unmarshals returns whether a type unmarshals itself from JSON.
+*/
+func unmarshals(t reflect.Type) bool {
+	return reflect.PtrTo(t).Implements(unmarshaler) || reflect.PtrTo(t).Implements(textUnmarshaler)
+}
+
+var (
+	marshaler       = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	unmarshaler     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+/*
+empty returns whether a value is empty, as defined by the "omitempty" option of
+the JSON keys.
+*/
+func empty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+/*
+unknown returns whether the fields of a type can not be known.
+*/
+func unknown(t reflect.Type) bool {
+	return t.Kind() == reflect.Interface || t == reflect.TypeOf(json.RawMessage{})
+}
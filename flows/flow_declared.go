@@ -0,0 +1,69 @@
+package flows
+
+import (
+	"encoding/json"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/destination"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Declared implements the flow.Flow interface for the flows declared in a YAML
+file. Its actions are created by the registry from the data of the event.
+*/
+type Declared struct {
+	options *flow.Options
+
+	Name string `json:"name"`
+
+	// EventContext is the context of the event, kept by the KeepContext middleware
+	// so the consent of the user can be respected.
+	EventContext *sources.Context `json:"event_context,omitempty"`
+
+	// Mapped is the data of the actions as mapped from the event by the registry.
+	// It is kept along with the flow so the actions can be created again when the
+	// flow is replayed.
+	Mapped []*Mapped `json:"mapped"`
+
+	actions destination.Actions
+}
+
+/*
+Mapped is the data of an action of a declared flow, as mapped from the event.
+*/
+type Mapped struct {
+
+	// Action is the action to run, such as "crm.register".
+	Action string `json:"action"`
+
+	// Data is the action as unmarshaled to create it, with its data and timestamp.
+	Data json.RawMessage `json:"data"`
+}
+
+/*
+Options returns the fow options. Declared flows are enabled but can be disabled
+using the toggles, given their name.
+*/
+func (f *Declared) Options() *flow.Options {
+	return &flow.Options{
+		Enabled: Switches.Enabled(f.Name, ""),
+	}
+}
+
+/*
+keepContext keeps the context of the event.
+*/
+func (f *Declared) keepContext(ctx *sources.Context) {
+	f.EventContext = ctx
+}
+
+/*
+Transform is the function being run by the scheduler when receiving the flow from the
+actions. The actions of a declared flow have already been mapped from the data of
+the event by the registry. Only the ones the user has consented to are run.
+*/
+func (f *Declared) Transform(tk *flow.Toolkit) destination.Actions {
+	return Consented(tk, f.Name, f.EventContext, f.actions)
+}
@@ -0,0 +1,47 @@
+package flows
+
+import (
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/destination"
+
+	"github.com/nunchistudio/smithy/destinations/crm"
+)
+
+/*
+OnAlert implements the flow.Flow interface. It notifies the operators of the
+application when something goes wrong, such as a pipeline being stuck.
+*/
+type OnAlert struct {
+	options *flow.Options
+
+	Email   string `json:"email"`
+	Message string `json:"message"`
+}
+
+/*
+Options returns the fow options. This flow is enabled but can be disabled
+whenever you want using the toggles.
+*/
+func (f *OnAlert) Options() *flow.Options {
+	return &flow.Options{
+		Enabled: Switches.Enabled("OnAlert", ""),
+	}
+}
+
+/*
+Transform is the function being run by the scheduler when receiving the flow from the
+actions. It is up to the flow to receive the data from sources and match it
+against the desired actions.
+*/
+func (f *OnAlert) Transform(tk *flow.Toolkit) destination.Actions {
+	return map[string][]destination.Action{
+		"crm": []destination.Action{
+			&crm.ActionNotify{
+				Data: &crm.Notification{
+					Email:   f.Email,
+					Message: f.Message,
+				},
+			},
+		},
+	}
+}
@@ -1,45 +1,118 @@
 package flows
 
 import (
+	"time"
+
 	"github.com/nunchistudio/blacksmith/flow"
 	"github.com/nunchistudio/blacksmith/flow/destination"
 
 	"github.com/nunchistudio/smithy/destinations/crm"
 	"github.com/nunchistudio/smithy/destinations/postgres"
+	"github.com/nunchistudio/smithy/sources"
 )
 
+/*
+OnRegisterRouter routes the actions of the "OnRegister" flow. Actions are run for
+every destinations until branches are configured.
+*/
+var OnRegisterRouter = &Router{
+	Flow: "OnRegister",
+}
+
 /*
 OnRegister implements the flow.Flow interface.
 */
 type OnRegister struct {
 	options *flow.Options
 
+	// Context is the context to apply to the actions. When nil, the context of
+	// the event is applied.
+	Context *sources.Context `json:"context,omitempty"`
+
+	// SentAt is the timestamp to apply to the actions, if any.
+	SentAt *time.Time `json:"sent_at,omitempty"`
+
+	// EventContext is the context of the event, kept by the KeepContext middleware
+	// so the router can evaluate it when the flow relies on the event's context.
+	EventContext *sources.Context `json:"event_context,omitempty"`
+
 	Username  string `json:"username"`
 	FullName  string `json:"full_name"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Email     string `json:"email"`
+
+	only string
 }
 
 /*
 Options returns the fow options. This flow is enabled but can be disabled
-whenever you want.
+whenever you want using the toggles.
 */
 func (f *OnRegister) Options() *flow.Options {
 	return &flow.Options{
-		Enabled: true,
+		Enabled: Switches.Enabled("OnRegister", ""),
 	}
 }
 
+/*
+FlowContext returns the context of the flow so the gateway can enrich it the same
+way it does for the event's context.
+*/
+func (f *OnRegister) FlowContext() *sources.Context {
+	return f.Context
+}
+
+/*
+Timestamp returns the timestamp of the flow so the gateway can correct it the same
+way it does for the event's timestamp.
+*/
+func (f *OnRegister) Timestamp() *time.Time {
+	return f.SentAt
+}
+
+/*
+SetTimestamp replaces the timestamp of the flow.
+*/
+func (f *OnRegister) SetTimestamp(sentAt *time.Time) {
+	f.SentAt = sentAt
+}
+
+/*
+keepContext keeps the context of the event.
+*/
+func (f *OnRegister) keepContext(ctx *sources.Context) {
+	f.EventContext = ctx
+}
+
+/*
+restrict restricts the actions routed to the ones of a destination, when the flow
+is replayed for this destination only.
+*/
+func (f *OnRegister) restrict(destination string) {
+	f.only = destination
+}
+
 /*
 Transform is the function being run by the scheduler when receiving the flow from the
 actions. It is up to the flow to receive the data from sources and match it
-against the desired actions.
+against the desired actions. The actions are routed by OnRegisterRouter, only for
+the destination replayed if any.
 */
 func (f *OnRegister) Transform(tk *flow.Toolkit) destination.Actions {
-	return map[string][]destination.Action{
+	s := subject(f.Email, f.Email, f.EventContext.Merge(f.Context), map[string]interface{}{
+		"username":   f.Username,
+		"full_name":  f.FullName,
+		"first_name": f.FirstName,
+		"last_name":  f.LastName,
+		"email":      f.Email,
+	})
+
+	return OnRegisterRouter.Transform(tk, f, s, only(map[string][]destination.Action{
 		"crm": []destination.Action{
 			&crm.ActionRegister{
+				Context: f.Context,
+				SentAt:  f.SentAt,
 				Data: &crm.User{
 					FullName: f.FullName,
 					Email:    f.Email,
@@ -48,6 +121,8 @@ func (f *OnRegister) Transform(tk *flow.Toolkit) destination.Actions {
 		},
 		"postgres": []destination.Action{
 			&postgres.ActionRegister{
+				Context: f.Context,
+				SentAt:  f.SentAt,
 				Data: &postgres.User{
 					FirstName: f.FirstName,
 					LastName:  f.LastName,
@@ -55,5 +130,5 @@ func (f *OnRegister) Transform(tk *flow.Toolkit) destination.Actions {
 				},
 			},
 		},
-	}
+	}, f.only))
 }
@@ -0,0 +1,175 @@
+package flows
+
+import (
+	"encoding/json"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/destination"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+replayable is the list of flows which can be replayed once kept while disabled,
+by name. Declared flows are replayed by creating their actions again using the
+registry.
+*/
+var replayable = map[string]func() flow.Flow{
+	"OnRegister": func() flow.Flow { return &OnRegister{} },
+	"OnAlert":    func() flow.Flow { return &OnAlert{} },
+}
+
+/*
+restricter is implemented by the flows routing their actions, so a replay only
+routes the actions of the destination replayed. Otherwise the other destinations
+would be evaluated again, and kept again if disabled.
+*/
+type restricter interface {
+	restrict(destination string)
+}
+
+/*
+Replayed implements the flow.Flow interface for the flows kept while disabled and
+replayed once enabled again. It runs the actions of the original flow, or only
+the ones of a destination if the destination was the one disabled.
+*/
+type Replayed struct {
+	options *flow.Options
+
+	// Flow is the name of the original flow.
+	Flow string `json:"flow"`
+
+	// Destination is the only destination to run the actions of, if any.
+	Destination string `json:"destination,omitempty"`
+
+	// Context is the context of the original event.
+	Context *sources.Context `json:"context,omitempty"`
+
+	// Data is the original flow, as marshaled when kept.
+	Data json.RawMessage `json:"data"`
+}
+
+/*
+Replay returns the flow to replay a flow kept while disabled. An error is returned
+if the flow can not be replayed.
+*/
+func Replay(name string, destination string, ctx *sources.Context, data json.RawMessage) (*Replayed, error) {
+	f := &Replayed{
+		Flow:        name,
+		Destination: destination,
+		Context:     ctx,
+		Data:        data,
+	}
+
+	_, err := f.original()
+	return f, err
+}
+
+/*
+Options returns the fow options. A replayed flow is enabled as long as the
+original flow is.
+*/
+func (f *Replayed) Options() *flow.Options {
+	return &flow.Options{
+		Enabled: Switches.Enabled(f.Flow, ""),
+	}
+}
+
+/*
+Transform is the function being run by the scheduler when receiving the flow from the
+actions. It returns the actions of the original flow, only for the destination
+set if any.
+*/
+func (f *Replayed) Transform(tk *flow.Toolkit) destination.Actions {
+	original, err := f.original()
+	if err != nil {
+		tk.Logger.Error(err.Error())
+		return destination.Actions{}
+	}
+
+	return only(original.Transform(tk), f.Destination)
+}
+
+/*
+only returns the actions of a destination, or every actions if no destination
+is set.
+*/
+func only(actions destination.Actions, dest string) destination.Actions {
+	if dest == "" {
+		return actions
+	}
+
+	restricted := destination.Actions{}
+	if list, exists := actions[dest]; exists {
+		restricted[dest] = list
+	}
+
+	return restricted
+}
+
+/*
+original returns the original flow, applying the context of the original event
+if the flow relied on it.
+*/
+func (f *Replayed) original() (flow.Flow, error) {
+	create, exists := replayable[f.Flow]
+	if !exists {
+		return f.declared()
+	}
+
+	original := create()
+	err := json.Unmarshal(f.Data, original)
+	if err != nil {
+		return nil, err
+	}
+
+	if restricted, ok := original.(restricter); ok {
+		restricted.restrict(f.Destination)
+	}
+
+	// The actions relying on the context of the original event must not rely on
+	// the context of the replay event instead.
+	if register, ok := original.(*OnRegister); ok && register.Context == nil {
+		register.Context = f.Context
+	}
+
+	return original, nil
+}
+
+/*
+declared returns the original flow when declared in a YAML file. Its actions are
+created again by the registry from the data mapped when the event was received.
+*/
+func (f *Replayed) declared() (flow.Flow, error) {
+	if declarations == nil {
+		return nil, &errors.Error{
+			StatusCode: 400,
+			Message:    "Flow " + f.Flow + " can not be replayed",
+		}
+	}
+
+	original := &Declared{}
+	err := json.Unmarshal(f.Data, original)
+	if err != nil {
+		return nil, err
+	}
+
+	if original.Name != f.Flow || len(original.Mapped) == 0 {
+		return nil, &errors.Error{
+			StatusCode: 400,
+			Message:    "Flow " + f.Flow + " can not be replayed",
+		}
+	}
+
+	if original.EventContext == nil {
+		original.EventContext = f.Context
+	}
+
+	err = declarations.restore(original)
+	if err != nil {
+		return nil, err
+	}
+
+	return original, nil
+}
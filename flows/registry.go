@@ -0,0 +1,483 @@
+package flows
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/destination"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nunchistudio/smithy/flows/expr"
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Definition is the definition of a flow declared in a YAML file.
+*/
+type Definition struct {
+
+	// Name is the name of the flow. It must be unique across the flows declared.
+	Name string `yaml:"name"`
+
+	// Triggers is the list of triggers the flow listens to, such as "api.register".
+	Triggers []string `yaml:"triggers"`
+
+	// Actions is the list of actions the flow fans out to.
+	Actions []*ActionDefinition `yaml:"actions"`
+}
+
+/*
+ActionDefinition is the definition of an action run by a declared flow.
+*/
+type ActionDefinition struct {
+
+	// Action is the action to run, such as "crm.register".
+	Action string `yaml:"action"`
+
+	// Data maps each field of the data of the action to an expression evaluated
+	// against the event, such as "data.email" or "lower(data.email)".
+	Data map[string]string `yaml:"data"`
+
+	expressions map[string]*expr.Expression
+}
+
+/*
+Registry holds the flows declared in a YAML file. It implements the Middleware
+interface of the sources, adding the declared flows listening to the trigger of
+every event going through the chain.
+
+The registry must be resolved against the sources and destinations of the
+application before processing events, so every trigger, action, and field is
+known.
+*/
+type Registry struct {
+	path        string
+	definitions []*Definition
+	lookups     map[string]map[string]string
+	actions     map[string]reflect.Type
+	resolved    bool
+}
+
+/*
+declarations is the last registry resolved. It creates again the actions of the
+declared flows when they are replayed.
+*/
+var declarations *Registry
+
+/*
+Load returns the registry of the flows declared in a YAML file. An error is
+returned if the file is malformed or if a flow is not valid, listing every
+invalid fields. The expressions of the actions are parsed once loaded.
+*/
+func Load(path string) (*Registry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Flows   []*Definition                `yaml:"flows"`
+		Lookups map[string]map[string]string `yaml:"lookups"`
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&file)
+	if err != nil {
+		return nil, &errors.Error{
+			StatusCode: 400,
+			Message:    path + ": " + err.Error(),
+		}
+	}
+
+	r := &Registry{
+		path:        path,
+		definitions: file.Flows,
+		lookups:     file.Lookups,
+	}
+
+	v := &sources.Validator{}
+	names := map[string]bool{}
+	for i, def := range r.definitions {
+		at := func(keys ...string) []string {
+			return append([]string{"flows", strconv.Itoa(i)}, keys...)
+		}
+
+		if def == nil {
+			v.Add(at(), "Flow must not be empty")
+			continue
+		}
+
+		if v.Required(at("name"), def.Name) && names[def.Name] {
+			v.Add(at("name"), "Flow \""+def.Name+"\" is already declared")
+		}
+
+		names[def.Name] = true
+		if len(def.Triggers) == 0 {
+			v.Add(at("triggers"), "Flow must listen to at least one trigger")
+		}
+
+		for j, trigger := range def.Triggers {
+			if _, _, ok := split(trigger); !ok {
+				v.Add(at("triggers", strconv.Itoa(j)), "Trigger must be written as \"<source>.<trigger>\"")
+			}
+		}
+
+		if len(def.Actions) == 0 {
+			v.Add(at("actions"), "Flow must run at least one action")
+		}
+
+		for j, action := range def.Actions {
+			if action == nil {
+				v.Add(at("actions", strconv.Itoa(j)), "Action must not be empty")
+				continue
+			}
+
+			if _, _, ok := split(action.Action); !ok {
+				v.Add(at("actions", strconv.Itoa(j), "action"), "Action must be written as \"<destination>.<action>\"")
+			}
+
+			action.expressions = map[string]*expr.Expression{}
+			for _, field := range fields(action.Data) {
+				x, err := expr.Parse(action.Data[field])
+				if err != nil {
+					v.Add(at("actions", strconv.Itoa(j), "data", field), err.Error())
+					continue
+				}
+
+				action.expressions[field] = x
+			}
+		}
+	}
+
+	return r, r.err(v)
+}
+
+/*
+Resolve resolves the triggers and actions of the declared flows against the
+sources and destinations of the application. Every field mapped must exist in
+the data of the actions, and its expression is type-checked against every
+triggers of the flow. The value of the expression must have a type compatible
+with the field.
+*/
+func (r *Registry) Resolve(srcs []*source.Options, dests []*destination.Options) error {
+	triggers := map[string]reflect.Type{}
+	for _, s := range srcs {
+		for name, t := range s.Load.Triggers() {
+			triggers[s.Load.String()+"."+name] = reflect.TypeOf(sources.Unwrap(t))
+		}
+	}
+
+	r.actions = map[string]reflect.Type{}
+	for _, d := range dests {
+		for name, a := range d.Load.Actions() {
+			r.actions[d.Load.String()+"."+name] = reflect.TypeOf(a)
+		}
+	}
+
+	v := &sources.Validator{}
+	for i, def := range r.definitions {
+		at := func(keys ...string) []string {
+			return append([]string{"flows", strconv.Itoa(i)}, keys...)
+		}
+
+		listened := map[string]reflect.Type{}
+		for j, trigger := range def.Triggers {
+			t, exists := triggers[trigger]
+			if !exists {
+				v.Add(at("triggers", strconv.Itoa(j)), "Trigger \""+trigger+"\" does not exist")
+				continue
+			}
+
+			listened[trigger] = t
+		}
+
+		for j, action := range def.Actions {
+			a, exists := r.actions[action.Action]
+			if !exists {
+				v.Add(at("actions", strconv.Itoa(j), "action"), "Action \""+action.Action+"\" does not exist")
+				continue
+			}
+
+			for _, field := range fields(action.Data) {
+				x, parsed := action.expressions[field]
+				if !parsed {
+					continue
+				}
+
+				location := at("actions", strconv.Itoa(j), "data", field)
+				to, exists := expr.Resolver(a)([]string{"data", field})
+				if !exists {
+					v.Add(location, "Action \""+action.Action+"\" has no field \"data."+field+"\"")
+					continue
+				}
+
+				for _, trigger := range def.Triggers {
+					t, exists := listened[trigger]
+					if !exists {
+						continue
+					}
+
+					from, err := x.Check(&expr.Scope{
+						Resolve: expr.Resolver(t),
+						Lookups: r.lookups,
+					})
+					if err != nil {
+						v.Add(location, "Trigger \""+trigger+"\": "+err.Error())
+						continue
+					}
+
+					if !expr.Assignable(from, to) {
+						v.Add(location, "Trigger \""+trigger+"\": Expression \""+x.String()+"\" is "+string(from)+" but field \""+field+"\" of action \""+action.Action+"\" is "+string(to))
+					}
+				}
+			}
+		}
+	}
+
+	err := r.err(v)
+	r.resolved = err == nil
+	if r.resolved {
+		declarations = r
+	}
+
+	return err
+}
+
+/*
+Process implements the sources.Middleware interface. It adds to the event the
+declared flows listening to its trigger. Flows whose data can not be evaluated
+against the event are skipped and logged along with the reason.
+*/
+func (r *Registry) Process(tk *source.Toolkit, e *sources.Event) error {
+	if !r.resolved {
+		return &errors.Error{
+			StatusCode: 500,
+			Message:    r.path + ": Flows have not been resolved",
+		}
+	}
+
+	trigger := e.Source + "." + e.Trigger
+	var env *expr.Env
+	for _, def := range r.definitions {
+		if !listens(def, trigger) {
+			continue
+		}
+
+		if env == nil {
+			doc, err := document(e)
+			if err != nil {
+				return err
+			}
+
+			env = &expr.Env{
+				Doc:      doc,
+				Timezone: e.Context.Timezone,
+			}
+		}
+
+		// A flow failing to map the data of the event is skipped, so the event and
+		// its other flows are still run.
+		f, err := r.declare(def, env, e.SentAt)
+		if err != nil {
+			tk.Logger.Warn(trigger + ": Skipping flow \"" + def.Name + "\": " + err.Error())
+			continue
+		}
+
+		e.Flows = append(e.Flows, f)
+	}
+
+	return nil
+}
+
+/*
+declare returns the flow of a definition for an event. The actions are created
+given their type, with their data evaluated from the event. Dates are formatted
+in the timezone of the event's context.
+*/
+func (r *Registry) declare(def *Definition, env *expr.Env, sentAt *time.Time) (*Declared, error) {
+	f := &Declared{
+		Name:    def.Name,
+		actions: destination.Actions{},
+	}
+
+	for _, action := range def.Actions {
+		data := map[string]interface{}{}
+		for field, x := range action.expressions {
+			value, err := x.Eval(env)
+			if err != nil {
+				return nil, &errors.Error{
+					StatusCode: 400,
+					Message:    r.path + ": Flow \"" + def.Name + "\" failed to map the data of action \"" + action.Action + "\": " + err.Error(),
+				}
+			}
+
+			if value != nil {
+				data[field] = value
+			}
+		}
+
+		b, err := json.Marshal(map[string]interface{}{
+			"data":    data,
+			"sent_at": sentAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		mapped := &Mapped{
+			Action: action.Action,
+			Data:   b,
+		}
+
+		err = r.create(f, mapped)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Mapped = append(f.Mapped, mapped)
+	}
+
+	return f, nil
+}
+
+/*
+restore creates again the actions of a declared flow kept while disabled, from
+the data mapped when the event was received. The expressions are not evaluated
+again, so the flow is replayed as it would have been run.
+*/
+func (r *Registry) restore(f *Declared) error {
+	f.actions = destination.Actions{}
+	for _, mapped := range f.Mapped {
+		err := r.create(f, mapped)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+create creates an action of a declared flow given its type, from the data mapped.
+*/
+func (r *Registry) create(f *Declared, mapped *Mapped) error {
+	t, exists := r.actions[mapped.Action]
+	if !exists {
+		return &errors.Error{
+			StatusCode: 400,
+			Message:    r.path + ": Flow \"" + f.Name + "\" has no action \"" + mapped.Action + "\"",
+		}
+	}
+
+	created := reflect.New(t)
+	err := json.Unmarshal(mapped.Data, created.Interface())
+	if err != nil {
+		return &errors.Error{
+			StatusCode: 400,
+			Message:    r.path + ": Flow \"" + f.Name + "\" failed to map the data of action \"" + mapped.Action + "\": " + err.Error(),
+		}
+	}
+
+	dest, _, _ := split(mapped.Action)
+	f.actions[dest] = append(f.actions[dest], created.Interface().(destination.Action))
+	return nil
+}
+
+/*
+err returns the error listing the validations of the declared flows, if any.
+*/
+func (r *Registry) err(v *sources.Validator) error {
+	if len(v.Validations()) == 0 {
+		return nil
+	}
+
+	return &errors.Error{
+		StatusCode:  400,
+		Message:     r.path + ": Flows are not valid",
+		Validations: v.Validations(),
+	}
+}
+
+/*
+fields returns the fields of a mapping sorted by name, so the validations are
+always listed in the same order.
+*/
+func fields(mapping map[string]string) []string {
+	names := []string{}
+	for name := range mapping {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+/*
+listens returns whether a flow listens to a trigger.
+*/
+func listens(def *Definition, trigger string) bool {
+	for _, t := range def.Triggers {
+		if t == trigger {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+split splits a name written as "<source>.<trigger>" or "<destination>.<action>".
+Only the first dot is considered, since triggers can contain dots.
+*/
+func split(name string) (string, string, bool) {
+	i := strings.Index(name, ".")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+
+	return name[:i], name[i+1:], true
+}
+
+/*
+document returns the event as a JSON document, so paths such as "data.email" can
+be looked up.
+*/
+func document(e *sources.Event) (map[string]interface{}, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"context": e.Context,
+		"data":    json.RawMessage(e.Data),
+		"sent_at": e.SentAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	err = json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+/*
+lookup returns the value at a path of a JSON document, or nil if there is none.
+*/
+func lookup(value interface{}, path []string) interface{} {
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		value = object[key]
+	}
+
+	return value
+}
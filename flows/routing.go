@@ -0,0 +1,424 @@
+package flows
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/destination"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Subject is what the conditions of a router are evaluated against. It is built by
+the flow from its own data and context.
+*/
+type Subject struct {
+
+	// Key identifies the subject across events, such as the email address of a
+	// user. It is used for sampling so a subject is always sampled the same way.
+	Key string
+
+	// Email is the email address of the subject, if any.
+	Email string
+
+	// Context is the context of the event, overridden by the one of the flow.
+	Context *sources.Context
+
+	// Data is the data of the flow, as a JSON document.
+	Data map[string]interface{}
+}
+
+/*
+Lookup returns the value at a path of the subject, such as "data.email" or
+"context.locale", or nil if there is none.
+*/
+func (s *Subject) Lookup(path string) interface{} {
+	doc := map[string]interface{}{
+		"data": s.Data,
+	}
+
+	if s.Context != nil {
+		b, err := json.Marshal(s.Context)
+		if err != nil {
+			return nil
+		}
+
+		var ctx map[string]interface{}
+		json.Unmarshal(b, &ctx)
+		doc["context"] = ctx
+	}
+
+	return lookup(doc, strings.Split(path, "."))
+}
+
+/*
+Condition is the interface used by the branches of a router to decide if the
+actions of a destination must be run for a subject.
+*/
+type Condition interface {
+
+	// Match returns whether the subject matches the condition. When it does not,
+	// the reason is returned as well.
+	Match(*Subject) (bool, string)
+}
+
+/*
+Branch is the branch of a router leading to a destination. The actions of the
+destination are run only if the subject matches every conditions.
+*/
+type Branch struct {
+
+	// Destination is the name of the destination the branch leads to.
+	Destination string
+
+	// Conditions is the list of conditions the subject must match.
+	Conditions []Condition
+}
+
+/*
+Router routes the actions of a flow to the destinations given the branches
+configured. When no branch is configured, the actions are always run. Otherwise
+only the destinations of a branch matched by the subject are kept.
+
+Routing does not depend on the scheduler, so a router can be evaluated on its own.
+*/
+type Router struct {
+
+	// Flow is the name of the flow using the router. It is recorded along the
+	// destinations skipped.
+	Flow string
+
+	// Branches is the list of branches of the router.
+	Branches []*Branch
+}
+
+/*
+Route returns the actions to run for a subject, and the reason why each
+destination has been skipped, if any. Canary events are never routed so the
+canary checks every destination.
+*/
+func (r *Router) Route(s *Subject, actions destination.Actions) (destination.Actions, map[string]string) {
+	if r == nil || len(r.Branches) == 0 || (s.Context != nil && s.Context.Canary != "") {
+		return actions, nil
+	}
+
+	routed := destination.Actions{}
+	reasons := map[string]string{}
+	for dest, list := range actions {
+		reason := "No branch leads to the destination"
+		for _, b := range r.Branches {
+			if b.Destination != dest {
+				continue
+			}
+
+			reason = ""
+			for _, c := range b.Conditions {
+				if matched, why := c.Match(s); !matched {
+					reason = why
+					break
+				}
+			}
+
+			if reason == "" {
+				break
+			}
+		}
+
+		if reason != "" {
+			reasons[dest] = reason
+			continue
+		}
+
+		routed[dest] = list
+	}
+
+	return routed, reasons
+}
+
+/*
+Transform routes the actions of a flow. Every destination skipped is recorded in
+the "smithy.unrouted" table along the subject and the reason, so it can be audited
+even when the actions of other destinations are run.
+
+Actions the subject has not consented to are not run, as returned by Consented.
+The actions of the destinations disabled by the toggles are not run. The flow is
+kept instead for each one of them, so their actions can be replayed later.
+*/
+func (r *Router) Transform(tk *flow.Toolkit, f flow.Flow, s *Subject, actions destination.Actions) destination.Actions {
+	routed, reasons := r.Route(s, actions)
+	if len(reasons) > 0 {
+		err := r.record(s, reasons)
+		if err != nil {
+			tk.Logger.Error(r.Flow + ": Failed to record skipped destinations: " + err.Error())
+		}
+	}
+
+	routed = Consented(tk, r.Flow, s.Context, routed)
+	for dest := range routed {
+		if Switches.Enabled(r.Flow, dest) {
+			continue
+		}
+
+		delete(routed, dest)
+		err := Keep(r.Flow, dest, f, s.Context)
+		if err != nil {
+			b, _ := json.Marshal(f)
+			tk.Logger.Error(r.Flow + ": Failed to keep flow for disabled destination " + dest + ": " + err.Error() + ": " + string(b))
+			continue
+		}
+
+		tk.Logger.Info(r.Flow + ": Destination " + dest + " is disabled and the flow has been kept")
+	}
+
+	return routed
+}
+
+/*
+record saves the destinations skipped for a subject with the reason why, one row
+per destination.
+*/
+func (r *Router) record(s *Subject, reasons map[string]string) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx, err := json.Marshal(s.Context)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s.Data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+	for dest, reason := range reasons {
+		_, err = tx.Exec(`
+			INSERT INTO smithy.unrouted (flow, destination, key, reason, context, data)
+			VALUES ($1, $2, $3, $4, $5, $6);
+		`, r.Flow, dest, s.Key, reason, ctx, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+EmailDomains matches the subjects given the domain of their email address. A
+domain also matches its subdomains.
+*/
+type EmailDomains struct {
+
+	// Allow is the list of domains allowed. When empty, every domains not blocked
+	// are allowed.
+	Allow []string
+
+	// Block is the list of domains blocked.
+	Block []string
+}
+
+/*
+Match implements the Condition interface.
+*/
+func (c *EmailDomains) Match(s *Subject) (bool, string) {
+	i := strings.LastIndex(s.Email, "@")
+	domain := strings.ToLower(s.Email[i+1:])
+	if i < 0 || domain == "" {
+		return false, "Email address has no domain"
+	}
+
+	if inDomains(domain, c.Block) {
+		return false, "Email domain \"" + domain + "\" is blocked"
+	}
+
+	if len(c.Allow) > 0 && !inDomains(domain, c.Allow) {
+		return false, "Email domain \"" + domain + "\" is not allowed"
+	}
+
+	return true, ""
+}
+
+/*
+Locales matches the subjects given the locale of their context. A language also
+matches its regional variants, so "fr" matches "fr-CA".
+*/
+type Locales struct {
+
+	// Allow is the list of locales allowed.
+	Allow []string
+}
+
+/*
+Match implements the Condition interface.
+*/
+func (c *Locales) Match(s *Subject) (bool, string) {
+	if s.Context == nil || s.Context.Locale == "" {
+		return false, "Locale is unknown"
+	}
+
+	locale := normalizeLocale(s.Context.Locale)
+	for _, allowed := range c.Allow {
+		allowed = normalizeLocale(allowed)
+		if allowed != "" && (locale == allowed || strings.HasPrefix(locale, allowed+"-")) {
+			return true, ""
+		}
+	}
+
+	return false, "Locale \"" + s.Context.Locale + "\" is not allowed"
+}
+
+/*
+Consent matches the subjects having given their consent at a path, such as
+"data.consent". The consent is given if the value at the path is neither missing,
+false, nor empty.
+*/
+type Consent struct {
+
+	// Path is the path of the consent in the subject.
+	Path string
+}
+
+/*
+Match implements the Condition interface.
+*/
+func (c *Consent) Match(s *Subject) (bool, string) {
+	switch value := s.Lookup(c.Path).(type) {
+	case nil:
+	case bool:
+		if value {
+			return true, ""
+		}
+	case string:
+		if value != "" {
+			return true, ""
+		}
+	default:
+		return true, ""
+	}
+
+	return false, "Consent \"" + c.Path + "\" is missing"
+}
+
+/*
+Sample matches a percentage of the subjects. Subjects are sampled given their
+key, so the same subject is always sampled the same way.
+*/
+type Sample struct {
+
+	// Percent is the percentage of subjects matched, from 0 to 100.
+	Percent float64
+}
+
+/*
+Match implements the Condition interface.
+*/
+func (c *Sample) Match(s *Subject) (bool, string) {
+	h := fnv.New32a()
+	h.Write([]byte(s.Key))
+	if float64(h.Sum32()%10000) < c.Percent*100 {
+		return true, ""
+	}
+
+	return false, "Subject is not part of the " + strconv.FormatFloat(c.Percent, 'f', -1, 64) + "% sampled"
+}
+
+/*
+Predicate matches the subjects given a function, allowing conditions on any field
+of the data and context.
+*/
+type Predicate struct {
+
+	// Name describes the predicate. It is used as the reason when not matched.
+	Name string
+
+	// Func returns whether the subject matches the predicate.
+	Func func(*Subject) bool
+}
+
+/*
+Match implements the Condition interface.
+*/
+func (c *Predicate) Match(s *Subject) (bool, string) {
+	if c.Func(s) {
+		return true, ""
+	}
+
+	return false, "Predicate \"" + c.Name + "\" is not met"
+}
+
+/*
+KeepContext is a middleware keeping the context of the events in their flows,
+so the routers can evaluate it from the scheduler. It should be the last
+middleware of the chains, once the context is complete.
+*/
+var KeepContext sources.Middleware = sources.MiddlewareFunc(func(tk *source.Toolkit, e *sources.Event) error {
+	for _, f := range e.Flows {
+		if keeper, ok := f.(contextKeeper); ok {
+			keeper.keepContext(e.Context)
+		}
+	}
+
+	return nil
+})
+
+/*
+contextKeeper is implemented by the flows routing or filtering their actions
+given the context of the event.
+*/
+type contextKeeper interface {
+	keepContext(*sources.Context)
+}
+
+/*
+subject returns the subject of a flow, with its data marshaled as a JSON document.
+*/
+func subject(key string, email string, ctx *sources.Context, data interface{}) *Subject {
+	s := &Subject{
+		Key:     key,
+		Email:   email,
+		Context: ctx,
+		Data:    map[string]interface{}{},
+	}
+
+	b, err := json.Marshal(data)
+	if err == nil {
+		json.Unmarshal(b, &s.Data)
+	}
+
+	return s
+}
+
+/*
+inDomains returns whether a domain is, or is a subdomain of, one of the domains.
+*/
+func inDomains(domain string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+normalizeLocale returns a locale in lower case with its parts separated by dashes.
+*/
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
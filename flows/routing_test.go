@@ -0,0 +1,256 @@
+package flows
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/nunchistudio/blacksmith/flow/destination"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+names returns the names of the destinations of actions, sorted.
+*/
+func names(actions destination.Actions) []string {
+	list := []string{}
+	for name := range actions {
+		list = append(list, name)
+	}
+
+	sort.Strings(list)
+	return list
+}
+
+func TestRoute(t *testing.T) {
+	actions := destination.Actions{
+		"crm":      []destination.Action{nil},
+		"postgres": []destination.Action{nil},
+	}
+
+	router := &Router{
+		Flow: "OnRegister",
+		Branches: []*Branch{
+			{
+				Destination: "crm",
+				Conditions: []Condition{
+					&EmailDomains{Block: []string{"example.com"}},
+					&Locales{Allow: []string{"en", "fr"}},
+				},
+			},
+			{Destination: "postgres"},
+		},
+	}
+
+	tests := map[string]struct {
+		subject *Subject
+		routed  []string
+		reasons map[string]string
+	}{
+		"every branch matched": {
+			subject: &Subject{Email: "jane@acme.com", Context: &sources.Context{Locale: "fr-CA"}},
+			routed:  []string{"crm", "postgres"},
+			reasons: map[string]string{},
+		},
+		"blocked domain": {
+			subject: &Subject{Email: "jane@mail.example.com", Context: &sources.Context{Locale: "en"}},
+			routed:  []string{"postgres"},
+			reasons: map[string]string{"crm": `Email domain "mail.example.com" is blocked`},
+		},
+		"locale not allowed": {
+			subject: &Subject{Email: "jane@acme.com", Context: &sources.Context{Locale: "de_DE"}},
+			routed:  []string{"postgres"},
+			reasons: map[string]string{"crm": `Locale "de_DE" is not allowed`},
+		},
+		"canary": {
+			subject: &Subject{Email: "jane@example.com", Context: &sources.Context{Canary: "42"}},
+			routed:  []string{"crm", "postgres"},
+			reasons: nil,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			routed, reasons := router.Route(test.subject, actions)
+			if got := names(routed); !reflect.DeepEqual(got, test.routed) {
+				t.Fatalf("expected destinations %v, got %v", test.routed, got)
+			}
+
+			if !reflect.DeepEqual(reasons, test.reasons) {
+				t.Fatalf("expected reasons %v, got %v", test.reasons, reasons)
+			}
+		})
+	}
+}
+
+func TestRouteWithoutBranch(t *testing.T) {
+	actions := destination.Actions{
+		"crm":     []destination.Action{nil},
+		"webhook": []destination.Action{nil},
+	}
+
+	var none *Router
+	routed, reasons := none.Route(&Subject{}, actions)
+	if len(routed) != 2 || reasons != nil {
+		t.Fatalf("expected every destination without a router, got %v and %v", routed, reasons)
+	}
+
+	router := &Router{
+		Branches: []*Branch{
+			{Destination: "crm"},
+		},
+	}
+
+	routed, reasons = router.Route(&Subject{}, actions)
+	if got := names(routed); !reflect.DeepEqual(got, []string{"crm"}) {
+		t.Fatalf("expected only the crm, got %v", got)
+	}
+
+	if reasons["webhook"] != "No branch leads to the destination" {
+		t.Fatalf("unexpected reason: %q", reasons["webhook"])
+	}
+}
+
+func TestEmailDomains(t *testing.T) {
+	tests := map[string]struct {
+		condition *EmailDomains
+		email     string
+		matched   bool
+	}{
+		"no domain":           {&EmailDomains{}, "jane", false},
+		"empty domain":        {&EmailDomains{}, "jane@", false},
+		"allowed by default":  {&EmailDomains{Block: []string{""}}, "jane@acme.com", true},
+		"blocked":             {&EmailDomains{Block: []string{"acme.com"}}, "jane@ACME.com", false},
+		"blocked subdomain":   {&EmailDomains{Block: []string{"acme.com"}}, "jane@eu.acme.com", false},
+		"not a subdomain":     {&EmailDomains{Block: []string{"acme.com"}}, "jane@notacme.com", true},
+		"allowed":             {&EmailDomains{Allow: []string{" acme.com "}}, "jane@acme.com", true},
+		"not allowed":         {&EmailDomains{Allow: []string{"acme.com"}}, "jane@other.com", false},
+		"blocked and allowed": {&EmailDomains{Allow: []string{"acme.com"}, Block: []string{"eu.acme.com"}}, "jane@eu.acme.com", false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			matched, reason := test.condition.Match(&Subject{Email: test.email})
+			if matched != test.matched {
+				t.Fatalf("expected %v, got %v (%s)", test.matched, matched, reason)
+			}
+
+			if !matched && reason == "" {
+				t.Fatal("expected a reason")
+			}
+		})
+	}
+}
+
+func TestLocales(t *testing.T) {
+	condition := &Locales{Allow: []string{"en", "pt-BR"}}
+	tests := map[string]bool{
+		"":      false,
+		"en":    true,
+		"en-US": true,
+		"en_GB": true,
+		"EN":    true,
+		"eng":   false,
+		"pt":    false,
+		"pt_br": true,
+		"fr":    false,
+	}
+
+	for locale, expected := range tests {
+		t.Run(locale, func(t *testing.T) {
+			matched, _ := condition.Match(&Subject{Context: &sources.Context{Locale: locale}})
+			if matched != expected {
+				t.Fatalf("expected %v, got %v", expected, matched)
+			}
+		})
+	}
+
+	matched, reason := condition.Match(&Subject{})
+	if matched || reason != "Locale is unknown" {
+		t.Fatalf("expected an unknown locale, got %v (%s)", matched, reason)
+	}
+}
+
+func TestConsent(t *testing.T) {
+	condition := &Consent{Path: "data.consent"}
+	tests := map[string]struct {
+		data    map[string]interface{}
+		matched bool
+	}{
+		"missing":      {map[string]interface{}{}, false},
+		"false":        {map[string]interface{}{"consent": false}, false},
+		"true":         {map[string]interface{}{"consent": true}, true},
+		"empty string": {map[string]interface{}{"consent": ""}, false},
+		"string":       {map[string]interface{}{"consent": "2020-08-17"}, true},
+		"object":       {map[string]interface{}{"consent": map[string]interface{}{"marketing": true}}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			matched, reason := condition.Match(&Subject{Data: test.data})
+			if matched != test.matched {
+				t.Fatalf("expected %v, got %v (%s)", test.matched, matched, reason)
+			}
+		})
+	}
+
+	matched, _ := (&Consent{Path: "context.locale"}).Match(&Subject{
+		Context: &sources.Context{Locale: "en"},
+	})
+	if !matched {
+		t.Fatal("expected the consent to be read from the context")
+	}
+}
+
+func TestSample(t *testing.T) {
+	for _, percent := range []float64{0, 100} {
+		condition := &Sample{Percent: percent}
+		for i := 0; i < 100; i++ {
+			matched, _ := condition.Match(&Subject{Key: "user" + strconv.Itoa(i)})
+			if matched != (percent == 100) {
+				t.Fatalf("expected %v for %v%%, got %v", percent == 100, percent, matched)
+			}
+		}
+	}
+
+	condition := &Sample{Percent: 50}
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		s := &Subject{Key: "user" + strconv.Itoa(i)}
+		first, _ := condition.Match(s)
+		second, _ := condition.Match(s)
+		if first != second {
+			t.Fatalf("expected %s to be sampled the same way", s.Key)
+		}
+
+		if first {
+			sampled++
+		}
+	}
+
+	if sampled < 400 || sampled > 600 {
+		t.Fatalf("expected about half of the subjects to be sampled, got %d", sampled)
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	condition := &Predicate{
+		Name: "adult",
+		Func: func(s *Subject) bool {
+			age, _ := s.Lookup("data.age").(float64)
+			return age >= 18
+		},
+	}
+
+	matched, _ := condition.Match(&Subject{Data: map[string]interface{}{"age": float64(42)}})
+	if !matched {
+		t.Fatal("expected the predicate to be met")
+	}
+
+	matched, reason := condition.Match(&Subject{Data: map[string]interface{}{"age": float64(12)}})
+	if matched || reason != `Predicate "adult" is not met` {
+		t.Fatalf("expected the predicate not to be met, got %v (%s)", matched, reason)
+	}
+}
@@ -0,0 +1,376 @@
+package flows
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Switches are the toggles read by the flows of the application. They are read from
+the "smithy.toggles" table until a file is set.
+*/
+var Switches = &Toggles{}
+
+/*
+Toggle is the state of a flow, or of a single destination of a flow, switched at
+runtime.
+*/
+type Toggle struct {
+
+	// Flow is the name of the flow, such as "OnRegister".
+	Flow string `yaml:"flow"`
+
+	// Destination is the name of the destination of the flow. When empty, the
+	// toggle applies to the whole flow.
+	Destination string `yaml:"destination"`
+
+	// Enabled indicates if the flow or the destination is enabled.
+	Enabled bool `yaml:"enabled"`
+
+	// By is who switched the toggle, recorded in the audit trail.
+	By string `yaml:"by"`
+
+	// Reason is why the toggle has been switched, recorded in the audit trail.
+	Reason string `yaml:"reason"`
+
+	switchedAt time.Time
+}
+
+/*
+Toggles allows to enable or disable flows, or a single destination of a flow,
+without redeploying the application. Flows and destinations are enabled unless a
+toggle disables them.
+
+Toggles are read from the "smithy.toggles" table, or from a YAML file if a path is
+set. They are read again at a regular interval, and the file only if it has been
+modified. If the toggles can not be read, the last ones are kept.
+
+Every switch is recorded in the "smithy.toggles_audit" table. Switches made in the
+table are recorded by the database itself, and the ones made in the file are
+recorded once read.
+*/
+type Toggles struct {
+
+	// Path is the path to the YAML file of the toggles, if any.
+	Path string
+
+	// CheckEvery is the interval at which the toggles are read again.
+	//
+	// Default: 10 seconds
+	CheckEvery time.Duration
+
+	mutex      sync.RWMutex
+	loading    sync.Mutex
+	refreshing int32
+	toggles    map[string]*Toggle
+	unaudited  []*Toggle
+	modTime    time.Time
+	checkedAt  time.Time
+}
+
+/*
+Enabled returns whether a flow is enabled. When a destination is given, it
+returns whether the destination of the flow is enabled.
+*/
+func (t *Toggles) Enabled(flow string, destination string) bool {
+	toggle, exists := t.load()[flow+"/"+destination]
+	return !exists || toggle.Enabled
+}
+
+/*
+Process implements the sources.Middleware interface. The disabled flows of the
+event are removed from it and kept in the "smithy.kept_flows" table, so they can
+be replayed once enabled again.
+*/
+func (t *Toggles) Process(tk *source.Toolkit, e *sources.Event) error {
+	enabled := []flow.Flow{}
+	for _, f := range e.Flows {
+		name := Name(f)
+		if t.Enabled(name, "") {
+			enabled = append(enabled, f)
+			continue
+		}
+
+		err := Keep(name, "", f, e.Context)
+		if err != nil {
+			return err
+		}
+
+		tk.Logger.Info(e.Source + "/" + e.Trigger + ": Flow " + name + " is disabled and has been kept")
+	}
+
+	e.Flows = enabled
+	return nil
+}
+
+/*
+Name returns the name of a flow used by the toggles, such as "OnRegister". The
+name of a declared flow is the one set in its file.
+*/
+func Name(f flow.Flow) string {
+	switch named := f.(type) {
+	case *Declared:
+		return named.Name
+	case *Replayed:
+		return named.Flow
+	}
+
+	t := reflect.TypeOf(f)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t.Name()
+}
+
+/*
+Keep saves a flow in the "smithy.kept_flows" table along the context of its
+event, so it can be replayed later. When a destination is given, only the actions
+of this destination will be replayed.
+*/
+func Keep(name string, destination string, f flow.Flow, ctx *sources.Context) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	c, err := json.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO smithy.kept_flows (flow, destination, data, context)
+		VALUES ($1, $2, $3, $4);
+	`, name, destination, data, c)
+	return err
+}
+
+/*
+load returns the toggles, reading them again if the interval has elapsed since
+the last check.
+
+The toggles are read without holding the lock, so the flows are not blocked by
+the database or the file in the meantime. Only one goroutine reads them again
+while the others keep using the last ones. They only wait for the toggles to be
+read the first time.
+*/
+func (t *Toggles) load() map[string]*Toggle {
+	checkEvery := t.CheckEvery
+	if checkEvery == 0 {
+		checkEvery = 10 * time.Second
+	}
+
+	t.mutex.RLock()
+	toggles, checkedAt := t.toggles, t.checkedAt
+	t.mutex.RUnlock()
+
+	if time.Since(checkedAt) < checkEvery {
+		return toggles
+	}
+
+	if !checkedAt.IsZero() {
+		if !atomic.CompareAndSwapInt32(&t.refreshing, 0, 1) {
+			return toggles
+		}
+
+		defer atomic.StoreInt32(&t.refreshing, 0)
+	}
+
+	t.loading.Lock()
+	defer t.loading.Unlock()
+
+	// Another goroutine may have read the toggles in the meantime.
+	t.mutex.RLock()
+	toggles, checkedAt = t.toggles, t.checkedAt
+	t.mutex.RUnlock()
+	if time.Since(checkedAt) < checkEvery {
+		return toggles
+	}
+
+	next, modTime := t.refresh(toggles)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.checkedAt = time.Now()
+	if next != nil {
+		t.toggles = next
+		t.modTime = modTime
+	}
+
+	return t.toggles
+}
+
+/*
+refresh reads the toggles again, from the table or from the file if it has been
+modified since the last check. It returns nil if they have not changed or can not
+be read, along with the modification time of the file if any. It must only be
+called while holding the loading lock.
+*/
+func (t *Toggles) refresh(toggles map[string]*Toggle) (map[string]*Toggle, time.Time) {
+	if t.Path == "" {
+		next, err := t.query()
+		if err != nil {
+			return nil, time.Time{}
+		}
+
+		return next, time.Time{}
+	}
+
+	var next map[string]*Toggle
+	modTime := t.modTime
+	info, err := os.Stat(t.Path)
+	if err == nil && (toggles == nil || info.ModTime().After(t.modTime)) {
+		read, err := t.read()
+		if err == nil {
+			t.unaudited = append(t.unaudited, switched(toggles, read, info.ModTime())...)
+			next = read
+			modTime = info.ModTime()
+		}
+	}
+
+	// Switches not recorded because of a database failure are recorded again at
+	// the next check.
+	if len(t.unaudited) > 0 && t.audit(t.unaudited) == nil {
+		t.unaudited = nil
+	}
+
+	return next, modTime
+}
+
+/*
+query reads the toggles from the "smithy.toggles" table.
+*/
+func (t *Toggles) query() (map[string]*Toggle, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT flow, destination, enabled FROM smithy.toggles;`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	toggles := map[string]*Toggle{}
+	for rows.Next() {
+		toggle := &Toggle{}
+		err = rows.Scan(&toggle.Flow, &toggle.Destination, &toggle.Enabled)
+		if err != nil {
+			return nil, err
+		}
+
+		toggles[toggle.Flow+"/"+toggle.Destination] = toggle
+	}
+
+	return toggles, rows.Err()
+}
+
+/*
+read reads the toggles from the YAML file.
+*/
+func (t *Toggles) read() (map[string]*Toggle, error) {
+	b, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Toggles []*Toggle `yaml:"toggles"`
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+
+	toggles := map[string]*Toggle{}
+	for _, toggle := range file.Toggles {
+		if toggle != nil && toggle.Flow != "" {
+			toggles[toggle.Flow+"/"+toggle.Destination] = toggle
+		}
+	}
+
+	return toggles, nil
+}
+
+/*
+audit records the switches made in the file. Every instances of the application
+read the same file, so a switch is recorded only once given the modification time
+of the file it has been read from.
+*/
+func (t *Toggles) audit(toggles []*Toggle) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	for _, toggle := range toggles {
+		by := toggle.By
+		if by == "" {
+			by = t.Path
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO smithy.toggles_audit (flow, destination, enabled, flipped_by, reason, origin, flipped_at)
+			VALUES ($1, $2, $3, $4, $5, 'file', $6)
+			ON CONFLICT (flow, destination, enabled, flipped_at) DO NOTHING;
+		`, toggle.Flow, toggle.Destination, toggle.Enabled, by, toggle.Reason, toggle.switchedAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+switched returns the toggles whose state differs between the previous and the
+next ones, switched at the given time. A toggle removed from the file switches
+back to enabled.
+*/
+func switched(previous map[string]*Toggle, next map[string]*Toggle, at time.Time) []*Toggle {
+	toggles := []*Toggle{}
+	for key, toggle := range next {
+		toggle.switchedAt = at
+		before, exists := previous[key]
+		if (exists && before.Enabled != toggle.Enabled) || (!exists && !toggle.Enabled) {
+			toggles = append(toggles, toggle)
+		}
+	}
+
+	for key, before := range previous {
+		if _, exists := next[key]; !exists && !before.Enabled {
+			toggles = append(toggles, &Toggle{
+				Flow:        before.Flow,
+				Destination: before.Destination,
+				Enabled:     true,
+				Reason:      "Toggle removed from the file",
+				switchedAt:  at,
+			})
+		}
+	}
+
+	return toggles
+}
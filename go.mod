@@ -2,6 +2,16 @@ module github.com/nunchistudio/smithy
 
 go 1.15
 
-require github.com/nunchistudio/blacksmith v0.12.0
+require (
+	github.com/jackc/pgconn v1.6.5-0.20200823013804-5db484908cf7
+	github.com/jackc/pglogrepl v0.0.0-20210731151948-9f1effd582c4
+	github.com/jackc/pgproto3/v2 v2.0.4
+	github.com/lib/pq v1.8.0
+	github.com/minio/minio-go/v7 v7.0.5
+	github.com/nats-io/nats.go v1.11.0
+	github.com/nunchistudio/blacksmith v0.12.0
+	github.com/oschwald/maxminddb-golang v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 replace golang.org/x/sys => golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS smithy.api_keys CASCADE;
+
+DROP SCHEMA IF EXISTS smithy;
@@ -0,0 +1,9 @@
+CREATE SCHEMA IF NOT EXISTS smithy;
+
+CREATE TABLE IF NOT EXISTS smithy.api_keys (
+  key_hash VARCHAR(64) PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  triggers TEXT[] NOT NULL DEFAULT '{}',
+  enabled BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS blacksmith_store.events_idempotency_key;
+
+DROP TABLE IF EXISTS smithy.idempotency_keys CASCADE;
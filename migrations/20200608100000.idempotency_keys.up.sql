@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS smithy.idempotency_keys (
+  trigger TEXT NOT NULL,
+  client TEXT NOT NULL DEFAULT '',
+  key TEXT NOT NULL,
+  created_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  PRIMARY KEY (trigger, client, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at
+  ON smithy.idempotency_keys (expires_at);
+
+CREATE INDEX IF NOT EXISTS events_idempotency_key
+  ON blacksmith_store.events (trigger, (context->>'idempotency_key'))
+  WHERE context->>'idempotency_key' IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS smithy.rate_limits_updated_at;
+
+DROP TABLE IF EXISTS smithy.rate_limits CASCADE;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS smithy.rate_limits (
+  bucket TEXT PRIMARY KEY,
+  tokens DOUBLE PRECISION NOT NULL,
+  allowed BOOLEAN NOT NULL,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_updated_at
+  ON smithy.rate_limits (updated_at);
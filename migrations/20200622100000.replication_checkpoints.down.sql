@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS blacksmith_store.events_replication_lsn;
+
+DROP TABLE IF EXISTS smithy.replication_checkpoints CASCADE;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS smithy.replication_checkpoints (
+  slot TEXT PRIMARY KEY,
+  lsn TEXT NOT NULL,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS events_replication_lsn
+  ON blacksmith_store.events ((data->>'lsn'))
+  WHERE source = 'postgres' AND trigger = 'replication';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS blacksmith_store.events_data_id;
+
+DROP TABLE IF EXISTS smithy.sync_watermarks CASCADE;
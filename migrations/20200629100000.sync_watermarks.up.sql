@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS smithy.sync_watermarks (
+  sync TEXT PRIMARY KEY,
+  cursor TEXT NOT NULL DEFAULT '',
+  key TEXT NOT NULL DEFAULT '',
+  pending_id TEXT,
+  pending_cursor TEXT NOT NULL DEFAULT '',
+  pending_key TEXT NOT NULL DEFAULT '',
+  pending_at TIMESTAMP WITHOUT TIME ZONE,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS events_data_id
+  ON blacksmith_store.events (source, trigger, (data->>'id'));
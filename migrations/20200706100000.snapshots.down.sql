@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS smithy.snapshot_progress CASCADE;
+
+DROP TABLE IF EXISTS smithy.snapshots CASCADE;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS smithy.snapshots (
+  slot TEXT PRIMARY KEY,
+  lsn TEXT NOT NULL,
+  exported BIGINT NOT NULL DEFAULT 0,
+  started_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  completed_at TIMESTAMP WITHOUT TIME ZONE
+);
+
+CREATE TABLE IF NOT EXISTS smithy.snapshot_progress (
+  slot TEXT NOT NULL,
+  table_name TEXT NOT NULL,
+  last_key TEXT[],
+  exported BIGINT NOT NULL DEFAULT 0,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  completed_at TIMESTAMP WITHOUT TIME ZONE,
+  PRIMARY KEY (slot, table_name)
+);
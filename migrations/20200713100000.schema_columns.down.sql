@@ -0,0 +1 @@
+DROP TABLE IF EXISTS smithy.schema_columns CASCADE;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS smithy.schema_columns (
+  table_name TEXT PRIMARY KEY,
+  columns JSONB NOT NULL,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
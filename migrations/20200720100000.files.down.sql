@@ -0,0 +1,2 @@
+-- The events_data_id index is owned by the sync_watermarks migration, and must
+-- not be dropped when rolling back this one.
@@ -0,0 +1,2 @@
+-- The files source looks events up by their data's ID, using the events_data_id
+-- index owned by the sync_watermarks migration. It has nothing else to create.
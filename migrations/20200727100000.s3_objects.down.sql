@@ -0,0 +1 @@
+DROP TABLE IF EXISTS smithy.s3_objects CASCADE;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS smithy.s3_objects (
+  bucket TEXT NOT NULL,
+  key TEXT NOT NULL,
+  etag TEXT NOT NULL,
+  status TEXT NOT NULL,
+  parts INTEGER NOT NULL DEFAULT 0,
+  records INTEGER NOT NULL DEFAULT 0,
+  report JSONB,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (bucket, key, etag)
+);
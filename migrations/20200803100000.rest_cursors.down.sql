@@ -0,0 +1 @@
+DROP TABLE IF EXISTS smithy.rest_cursors CASCADE;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS smithy.rest_cursors (
+  endpoint TEXT PRIMARY KEY,
+  next TEXT NOT NULL DEFAULT '',
+  since TEXT NOT NULL DEFAULT '',
+  seen TEXT NOT NULL DEFAULT '',
+  pending_id TEXT,
+  pending_next TEXT NOT NULL DEFAULT '',
+  pending_seen TEXT NOT NULL DEFAULT '',
+  pending_at TIMESTAMP WITHOUT TIME ZONE,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
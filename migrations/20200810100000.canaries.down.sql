@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS smithy.canaries_pending;
+
+DROP TABLE IF EXISTS smithy.canaries CASCADE;
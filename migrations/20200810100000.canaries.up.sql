@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS smithy.canaries (
+  id TEXT PRIMARY KEY,
+  sent_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  event_id TEXT,
+  succeeded_at TIMESTAMP WITHOUT TIME ZONE,
+  latency_ms BIGINT,
+  alerted_at TIMESTAMP WITHOUT TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS canaries_pending
+  ON smithy.canaries (sent_at) WHERE succeeded_at IS NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS smithy.unrouted_flow;
+
+DROP TABLE IF EXISTS smithy.unrouted CASCADE;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS smithy.unrouted (
+  id BIGSERIAL PRIMARY KEY,
+  flow TEXT NOT NULL,
+  destination TEXT NOT NULL,
+  key TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  context JSONB,
+  data JSONB,
+  recorded_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS unrouted_flow
+  ON smithy.unrouted (flow, destination, recorded_at);
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS smithy.kept_flows_pending;
+
+DROP TABLE IF EXISTS smithy.kept_flows CASCADE;
+
+DROP TRIGGER IF EXISTS toggles_audit ON smithy.toggles;
+
+DROP FUNCTION IF EXISTS smithy.audit_toggles();
+
+DROP TABLE IF EXISTS smithy.toggles_audit CASCADE;
+
+DROP TABLE IF EXISTS smithy.toggles CASCADE;
@@ -0,0 +1,59 @@
+CREATE TABLE IF NOT EXISTS smithy.toggles (
+  flow TEXT NOT NULL,
+  destination TEXT NOT NULL DEFAULT '',
+  enabled BOOLEAN NOT NULL,
+  updated_by TEXT,
+  reason TEXT,
+  updated_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (flow, destination)
+);
+
+CREATE TABLE IF NOT EXISTS smithy.toggles_audit (
+  id BIGSERIAL PRIMARY KEY,
+  flow TEXT NOT NULL,
+  destination TEXT NOT NULL,
+  enabled BOOLEAN NOT NULL,
+  flipped_by TEXT NOT NULL,
+  reason TEXT,
+  origin TEXT NOT NULL,
+  flipped_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  UNIQUE (flow, destination, enabled, flipped_at)
+);
+
+CREATE OR REPLACE FUNCTION smithy.audit_toggles() RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    INSERT INTO smithy.toggles_audit (flow, destination, enabled, flipped_by, reason, origin)
+    VALUES (OLD.flow, OLD.destination, TRUE, CURRENT_USER, 'Toggle deleted', 'database');
+    RETURN OLD;
+  END IF;
+
+  IF TG_OP = 'UPDATE' AND OLD.enabled = NEW.enabled THEN
+    RETURN NEW;
+  END IF;
+
+  INSERT INTO smithy.toggles_audit (flow, destination, enabled, flipped_by, reason, origin)
+  VALUES (NEW.flow, NEW.destination, NEW.enabled, COALESCE(NEW.updated_by, CURRENT_USER), NEW.reason, 'database');
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER toggles_audit
+  AFTER INSERT OR UPDATE OR DELETE ON smithy.toggles
+  FOR EACH ROW EXECUTE PROCEDURE smithy.audit_toggles();
+
+CREATE TABLE IF NOT EXISTS smithy.kept_flows (
+  id BIGSERIAL PRIMARY KEY,
+  flow TEXT NOT NULL,
+  destination TEXT NOT NULL,
+  data JSONB NOT NULL,
+  context JSONB,
+  kept_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW(),
+  replay_id TEXT,
+  replay_at TIMESTAMP WITHOUT TIME ZONE,
+  replayed_at TIMESTAMP WITHOUT TIME ZONE,
+  error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS kept_flows_pending
+  ON smithy.kept_flows (kept_at) WHERE replayed_at IS NULL AND error IS NULL;
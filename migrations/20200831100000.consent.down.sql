@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS smithy.unconsented_flow;
+
+DROP TABLE IF EXISTS smithy.unconsented CASCADE;
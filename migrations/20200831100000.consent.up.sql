@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS smithy.unconsented (
+  id BIGSERIAL PRIMARY KEY,
+  flow TEXT NOT NULL,
+  destination TEXT NOT NULL,
+  action TEXT NOT NULL,
+  missing TEXT[] NOT NULL,
+  reason TEXT NOT NULL,
+  consent JSONB,
+  data JSONB,
+  recorded_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS unconsented_flow
+  ON smithy.unconsented (flow, destination, recorded_at);
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+)
+
+/*
+cleanup periodically removes the expired state of the source, outside of the
+requests so they are not slowed down. It runs for as long as the gateway does.
+*/
+func (s *Source) cleanup(tk *source.Toolkit) {
+	every := s.env.CleanupEvery
+	if every == 0 {
+		every = 10 * time.Minute
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.env.Idempotency != nil {
+			err := s.env.Idempotency.Cleanup()
+			if err != nil {
+				tk.Logger.Error("api: Failed to remove expired idempotency keys: " + err.Error())
+			}
+		}
+
+		if limiter, ok := s.limiter().(cleaner); ok {
+			err := limiter.Cleanup()
+			if err != nil {
+				tk.Logger.Error("api: Failed to remove idle rate limits: " + err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+clientIP returns the IP address of the client making the request. It is the IP
+address of the socket, unless the socket is one of the trusted proxies. In this
+case, the "X-Forwarded-For" header is read from right to left and the first IP
+address not trusted is returned.
+*/
+func (s *Source) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !s.trusted(ip) {
+		return ip
+	}
+
+	hops := []string{}
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+/*
+trusted indicates if the IP address is one of the trusted proxies of the source.
+*/
+func (s *Source) trusted(ip net.IP) bool {
+	for _, proxy := range s.env.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if net.ParseIP(proxy).Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+acceptLanguage returns the language with the highest quality in the
+"Accept-Language" header of the request. It returns an empty string if the header
+is missing or only accepts any language.
+*/
+func acceptLanguage(req *http.Request) string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+
+	languages := []language{}
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		languages = append(languages, language{tag, quality})
+	}
+
+	if len(languages) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	return languages[0].tag
+}
+
+/*
+enrich returns the function filling the context of an event with the details of
+the request, on the server side. The values sent by the client for the IP address,
+the locale, and the location are kept in the "supplied" key of the context.
+*/
+func (s *Source) enrich(req *http.Request, receivedAt time.Time) func(*sources.Context) {
+	ip := s.clientIP(req)
+	ua := sources.ParseUserAgent(req.UserAgent())
+	locale := acceptLanguage(req)
+
+	return func(ctx *sources.Context) {
+		if ctx.IP != nil || ctx.Locale != "" || ctx.Location != nil {
+			ctx.Supplied = &sources.Supplied{
+				IP:       ctx.IP,
+				Locale:   ctx.Locale,
+				Location: ctx.Location,
+			}
+		} else {
+			ctx.Supplied = nil
+		}
+
+		// Only the canary trigger can tag events as canaries, and the location is
+		// only resolved from the IP address.
+		ctx.Canary = ""
+		ctx.Location = nil
+		ctx.IP = ip
+		ctx.UserAgent = ua
+		ctx.ReceivedAt = &receivedAt
+		if ctx.Locale == "" {
+			ctx.Locale = locale
+		}
+	}
+}
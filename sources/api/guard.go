@@ -0,0 +1,146 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+triggerHTTP is a source's trigger using a HTTP route.
+*/
+type triggerHTTP interface {
+	source.Trigger
+	source.TriggerHTTP
+}
+
+/*
+guarded wraps a HTTP trigger of the source. It runs the checks enabled in the
+source's options before extracting the event, so every trigger benefits from
+them without having to call them explicitly.
+*/
+type guarded struct {
+	trigger triggerHTTP
+	source  *Source
+}
+
+/*
+guard returns the trigger wrapped with the checks of the source.
+*/
+func (s *Source) guard(t triggerHTTP) source.Trigger {
+	return guarded{
+		trigger: t,
+		source:  s,
+	}
+}
+
+/*
+String returns the string representation of the wrapped trigger.
+*/
+func (g guarded) String() string {
+	return g.trigger.String()
+}
+
+/*
+Unwrap implements the sources.Wrapper interface.
+*/
+func (g guarded) Unwrap() source.Trigger {
+	return g.trigger
+}
+
+/*
+Mode returns the mode of the wrapped trigger.
+*/
+func (g guarded) Mode() *source.Mode {
+	return g.trigger.Mode()
+}
+
+/*
+Extract runs the checks of the source against the request. If every checks pass,
+the Extract function of the wrapped trigger is run. Otherwise, the error of the
+first failing check is returned.
+
+Once extracted, the context of the event is completed on the server side with
+the details of the request, such as the IP address and the user agent, and with
+the details resolved by the checks, such as the client's name. The event then
+goes through the middlewares of the source.
+*/
+func (g guarded) Extract(tk *source.Toolkit, req *http.Request) (*source.Payload, error) {
+	receivedAt := time.Now().UTC()
+	env := g.source.env
+	g.source.cleaning.Do(func() {
+		go g.source.cleanup(tk)
+	})
+
+	if limit, exists := env.RateLimits[g.String()]; exists {
+		err := g.source.limit(req, g.String(), limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if env.Signature != nil {
+		err := env.Signature.Verify(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var client *Client
+	if env.Keys != nil {
+		var err error
+		client, err = env.Keys.Authorize(req, g.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Idempotency keys are scoped by client, if any, so a client can not retrieve
+	// the events of another one.
+	var key, name string
+	if client != nil {
+		name = client.Name
+	}
+
+	if env.Idempotency != nil {
+		var err error
+		key, err = env.Idempotency.Claim(req, g.String(), name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := g.trigger.Extract(tk, req)
+	if err == nil && payload != nil {
+		enrich := g.source.enrich(req, receivedAt)
+		err = sources.Apply(payload, func(ctx *sources.Context) {
+			enrich(ctx)
+			if client != nil {
+				client.apply(ctx)
+			}
+
+			ctx.IdempotencyKey = key
+		})
+	}
+
+	if err == nil && payload != nil {
+		payload, err = env.Middlewares.Run(tk, g.source.String(), g.String(), payload)
+		if dropped, ok := err.(*sources.Dropped); ok {
+			err = dropped.HTTP()
+		}
+	}
+
+	// Release the idempotency key if no event will be created, so the client can
+	// retry with the same key. This is also the case if the event has been dropped
+	// by a middleware.
+	if key != "" && (err != nil || payload == nil) {
+		if errRelease := env.Idempotency.Release(g.String(), name, key); errRelease != nil {
+			tk.Logger.Error(errRelease)
+		}
+	}
+
+	return payload, err
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Idempotency is the options used to deduplicate the events sent several times by
+the clients, such as mobile applications retrying a request on flaky networks.
+
+A client sends a unique key in the idempotency header. If the same key is received
+again from the same client for the same trigger within the window, no new event
+is created and the ID of the original event is returned. When API keys are
+enabled, keys are scoped by the name of the client so a client can not retrieve
+the events of another one. Keys are stored in the "smithy.idempotency_keys" table
+and expire once the window is over. Expired keys are removed periodically.
+*/
+type Idempotency struct {
+
+	// Header is the name of the HTTP header containing the idempotency key.
+	//
+	// Default: "Idempotency-Key"
+	Header string
+
+	// Window is the duration a key is kept. A key received after the window is
+	// considered as a new one.
+	//
+	// Default: 24 hours
+	Window time.Duration
+
+	// Timeout is the duration after which a key claimed by a request with no
+	// related event is considered as abandoned, for example if the gateway failed
+	// to store the event. A new request with the same key can then be processed.
+	//
+	// Default: 1 minute
+	Timeout time.Duration
+}
+
+/*
+Claim claims the idempotency key of the request for the trigger and the client,
+which is empty if API keys are not enabled. It returns the key claimed, or an
+empty string if the request has no key.
+
+If the key has already been claimed by a previous request, Claim returns an error
+with a 200 status code including the ID of the original event. If the original
+request is still being processed, a 409 error is returned instead.
+*/
+func (i *Idempotency) Claim(req *http.Request, trigger string, client string) (string, error) {
+	header := i.Header
+	if header == "" {
+		header = "Idempotency-Key"
+	}
+
+	window := i.Window
+	if window == 0 {
+		window = 24 * time.Hour
+	}
+
+	timeout := i.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	key := req.Header.Get(header)
+	if key == "" {
+		return "", nil
+	}
+
+	if len(key) > 255 {
+		return "", &errors.Error{
+			StatusCode: 400,
+			Message:    "Bad Request",
+			Validations: []errors.Validation{
+				{
+					Message: "Header must not exceed 255 characters",
+					Path:    []string{"request", "headers", header},
+				},
+			},
+		}
+	}
+
+	db, err := sources.DB()
+	if err != nil {
+		return "", err
+	}
+
+	// Try to claim the key. If it already exists and has not expired, a previous
+	// request has been received with the same key. Expired keys not removed yet
+	// are claimed again.
+	res, err := db.Exec(`
+		INSERT INTO smithy.idempotency_keys AS k (trigger, client, key, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')
+		ON CONFLICT (trigger, client, key) DO UPDATE
+		SET created_at = NOW(), expires_at = EXCLUDED.expires_at
+		WHERE k.expires_at < NOW();
+	`, trigger, client, key, window.Seconds())
+	if err != nil {
+		return "", err
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	if claimed == 1 {
+		return key, nil
+	}
+
+	// Look for the event created by the previous request within the window. The
+	// name of the client is the one saved in the library of the context.
+	var id string
+	err = db.QueryRow(`
+		SELECT id FROM blacksmith_store.events
+		WHERE source = 'api' AND trigger = $1 AND context->>'idempotency_key' = $3
+		AND ($2 = '' OR context->'library'->>'name' = $2)
+		AND received_at > NOW() - $4 * INTERVAL '1 second'
+		ORDER BY received_at DESC
+		LIMIT 1;
+	`, trigger, client, key, window.Seconds()).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if id != "" {
+		return "", &errors.Error{
+			StatusCode: 200,
+			Message:    "Event already received",
+			Meta: &errors.Meta{
+				Event: &errors.Event{
+					ID: id,
+				},
+			},
+		}
+	}
+
+	// No event has been found. Take over the key if the previous request has
+	// been abandoned, otherwise it is still being processed.
+	res, err = db.Exec(`
+		UPDATE smithy.idempotency_keys
+		SET created_at = NOW(), expires_at = NOW() + $4 * INTERVAL '1 second'
+		WHERE trigger = $1 AND client = $2 AND key = $3 AND created_at < NOW() - $5 * INTERVAL '1 second';
+	`, trigger, client, key, window.Seconds(), timeout.Seconds())
+	if err != nil {
+		return "", err
+	}
+
+	claimed, err = res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	if claimed == 1 {
+		return key, nil
+	}
+
+	return "", &errors.Error{
+		StatusCode: 409,
+		Message:    "Conflict",
+		Validations: []errors.Validation{
+			{
+				Message: "A request with the same key is being processed",
+				Path:    []string{"request", "headers", header},
+			},
+		},
+	}
+}
+
+/*
+Release releases a key claimed by a request that failed before an event could be
+created, so the client can retry with the same key.
+*/
+func (i *Idempotency) Release(trigger string, client string, key string) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM smithy.idempotency_keys
+		WHERE trigger = $1 AND client = $2 AND key = $3;
+	`, trigger, client, key)
+
+	return err
+}
+
+/*
+Cleanup removes the expired keys. It is run periodically by the source, outside
+of the requests.
+*/
+func (i *Idempotency) Cleanup() error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM smithy.idempotency_keys
+		WHERE expires_at < NOW();
+	`)
+
+	return err
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Keys is the options used to authenticate the clients of the source with API keys.
+Keys are stored in the "smithy.api_keys" table as SHA-256 hashes, so a leak of the
+database does not leak the keys themselves.
+*/
+type Keys struct {
+
+	// Header is the name of the HTTP header containing the API key.
+	//
+	// Default: "X-Api-Key"
+	Header string
+
+	// CacheFor is the duration a resolved key is kept in memory before being read
+	// again from the database. Disabling a key can therefore take up to this
+	// duration to be effective.
+	//
+	// Default: 30 seconds
+	CacheFor time.Duration
+
+	cache sync.Map
+}
+
+/*
+Client is the client resolved from an API key.
+*/
+type Client struct {
+
+	// Name is the name of the client, such as the integration sending the events.
+	Name string
+
+	// Triggers is the list of triggers the client is allowed to send events to.
+	// "*" allows every triggers of the source.
+	Triggers []string
+
+	// Enabled indicates if the key can be used.
+	Enabled bool
+
+	expiresAt time.Time
+}
+
+/*
+HashKey returns the hash of an API key as stored in the database. It shall be used
+when creating new keys:
+
+	INSERT INTO smithy.api_keys (key_hash, name, triggers)
+	VALUES ('<hash>', 'website', '{register,batch}');
+*/
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Allows indicates if the client is allowed to send events to the trigger.
+*/
+func (c *Client) Allows(trigger string) bool {
+	for _, allowed := range c.Triggers {
+		if allowed == "*" || allowed == trigger {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+apply records the client's name in the library of the context, so every stored
+event shows which integration sent it. The library sent by the client, if any, is
+kept in the "supplied" key of the context.
+*/
+func (c *Client) apply(ctx *sources.Context) {
+	if ctx.Library == nil {
+		ctx.Library = &sources.Library{}
+	} else if ctx.Library.Name != "" && ctx.Library.Name != c.Name {
+		if ctx.Supplied == nil {
+			ctx.Supplied = &sources.Supplied{}
+		}
+
+		supplied := *ctx.Library
+		ctx.Supplied.Library = &supplied
+	}
+
+	ctx.Library.Name = c.Name
+}
+
+/*
+Authorize resolves the client from the API key of the request and makes sure it
+is allowed to send events to the trigger. It returns a 401 error if the key is
+missing, unknown, or disabled, and a 403 error if the key lacks the scope.
+*/
+func (k *Keys) Authorize(req *http.Request, trigger string) (*Client, error) {
+	header := k.Header
+	if header == "" {
+		header = "X-Api-Key"
+	}
+
+	key := req.Header.Get(header)
+	if key == "" {
+		return nil, errUnauthorized(header, "Header is required")
+	}
+
+	client, err := k.resolve(HashKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if client == nil || !client.Enabled {
+		return nil, errUnauthorized(header, "Header must be a valid and enabled API key")
+	}
+
+	if !client.Allows(trigger) {
+		return nil, &errors.Error{
+			StatusCode: 403,
+			Message:    "Forbidden",
+			Validations: []errors.Validation{
+				{
+					Message: "API key is not allowed to use the trigger '" + trigger + "'",
+					Path:    []string{"request", "headers", header},
+				},
+			},
+		}
+	}
+
+	return client, nil
+}
+
+/*
+resolve returns the client given the hash of its key, from the cache if still
+valid or from the database otherwise. It returns nil if the key is unknown.
+
+Only the keys found in the database are cached, so the cache can not grow beyond
+the number of keys stored no matter how many unknown keys are sent. Rate limits
+protect the database from clients sending random keys.
+*/
+func (k *Keys) resolve(hash string) (*Client, error) {
+	if cached, ok := k.cache.Load(hash); ok {
+		client := cached.(*Client)
+		if time.Now().Before(client.expiresAt) {
+			return client, nil
+		}
+
+		k.cache.Delete(hash)
+	}
+
+	db, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{}
+	row := db.QueryRow(`
+		SELECT name, triggers, enabled
+		FROM smithy.api_keys
+		WHERE key_hash = $1;
+	`, hash)
+
+	err = row.Scan(&client.Name, pq.Array(&client.Triggers), &client.Enabled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cacheFor := k.CacheFor
+	if cacheFor == 0 {
+		cacheFor = 30 * time.Second
+	}
+
+	client.expiresAt = time.Now().Add(cacheFor)
+	k.cache.Store(hash, client)
+
+	return client, nil
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nunchistudio/blacksmith/helper/rest"
+)
+
+/*
+headersKey is the key used to store the response headers set by the triggers in
+the request's context.
+*/
+type headersKey struct{}
+
+/*
+Middleware is the HTTP middleware to use for the gateway. It wraps the default
+Blacksmith middleware and allows the triggers of the source to set headers on the
+HTTP response, such as "Retry-After", even though they do not have access to the
+response writer.
+*/
+func Middleware(next http.Handler) http.Handler {
+	return rest.Middleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		headers := http.Header{}
+		ctx := context.WithValue(req.Context(), headersKey{}, headers)
+
+		next.ServeHTTP(&writer{
+			ResponseWriter: res,
+			headers:        headers,
+		}, req.WithContext(ctx))
+	}))
+}
+
+/*
+setHeader sets a header to write on the HTTP response of the request. It has no
+effect if the gateway does not use Middleware.
+*/
+func setHeader(req *http.Request, key string, value string) {
+	if headers, ok := req.Context().Value(headersKey{}).(http.Header); ok {
+		headers.Set(key, value)
+	}
+}
+
+/*
+writer is a HTTP response writer adding the headers set by the triggers before
+writing the status code.
+*/
+type writer struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+/*
+WriteHeader adds the headers set by the triggers and writes the status code.
+*/
+func (w *writer) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for key, values := range w.headers {
+			for _, value := range values {
+				w.ResponseWriter.Header().Add(key, value)
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+/*
+Write makes sure the headers are added when the status code is written implicitly.
+*/
+func (w *writer) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
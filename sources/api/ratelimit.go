@@ -0,0 +1,353 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+RateLimit is the options of a token-bucket rate limit applied to a trigger. Each
+client has its own bucket of Burst tokens, refilled at a rate of Rate tokens per
+second. Every request takes one token. Requests are rejected when the bucket is
+empty.
+*/
+type RateLimit struct {
+
+	// By is the value identifying a client. It must be one of:
+	//   - "ip": the IP address of the client;
+	//   - "key": the API key of the client;
+	//   - "context.<field>": a field of the event's context, such as "context.locale".
+	//
+	// Default: "ip"
+	By string
+
+	// Rate is the number of tokens added to the bucket every second.
+	Rate float64
+
+	// Burst is the maximum number of tokens in the bucket. It is the number of
+	// requests a client can send at once.
+	Burst float64
+}
+
+/*
+Limiter is the interface used to store the buckets of the rate limits. It allows
+several gateway instances to share their buckets.
+*/
+type Limiter interface {
+
+	// Take takes a token from the bucket. It returns false and the duration to wait
+	// before the next token is available if the bucket is empty.
+	Take(bucket string, limit *RateLimit) (bool, time.Duration, error)
+}
+
+/*
+MemoryLimiter is a Limiter keeping the buckets in memory. Buckets are not shared
+across gateway instances.
+*/
+type MemoryLimiter struct {
+
+	// IdleFor is the duration after which a bucket not used anymore is removed. It
+	// must be longer than the time needed to refill a bucket, so removing a bucket
+	// is the same as keeping it full.
+	//
+	// Default: 1 hour
+	IdleFor time.Duration
+
+	mutex   sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+/*
+memoryBucket is a bucket kept in memory.
+*/
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+/*
+Take takes a token from the bucket kept in memory.
+*/
+func (l *MemoryLimiter) Take(bucket string, limit *RateLimit) (bool, time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*memoryBucket)
+	}
+
+	b, exists := l.buckets[bucket]
+	if !exists {
+		b = &memoryBucket{
+			tokens:    limit.Burst,
+			updatedAt: now,
+		}
+
+		l.buckets[bucket] = b
+	}
+
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.updatedAt).Seconds()*limit.Rate)
+	b.updatedAt = now
+	if b.tokens < 1 {
+		return false, wait(b.tokens, limit), nil
+	}
+
+	b.tokens--
+	return true, 0, nil
+}
+
+/*
+Cleanup removes the buckets idle for longer than IdleFor.
+*/
+func (l *MemoryLimiter) Cleanup() error {
+	idleFor := l.IdleFor
+	if idleFor == 0 {
+		idleFor = time.Hour
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for bucket, b := range l.buckets {
+		if time.Since(b.updatedAt) > idleFor {
+			delete(l.buckets, bucket)
+		}
+	}
+
+	return nil
+}
+
+/*
+PostgresLimiter is a Limiter keeping the buckets in the "smithy.rate_limits" table.
+Buckets are shared across every gateway instances using the same database.
+*/
+type PostgresLimiter struct {
+
+	// IdleFor is the duration after which a bucket not used anymore is removed. It
+	// must be longer than the time needed to refill a bucket, so removing a bucket
+	// is the same as keeping it full.
+	//
+	// Default: 1 hour
+	IdleFor time.Duration
+}
+
+/*
+Take takes a token from the bucket stored in the database. The bucket is refilled
+and taken in a single statement so concurrent requests from several instances do
+not take the same token.
+*/
+func (l *PostgresLimiter) Take(bucket string, limit *RateLimit) (bool, time.Duration, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return false, 0, err
+	}
+
+	var tokens float64
+	var allowed bool
+	err = db.QueryRow(`
+		INSERT INTO smithy.rate_limits AS r (bucket, tokens, allowed, updated_at)
+		VALUES ($1, $2 - 1, TRUE, NOW())
+		ON CONFLICT (bucket) DO UPDATE SET
+			tokens = CASE
+				WHEN LEAST($2, r.tokens + EXTRACT(EPOCH FROM NOW() - r.updated_at) * $3) >= 1
+				THEN LEAST($2, r.tokens + EXTRACT(EPOCH FROM NOW() - r.updated_at) * $3) - 1
+				ELSE LEAST($2, r.tokens + EXTRACT(EPOCH FROM NOW() - r.updated_at) * $3)
+			END,
+			allowed = LEAST($2, r.tokens + EXTRACT(EPOCH FROM NOW() - r.updated_at) * $3) >= 1,
+			updated_at = NOW()
+		RETURNING tokens, allowed;
+	`, bucket, limit.Burst, limit.Rate).Scan(&tokens, &allowed)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if !allowed {
+		return false, wait(tokens, limit), nil
+	}
+
+	return true, 0, nil
+}
+
+/*
+Cleanup removes the buckets idle for longer than IdleFor.
+*/
+func (l *PostgresLimiter) Cleanup() error {
+	idleFor := l.IdleFor
+	if idleFor == 0 {
+		idleFor = time.Hour
+	}
+
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM smithy.rate_limits
+		WHERE updated_at < NOW() - $1 * INTERVAL '1 second';
+	`, idleFor.Seconds())
+
+	return err
+}
+
+/*
+cleaner is implemented by the limiters removing their idle buckets periodically.
+*/
+type cleaner interface {
+	Cleanup() error
+}
+
+/*
+wait returns the duration to wait before a token is available in a bucket.
+*/
+func wait(tokens float64, limit *RateLimit) time.Duration {
+	if limit.Rate <= 0 {
+		return time.Hour
+	}
+
+	return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
+
+/*
+limit applies the rate limit to the request. It returns a 429 error and sets the
+"Retry-After" header if the client exceeded the limit.
+*/
+func (s *Source) limit(req *http.Request, trigger string, limit *RateLimit) error {
+	by := limit.By
+	if by == "" {
+		by = "ip"
+	}
+
+	value, err := s.identify(req, by)
+	if err != nil {
+		return err
+	}
+
+	limiter := s.limiter()
+
+	allowed, retryAfter, err := limiter.Take(trigger+":"+by+":"+value, limit)
+	if err != nil {
+		return err
+	}
+
+	if allowed {
+		return nil
+	}
+
+	// The validation points at the value the client is identified by, if it has
+	// been sent by the client.
+	seconds := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	setHeader(req, "Retry-After", seconds)
+	return &errors.Error{
+		StatusCode: 429,
+		Message:    "Too Many Requests",
+		Validations: []errors.Validation{
+			{
+				Message: "Rate limit exceeded, retry in " + seconds + " seconds",
+				Path:    s.identifiedBy(by),
+			},
+		},
+	}
+}
+
+/*
+limiter returns the limiter of the source, which is kept in memory by default.
+*/
+func (s *Source) limiter() Limiter {
+	if s.env.Limiter == nil {
+		return s.memory
+	}
+
+	return s.env.Limiter
+}
+
+/*
+identify returns the value identifying the client of the request, given the By
+option of a rate limit.
+*/
+func (s *Source) identify(req *http.Request, by string) (string, error) {
+	switch {
+	case by == "ip":
+		return s.clientIP(req).String(), nil
+
+	case by == "key":
+		return HashKey(req.Header.Get(s.keyHeader())), nil
+
+	case strings.HasPrefix(by, "context."):
+		body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, s.maxBodySize()))
+		if err != nil {
+			return "", &errors.Error{
+				StatusCode: 413,
+				Message:    "Request Entity Too Large",
+			}
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// Only decode the context of the payload. If the body is not valid, the
+		// trigger will reject it anyway so an empty value is used.
+		var payload struct {
+			Context map[string]interface{} `json:"context"`
+		}
+
+		json.Unmarshal(body, &payload)
+		value, _ := payload.Context[strings.TrimPrefix(by, "context.")].(string)
+		return value, nil
+	}
+
+	return "", &errors.Error{
+		StatusCode: 500,
+		Message:    "Rate limit must be by 'ip', 'key', or 'context.<field>'",
+	}
+}
+
+/*
+identifiedBy returns the path of the value identifying the client of the request,
+given the By option of a rate limit. It is nil for the IP address since it is not
+sent by the client.
+*/
+func (s *Source) identifiedBy(by string) []string {
+	switch {
+	case by == "key":
+		return []string{"request", "headers", s.keyHeader()}
+	case strings.HasPrefix(by, "context."):
+		return sources.Path("context", strings.TrimPrefix(by, "context."))
+	}
+
+	return nil
+}
+
+/*
+keyHeader returns the name of the HTTP header containing the API key.
+*/
+func (s *Source) keyHeader() string {
+	if s.env.Keys != nil && s.env.Keys.Header != "" {
+		return s.env.Keys.Header
+	}
+
+	return "X-Api-Key"
+}
+
+/*
+maxBodySize returns the maximum size of the body, in bytes, read before the
+trigger. It is the one of the signature, if any.
+*/
+func (s *Source) maxBodySize() int64 {
+	if s.env.Signature != nil && s.env.Signature.MaxBodySize != 0 {
+		return s.env.Signature.MaxBodySize
+	}
+
+	return 1 << 20
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+)
+
+/*
+Signature is the options used to verify that a request has been signed with a
+shared secret.
+
+The caller computes a HMAC-SHA256 of the timestamp, a dot, and the raw body of the
+request:
+
+	hex(HMAC-SHA256(secret, "<timestamp>.<body>"))
+
+It sends the result in the signature header, optionally prefixed by "sha256=",
+and the timestamp (in seconds since Unix epoch) in the timestamp header.
+*/
+type Signature struct {
+
+	// Secrets is the list of shared secrets currently active. A request is valid if
+	// it has been signed with any of them. This allows to rotate the secrets by
+	// adding the new one before removing the old one.
+	Secrets []string
+
+	// Header is the name of the HTTP header containing the signature.
+	//
+	// Default: "X-Signature"
+	Header string
+
+	// TimestampHeader is the name of the HTTP header containing the timestamp the
+	// request has been signed at.
+	//
+	// Default: "X-Timestamp"
+	TimestampHeader string
+
+	// Tolerance is the maximum duration allowed between the timestamp of the request
+	// and the time it is received. Requests outside this window are considered as
+	// replayed.
+	//
+	// Default: 5 minutes
+	Tolerance time.Duration
+
+	// MaxBodySize is the maximum size of the body, in bytes, read to verify the
+	// signature.
+	//
+	// Default: 1 MB
+	MaxBodySize int64
+}
+
+/*
+Validate returns an error if the signature can not be verified safely. At least
+one secret must be set, and none of them can be empty since anyone could sign a
+request with an empty secret.
+*/
+func (s *Signature) Validate() error {
+	if len(s.Secrets) == 0 {
+		return &errors.Error{
+			StatusCode: 500,
+			Message:    "api: Signature must have at least one secret",
+		}
+	}
+
+	for i, secret := range s.Secrets {
+		if strings.TrimSpace(secret) == "" {
+			return &errors.Error{
+				StatusCode: 500,
+				Message:    "api: Secret " + strconv.Itoa(i) + " of the signature is empty",
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+errUnauthorized returns a 401 error with a validation error for the given header.
+*/
+func errUnauthorized(header string, message string) error {
+	return &errors.Error{
+		StatusCode: 401,
+		Message:    "Unauthorized",
+		Validations: []errors.Validation{
+			{
+				Message: message,
+				Path:    []string{"request", "headers", header},
+			},
+		},
+	}
+}
+
+/*
+Verify reads the raw body of the request and checks its signature and timestamp.
+The body is then restored so the trigger can decode it as usual. It returns a 401
+error if the request is not correctly signed or is outside the replay window.
+*/
+func (s *Signature) Verify(req *http.Request) error {
+	header := s.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+
+	timestampHeader := s.TimestampHeader
+	if timestampHeader == "" {
+		timestampHeader = "X-Timestamp"
+	}
+
+	tolerance := s.Tolerance
+	if tolerance == 0 {
+		tolerance = 5 * time.Minute
+	}
+
+	maxBodySize := s.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = 1 << 20
+	}
+
+	// Check the timestamp first since it is cheaper than reading the body.
+	timestamp := req.Header.Get(timestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errUnauthorized(timestampHeader, "Header must be a valid Unix timestamp")
+	}
+
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > tolerance || skew < -tolerance {
+		return errUnauthorized(timestampHeader, "Header is outside the tolerated time window")
+	}
+
+	signature := strings.TrimPrefix(req.Header.Get(header), "sha256=")
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return errUnauthorized(header, "Header must be a valid hexadecimal signature")
+	}
+
+	// Read the raw body and restore it for the trigger.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, maxBodySize))
+	if err != nil {
+		return &errors.Error{
+			StatusCode: 413,
+			Message:    "Request Entity Too Large",
+		}
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// Try every active secrets until one matches. Empty secrets are never valid.
+	for _, secret := range s.Secrets {
+		if len(secret) == 0 {
+			continue
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return nil
+		}
+	}
+
+	return errUnauthorized(header, "Header does not match the signature of the request")
+}
@@ -1,7 +1,12 @@
 package api
 
 import (
+	"sync"
+	"time"
+
 	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
 )
 
 /*
@@ -9,6 +14,52 @@ Source implements the source.Source interface for the "api" source.
 */
 type Source struct {
 	options *source.Options
+	env     *Options
+	memory  *MemoryLimiter
+
+	cleaning sync.Once
+}
+
+/*
+Options is the options a user can pass to secure the HTTP triggers of the source.
+Every options are optional. When nil, the related check is disabled.
+*/
+type Options struct {
+
+	// Signature enables the verification of the HMAC signature of every requests.
+	Signature *Signature
+
+	// Keys enables the authentication of the clients with API keys.
+	Keys *Keys
+
+	// Idempotency enables the deduplication of events sent several times with the
+	// same idempotency key.
+	Idempotency *Idempotency
+
+	// RateLimits is the rate limits to apply, per trigger name.
+	RateLimits map[string]*RateLimit
+
+	// Limiter is used to store the buckets of the rate limits. Use PostgresLimiter
+	// to share the buckets across several gateway instances.
+	//
+	// Default: MemoryLimiter
+	Limiter Limiter
+
+	// TrustedProxies is the list of IP addresses or CIDR ranges of the proxies in
+	// front of the gateway. When a request comes from a trusted proxy, the IP
+	// address of the client is read from the "X-Forwarded-For" header.
+	TrustedProxies []string
+
+	// Middlewares is the chain of middlewares every events go through once
+	// extracted and enriched by the source, before their flows are run.
+	Middlewares sources.Chain
+
+	// CleanupEvery is the interval at which the expired state of the source, such
+	// as the expired idempotency keys and the idle rate limits, is removed. The
+	// cleanup starts with the first request received.
+	//
+	// Default: 10 minutes
+	CleanupEvery time.Duration
 }
 
 /*
@@ -16,9 +67,15 @@ New returns a valid Blacksmith source.
 
 There is no need for a schedule on this source since it only handles HTTP triggers.
 */
-func New() source.Source {
+func New(options *Options) source.Source {
+	if options == nil {
+		options = &Options{}
+	}
+
 	return &Source{
 		options: &source.Options{},
+		env:     options,
+		memory:  &MemoryLimiter{},
 	}
 }
 
@@ -38,10 +95,12 @@ func (s *Source) Options() *source.Options {
 }
 
 /*
-Triggers return a list of triggers the source is able to handle.
+Triggers return a list of triggers the source is able to handle. Every triggers
+are guarded so the security options of the source apply to all of them.
 */
 func (s *Source) Triggers() map[string]source.Trigger {
 	return map[string]source.Trigger{
-		"register": TriggerRegister{},
+		"register": s.guard(TriggerRegister{}),
+		"batch":    s.guard(TriggerBatch{}),
 	}
 }
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+MaxBatchSize is the maximum number of items accepted within a single batch.
+*/
+var MaxBatchSize = 500
+
+/*
+TriggerBatch is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+The context of the batch is shared across every items. It is merged with the
+context of each item, the one of the item taking precedence.
+*/
+type TriggerBatch struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the list of items sent within the batch.
+	Data []*Envelope `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+}
+
+/*
+Envelope is an item sent within a batch. Type is the name of the trigger the item
+would have been sent to if it was not batched, such as "register".
+*/
+type Envelope struct {
+	Type    string           `json:"type"`
+	Context *sources.Context `json:"context,omitempty"`
+	Data    json.RawMessage  `json:"data"`
+	SentAt  *time.Time       `json:"sent_at,omitempty"`
+}
+
+/*
+Batch is the data payload of a batch once extracted. It reports which items have
+been accepted and which have been rejected. It is returned in the HTTP response.
+*/
+type Batch struct {
+	Accepted []*BatchItem `json:"accepted"`
+	Rejected []*BatchItem `json:"rejected"`
+}
+
+/*
+BatchItem is the report of a single item within a batch. Index is the position
+of the item in the request payload.
+*/
+type BatchItem struct {
+	Index       int                 `json:"index"`
+	Type        string              `json:"type"`
+	Validations []errors.Validation `json:"validations,omitempty"`
+}
+
+/*
+Router is implemented by the triggers of the source accepting items sent within a
+batch. Route decodes and validates the data of an item and returns the flows to
+run. Validation errors must be added to the validator, in which case the item is
+rejected.
+*/
+type Router interface {
+	Route(item *Envelope, v *sources.Validator, path ...string) []flow.Flow
+}
+
+/*
+routes returns the triggers an item can be routed to, given its type.
+*/
+func routes() map[string]Router {
+	return map[string]Router{
+		"register": TriggerRegister{},
+	}
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerBatch) String() string {
+	return "batch"
+}
+
+/*
+Mode allows to register the trigger as a HTTP route. This means, every time a
+"POST" request is executed against the route "/batch" the Extract function
+will run.
+
+Data is shown in the HTTP response so the client knows which items have been
+accepted or rejected.
+*/
+func (t TriggerBatch) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeHTTP,
+		UsingHTTP: &source.Route{
+			Methods:  []string{"POST"},
+			Path:     "/batch",
+			ShowMeta: true,
+			ShowData: true,
+		},
+	}
+}
+
+/*
+Extract is the function being run when the HTTP route is triggered. Each item of
+the batch is routed to the flows of the trigger its type maps to. Items failing
+the validation are rejected without failing the whole batch. An error is returned
+only if the batch itself is invalid or if every items are rejected.
+*/
+func (t TriggerBatch) Extract(tk *source.Toolkit, req *http.Request) (*source.Payload, error) {
+
+	// Create an empty payload, catch unwanted fields, and unmarshal it.
+	// Return an error if any occured.
+	var payload TriggerBatch
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the batch is neither empty nor too large.
+	v := &sources.Validator{}
+	payload.Context.Validate(v, "context")
+	if len(payload.Data) == 0 {
+		v.Add(sources.Path("data"), "Field must contain at least one item")
+	} else if len(payload.Data) > MaxBatchSize {
+		v.Add(sources.Path("data"), "Field must not contain more than "+strconv.Itoa(MaxBatchSize)+" items")
+	}
+
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+
+	// Route every items to their trigger. Each item has its own validator so we
+	// can report its validation errors individually.
+	batch := &Batch{
+		Accepted: []*BatchItem{},
+		Rejected: []*BatchItem{},
+	}
+
+	all := &sources.Validator{}
+	toRun := []flow.Flow{}
+	for i, item := range payload.Data {
+		path := []string{"data", strconv.Itoa(i)}
+		report := &BatchItem{
+			Index: i,
+		}
+
+		var routed []flow.Flow
+		iv := &sources.Validator{}
+		if item == nil {
+			iv.Add(sources.Path(path...), "Field is required")
+		} else {
+			report.Type = item.Type
+			item.Context.Validate(iv, append(path, "context")...)
+
+			// Apply the context and the timestamp of the batch to the item.
+			item.Context = payload.Context.Merge(item.Context)
+			if item.SentAt == nil {
+				item.SentAt = payload.SentAt
+			}
+
+			// An item with an invalid context is rejected without being routed, so
+			// none of its flows are run.
+			router, exists := routes()[item.Type]
+			if !exists {
+				iv.Add(sources.Path(append(path, "type")...), "Field must be a known type")
+			} else if len(iv.Validations()) == 0 {
+				routed = router.Route(item, iv, path...)
+			}
+		}
+
+		if len(iv.Validations()) > 0 {
+			report.Validations = iv.Validations()
+			batch.Rejected = append(batch.Rejected, report)
+			for _, validation := range iv.Validations() {
+				all.Add(validation.Path, validation.Message)
+			}
+
+			continue
+		}
+
+		batch.Accepted = append(batch.Accepted, report)
+		toRun = append(toRun, routed...)
+	}
+
+	// Fail the whole batch only if there is nothing to run.
+	if len(batch.Accepted) == 0 {
+		return nil, all.Err()
+	}
+
+	// Try to marshal the shared context from the request payload.
+	ctx, err := json.Marshal(&payload.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try to marshal the batch report.
+	data, err := json.Marshal(&batch)
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the context, the report as data, and the flows of every accepted
+	// items.
+	return &source.Payload{
+		Context: ctx,
+		Data:    data,
+		SentAt:  payload.SentAt,
+		Flows:   toRun,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nunchistudio/smithy/flows"
+)
+
+func TestBatchInvalidContext(t *testing.T) {
+	body := `{
+		"data": [
+			{
+				"type": "register",
+				"data": {"username": "jdoe", "first_name": "John", "last_name": "Doe", "email": "john@example.com"}
+			},
+			{
+				"type": "register",
+				"context": {"consent": {"categories": ["marketing"]}},
+				"data": {"username": "jane", "first_name": "Jane", "last_name": "Doe", "email": "jane@example.com"}
+			}
+		]
+	}`
+
+	req := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+	payload, err := TriggerBatch{}.Extract(nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch Batch
+	err = json.Unmarshal(payload.Data, &batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Accepted) != 1 || batch.Accepted[0].Index != 0 {
+		t.Fatalf("expected only the first item to be accepted, got %+v", batch.Accepted)
+	}
+
+	if len(batch.Rejected) != 1 || batch.Rejected[0].Index != 1 {
+		t.Fatalf("expected the second item to be rejected, got %+v", batch.Rejected)
+	}
+
+	for _, validation := range batch.Rejected[0].Validations {
+		if !strings.Contains(strings.Join(validation.Path, "."), "data.1.context.consent") {
+			t.Fatalf("unexpected validation: %+v", validation)
+		}
+	}
+
+	if len(payload.Flows) != 1 {
+		t.Fatalf("expected 1 flow, got %d", len(payload.Flows))
+	}
+
+	f, ok := payload.Flows[0].(*flows.OnRegister)
+	if !ok || f.Email != "john@example.com" {
+		t.Fatalf("expected the flow of the first item only, got %#v", payload.Flows[0])
+	}
+}
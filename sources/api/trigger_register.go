@@ -1,15 +1,17 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
-	"strings"
+	"reflect"
 	"time"
 
 	"github.com/nunchistudio/blacksmith/flow"
 	"github.com/nunchistudio/blacksmith/flow/source"
 
 	"github.com/nunchistudio/smithy/flows"
+	"github.com/nunchistudio/smithy/flows/expr"
 	"github.com/nunchistudio/smithy/sources"
 )
 
@@ -41,6 +43,37 @@ type User struct {
 	Email     string `json:"email"`
 }
 
+/*
+Validate adds to the validator every validation errors found in the user. The
+path is the location of the user in the request payload, such as "data".
+*/
+func (u *User) Validate(v *sources.Validator, path ...string) {
+	if u == nil {
+		v.Add(sources.Path(path...), "Field is required")
+		return
+	}
+
+	at := func(key string) []string {
+		return sources.Path(append(append([]string{}, path...), key)...)
+	}
+
+	if v.Required(at("email"), u.Email) && v.MaxLength(at("email"), u.Email, 254) {
+		v.Email(at("email"), u.Email)
+	}
+
+	if v.Required(at("first_name"), u.FirstName) {
+		v.MaxLength(at("first_name"), u.FirstName, 64)
+	}
+
+	if v.Required(at("last_name"), u.LastName) {
+		v.MaxLength(at("last_name"), u.LastName, 64)
+	}
+
+	if v.MaxLength(at("username"), u.Username, 32) {
+		v.Username(at("username"), u.Username)
+	}
+}
+
 /*
 String returns the string representation of the trigger.
 */
@@ -85,6 +118,15 @@ func (t TriggerRegister) Extract(tk *source.Toolkit, req *http.Request) (*source
 		return nil, err
 	}
 
+	// Validate every fields of the payload and return all the validation errors
+	// at once, if any.
+	v := &sources.Validator{}
+	payload.Context.Validate(v, "context")
+	payload.Data.Validate(v, "data")
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+
 	// Try to marshal the context from the request payload.
 	ctx, err := json.Marshal(&payload.Context)
 	if err != nil {
@@ -97,19 +139,87 @@ func (t TriggerRegister) Extract(tk *source.Toolkit, req *http.Request) (*source
 		return nil, err
 	}
 
+	// Map the user to the flows, and reject the request if it can not be.
+	f, err := payload.Data.Flows(payload.Context, payload.SentAt)
+	if err != nil {
+		v.Add(sources.Path("data"), "User can not be mapped: "+err.Error())
+		return nil, v.Err()
+	}
+
 	// Return the context, data, and a collection of flows to run.
 	return &source.Payload{
 		Context: ctx,
 		Data:    data,
 		SentAt:  payload.SentAt,
-		Flows: []flow.Flow{
-			&flows.OnRegister{
-				Username:  payload.Data.Username,
-				FullName:  payload.Data.FirstName + " " + strings.ToUpper(payload.Data.LastName),
-				FirstName: payload.Data.FirstName,
-				LastName:  strings.ToUpper(payload.Data.LastName),
-				Email:     strings.ToLower(payload.Data.Email),
-			},
-		},
+		Flows:   f,
 	}, nil
 }
+
+/*
+Route decodes and validates the data of an item sent within a batch. It returns
+the flows to run for this item given its context. Validation errors are added to
+the validator, in which case no flows are returned.
+*/
+func (t TriggerRegister) Route(item *Envelope, v *sources.Validator, path ...string) []flow.Flow {
+	at := append(append([]string{}, path...), "data")
+
+	var u *User
+	decoder := json.NewDecoder(bytes.NewReader(item.Data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&u)
+	if err != nil {
+		v.Add(sources.Path(at...), "Field must be a valid user: "+err.Error())
+		return nil
+	}
+
+	before := len(v.Validations())
+	u.Validate(v, at...)
+	if len(v.Validations()) > before {
+		return nil
+	}
+
+	f, err := u.Flows(item.Context, item.SentAt)
+	if err != nil {
+		v.Add(sources.Path(at...), "User can not be mapped: "+err.Error())
+		return nil
+	}
+
+	return f
+}
+
+/*
+registration maps a registered user to the "OnRegister" flow. It is compiled and
+type-checked against the user and the flow once, when the application starts.
+*/
+var registration = expr.MustMapping(map[string]string{
+	"username":   `username`,
+	"full_name":  `first_name + " " + upper(last_name)`,
+	"first_name": `first_name`,
+	"last_name":  `upper(last_name)`,
+	"email":      `lower(email)`,
+}, reflect.TypeOf(User{}), reflect.TypeOf(flows.OnRegister{}), nil)
+
+/*
+Flows returns the flows to run for a registered user. When a context is given it
+is passed to the flows so the actions do not rely on the event's context. It is
+also used by the sources ingesting users from files. An error is returned if the
+user can not be mapped.
+*/
+func (u *User) Flows(ctx *sources.Context, sentAt *time.Time) ([]flow.Flow, error) {
+	f := &flows.OnRegister{
+		Context: ctx,
+		SentAt:  sentAt,
+	}
+
+	var timezone string
+	if ctx != nil {
+		timezone = ctx.Timezone
+	}
+
+	err := registration.Apply(u, f, timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	return []flow.Flow{f}, nil
+}
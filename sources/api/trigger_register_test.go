@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nunchistudio/smithy/flows"
+)
+
+func TestRegisterContext(t *testing.T) {
+	body := `{
+		"context": {"timezone": "Europe/Paris"},
+		"data": {"username": "jdoe", "first_name": "John", "last_name": "Doe", "email": "John@Example.com"},
+		"sent_at": "2020-08-17T10:30:00Z"
+	}`
+
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+	payload, err := TriggerRegister{}.Extract(nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payload.Flows) != 1 {
+		t.Fatalf("expected 1 flow, got %d", len(payload.Flows))
+	}
+
+	f, ok := payload.Flows[0].(*flows.OnRegister)
+	if !ok {
+		t.Fatalf("expected the OnRegister flow, got %#v", payload.Flows[0])
+	}
+
+	if f.Context == nil || f.Context.Timezone != "Europe/Paris" {
+		t.Fatalf("expected the timezone of the context, got %+v", f.Context)
+	}
+
+	if f.SentAt == nil || !f.SentAt.Equal(*payload.SentAt) {
+		t.Fatalf("expected the timestamp of the event, got %v", f.SentAt)
+	}
+
+	if f.Email != "john@example.com" || f.FullName != "John DOE" {
+		t.Fatalf("unexpected mapping: %+v", f)
+	}
+}
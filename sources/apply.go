@@ -0,0 +1,54 @@
+package sources
+
+import (
+	"encoding/json"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+)
+
+/*
+Contextual is implemented by flows carrying their own context, such as the flows
+of an item sent within a batch. It allows changes made to the context of an event
+to be applied to the context of its flows as well.
+*/
+type Contextual interface {
+
+	// FlowContext returns the context of the flow. It can be nil if the flow relies
+	// on the context of the event.
+	FlowContext() *Context
+}
+
+/*
+Apply runs the function against the context of the payload and against the
+context of every flows implementing Contextual. The context of the payload is
+marshaled back once the function has run.
+*/
+func Apply(p *source.Payload, fn func(*Context)) error {
+	ctx := &Context{}
+	if len(p.Context) > 0 {
+		err := json.Unmarshal(p.Context, &ctx)
+		if err != nil {
+			return err
+		}
+
+		// The context can be "null" if the event was sent without one.
+		if ctx == nil {
+			ctx = &Context{}
+		}
+	}
+
+	fn(ctx)
+	for _, f := range p.Flows {
+		if contextual, ok := f.(Contextual); ok && contextual.FlowContext() != nil {
+			fn(contextual.FlowContext())
+		}
+	}
+
+	b, err := json.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.Context = b
+	return nil
+}
@@ -0,0 +1,159 @@
+package sources
+
+import (
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+)
+
+/*
+Clock contains data about the clock of the device sending the event, compared to
+the clock of the gateway.
+*/
+type Clock struct {
+
+	// SentAt is the timestamp the event was sent at, as reported by the device.
+	SentAt *time.Time `json:"sent_at,omitempty"`
+
+	// Offset is the difference in milliseconds between the time the event has been
+	// received at by the gateway and the time it was sent at by the device. It is
+	// positive when the clock of the device is late.
+	Offset int64 `json:"offset"`
+
+	// Flag indicates why the timestamp of the event should not be trusted, if any.
+	// It is one of "missing", "ahead", or "behind".
+	Flag string `json:"flag,omitempty"`
+}
+
+/*
+The flags a clock can have.
+*/
+var (
+	ClockMissing = "missing"
+	ClockAhead   = "ahead"
+	ClockBehind  = "behind"
+)
+
+/*
+Timestamped is implemented by flows carrying their own timestamp, such as the
+flows of an item sent within a batch. It allows the timestamp to be corrected the
+same way the one of the event is.
+*/
+type Timestamped interface {
+
+	// Timestamp returns the timestamp of the flow, if any.
+	Timestamp() *time.Time
+
+	// SetTimestamp replaces the timestamp of the flow.
+	SetTimestamp(*time.Time)
+}
+
+/*
+SkewCorrection is a middleware correcting the timestamps of the events given the
+clock of the device sending them.
+
+The device sends the time it sent the event at in "sent_at". The gateway compares
+it with the time it received the event at to compute the offset of the device's
+clock. Every timestamps of the event are then shifted by this offset. The original
+values are kept in the "clock" key of the context.
+
+When "sent_at" is missing, the time the event has been received at is used.
+*/
+type SkewCorrection struct {
+
+	// MaxAhead is the maximum duration the clock of a device can be ahead of the
+	// gateway's clock.
+	//
+	// Default: 10 minutes
+	MaxAhead time.Duration
+
+	// MaxBehind is the maximum duration the clock of a device can be behind the
+	// gateway's clock. It includes the time an event can be buffered by a device
+	// before being sent.
+	//
+	// Default: 7 days
+	MaxBehind time.Duration
+
+	// Reject rejects the events outside the bounds. Otherwise, they are flagged
+	// as "ahead" or "behind" in the clock of the context.
+	Reject bool
+}
+
+/*
+Process implements the Middleware interface.
+*/
+func (s *SkewCorrection) Process(tk *source.Toolkit, e *Event) error {
+	maxAhead := s.MaxAhead
+	if maxAhead == 0 {
+		maxAhead = 10 * time.Minute
+	}
+
+	maxBehind := s.MaxBehind
+	if maxBehind == 0 {
+		maxBehind = 7 * 24 * time.Hour
+	}
+
+	receivedAt := time.Now().UTC()
+	if e.Context.ReceivedAt != nil {
+		receivedAt = *e.Context.ReceivedAt
+	}
+
+	clock := &Clock{
+		SentAt: e.SentAt,
+	}
+
+	var offset time.Duration
+	if e.SentAt == nil {
+		clock.Flag = ClockMissing
+	} else {
+		offset = receivedAt.Sub(*e.SentAt)
+		clock.Offset = offset.Milliseconds()
+
+		var message string
+		switch {
+		case offset < -maxAhead:
+			clock.Flag = ClockAhead
+			message = "Field must not be more than " + maxAhead.String() + " in the future"
+		case offset > maxBehind:
+			clock.Flag = ClockBehind
+			message = "Field must not be more than " + maxBehind.String() + " in the past"
+		}
+
+		if message != "" && s.Reject {
+			return &errors.Error{
+				StatusCode: 400,
+				Message:    "Bad Request",
+				Validations: []errors.Validation{
+					{
+						Message: message,
+						Path:    Path("sent_at"),
+					},
+				},
+			}
+		}
+	}
+
+	// The corrected time the event was sent at is the time it has been received
+	// at. Flows with their own timestamp are shifted by the same offset.
+	e.SentAt = &receivedAt
+	for _, f := range e.Flows {
+		if timestamped, ok := f.(Timestamped); ok {
+			if ts := timestamped.Timestamp(); ts != nil {
+				corrected := ts.Add(offset)
+				timestamped.SetTimestamp(&corrected)
+			} else {
+				timestamped.SetTimestamp(&receivedAt)
+			}
+		}
+	}
+
+	for _, ctx := range e.Contexts() {
+		ctx.Clock = clock
+		if ctx.ReceivedAt == nil {
+			ctx.ReceivedAt = &receivedAt
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package sources
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Consent is the consent given by a user for the processing of their data, such as
+the one collected by a cookie banner. Actions requiring a consent are only run
+for the users having granted every categories they need.
+*/
+type Consent struct {
+
+	// Categories is the list of categories the user consented to, such as
+	// "marketing" or "analytics".
+	Categories []string `json:"categories"`
+
+	// Version is the version of the terms the user consented to.
+	Version string `json:"version"`
+
+	// GivenAt is the timestamp the user gave their consent at.
+	GivenAt *time.Time `json:"given_at"`
+}
+
+/*
+Missing returns the categories required which have not been granted by the
+consent, if any. Categories are compared regardless of their case. Every
+categories are missing if there is no consent.
+*/
+func (c *Consent) Missing(required []string) []string {
+	missing := []string{}
+	for _, category := range required {
+		granted := false
+		if c != nil {
+			for _, given := range c.Categories {
+				if strings.EqualFold(given, category) {
+					granted = true
+					break
+				}
+			}
+		}
+
+		if !granted {
+			missing = append(missing, category)
+		}
+	}
+
+	return missing
+}
+
+/*
+Validate adds to the validator every validation errors found in the consent. The
+path is the location of the consent in the request payload, such as
+"context.consent". The version and the timestamp are required so the consent can
+be audited.
+*/
+func (c *Consent) Validate(v *Validator, path ...string) {
+	if c == nil {
+		return
+	}
+
+	at := func(keys ...string) []string {
+		return Path(append(append([]string{}, path...), keys...)...)
+	}
+
+	for i, category := range c.Categories {
+		if v.Required(at("categories", strconv.Itoa(i)), category) {
+			v.MaxLength(at("categories", strconv.Itoa(i)), category, 64)
+		}
+	}
+
+	if v.Required(at("version"), c.Version) {
+		v.MaxLength(at("version"), c.Version, 64)
+	}
+
+	// The clock of the device may be ahead of the one of the gateway, so a day of
+	// margin is allowed.
+	if c.GivenAt == nil {
+		v.Add(at("given_at"), "Field is required")
+	} else if c.GivenAt.After(time.Now().Add(24 * time.Hour)) {
+		v.Add(at("given_at"), "Field must not be in the future")
+	}
+}
@@ -2,6 +2,7 @@ package sources
 
 import (
 	"net"
+	"time"
 )
 
 /*
@@ -13,6 +14,54 @@ type Context struct {
 	Locale   string   `json:"locale,omitempty"`
 	Timezone string   `json:"timezone,omitempty"`
 	Library  *Library `json:"library,omitempty"`
+
+	// IdempotencyKey is the key sent by the client to deduplicate the event, if
+	// any. It is set by the gateway and allows to find the original event when
+	// the same key is received again.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Location is the location of the client resolved from its IP address, if
+	// GeoIP is enabled.
+	Location *Location `json:"location,omitempty"`
+
+	// UserAgent is the user agent of the client, parsed by the gateway.
+	UserAgent *UserAgent `json:"user_agent,omitempty"`
+
+	// ReceivedAt is the timestamp the event has been received at by the gateway.
+	ReceivedAt *time.Time `json:"received_at,omitempty"`
+
+	// Clock contains data about the clock of the device sending the event, if the
+	// timestamps of the event have been corrected.
+	Clock *Clock `json:"clock,omitempty"`
+
+	// Supplied keeps the values originally sent by the client for the fields
+	// overridden by the gateway, so they can be audited.
+	Supplied *Supplied `json:"supplied,omitempty"`
+
+	// Canary is the identifier of the synthetic event sent by the canary trigger,
+	// if the event is one. Destinations short-circuit the jobs of canary events.
+	Canary string `json:"canary,omitempty"`
+
+	// Consent is the consent given by the user, if any. Actions requiring a consent
+	// are not run for the users who have not granted it.
+	Consent *Consent `json:"consent,omitempty"`
+}
+
+/*
+Supplied contains the values sent by the client for the fields of the context
+the gateway fills on the server side.
+*/
+type Supplied struct {
+	IP     net.IP `json:"ip,omitempty"`
+	Locale string `json:"locale,omitempty"`
+
+	// Library is the library sent by the client, when its name is overridden by
+	// the name of the client resolved from the API key.
+	Library *Library `json:"library,omitempty"`
+
+	// Location is the location sent by the client. The location of the context
+	// is only resolved on the server side.
+	Location *Location `json:"location,omitempty"`
 }
 
 /*
@@ -22,3 +71,81 @@ type Library struct {
 	Name    string `json:"name,omitempty"`
 	Version string `json:"version,omitempty"`
 }
+
+/*
+Merge returns a new context made of the current context overridden by the non-empty
+fields of the one passed in params. It is used to apply a context shared across
+several events, such as the ones sent within a batch, to each one of them.
+*/
+func (c *Context) Merge(with *Context) *Context {
+	merged := &Context{}
+	if c != nil {
+		*merged = *c
+	}
+
+	if with == nil {
+		return merged
+	}
+
+	if with.IP != nil {
+		merged.IP = with.IP
+	}
+
+	if with.Locale != "" {
+		merged.Locale = with.Locale
+	}
+
+	if with.Timezone != "" {
+		merged.Timezone = with.Timezone
+	}
+
+	if with.Library != nil {
+		merged.Library = with.Library
+	}
+
+	if with.IdempotencyKey != "" {
+		merged.IdempotencyKey = with.IdempotencyKey
+	}
+
+	if with.Location != nil {
+		merged.Location = with.Location
+	}
+
+	if with.UserAgent != nil {
+		merged.UserAgent = with.UserAgent
+	}
+
+	if with.ReceivedAt != nil {
+		merged.ReceivedAt = with.ReceivedAt
+	}
+
+	if with.Clock != nil {
+		merged.Clock = with.Clock
+	}
+
+	if with.Supplied != nil {
+		merged.Supplied = with.Supplied
+	}
+
+	if with.Canary != "" {
+		merged.Canary = with.Canary
+	}
+
+	if with.Consent != nil {
+		merged.Consent = with.Consent
+	}
+
+	return merged
+}
+
+/*
+Validate adds to the validator every validation errors found in the context. The
+path is the location of the context in the request payload, such as "context".
+*/
+func (c *Context) Validate(v *Validator, path ...string) {
+	if c == nil {
+		return
+	}
+
+	c.Consent.Validate(v, append(append([]string{}, path...), "consent")...)
+}
@@ -0,0 +1,298 @@
+package files
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+	"github.com/nunchistudio/smithy/sources/api"
+)
+
+/*
+The formats of the files supported.
+*/
+var (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+	FormatJSON   = "json"
+)
+
+/*
+Mapping is the name of the column, or key, holding each field of a user in the
+files. Fields left empty use the name of the field itself, such as "email".
+*/
+type Mapping struct {
+	Username  string
+	FirstName string
+	LastName  string
+	Email     string
+}
+
+/*
+Detect returns the format of a file given its name, and whether it is compressed
+with gzip. It returns an empty format if the file is not supported.
+
+Supported extensions are ".csv", ".ndjson", and ".json", optionally followed by
+".gz".
+*/
+func Detect(name string) (string, bool) {
+	name = strings.ToLower(name)
+	compressed := strings.HasSuffix(name, ".gz")
+	name = strings.TrimSuffix(name, ".gz")
+
+	switch {
+	case strings.HasSuffix(name, ".csv"):
+		return FormatCSV, compressed
+	case strings.HasSuffix(name, ".ndjson"):
+		return FormatNDJSON, compressed
+	case strings.HasSuffix(name, ".json"):
+		return FormatJSON, compressed
+	}
+
+	return "", false
+}
+
+/*
+Parse reads the users of a file given its name, and calls fn for every valid
+user. The file is streamed so it is never loaded whole in memory.
+
+A file is valid only if every users are valid. Validation errors of every users
+are returned together once the file has been read, with the path of each user
+such as:
+
+	[]string{"request", "payload", "records", "12", "email"}
+
+Records are numbered from 1, not counting the header of CSV files. An error is
+returned right away if the file is malformed. Errors of the reader itself, such
+as a connection reset, are returned as is so the file can be read again later.
+*/
+func Parse(r io.Reader, name string, mapping *Mapping, fn func(*api.User) error) error {
+	format, compressed := Detect(name)
+	if format == "" {
+		return &errors.Error{
+			StatusCode: 400,
+			Message:    "Unsupported file format: " + name,
+		}
+	}
+
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return wrap(err, 0)
+		}
+
+		defer gz.Close()
+		r = gz
+	}
+
+	if mapping == nil {
+		mapping = &Mapping{}
+	}
+
+	v := &sources.Validator{}
+	index := 0
+	var failed error
+	record := func(fields map[string]string) error {
+		index++
+		u := mapping.user(fields)
+
+		before := len(v.Validations())
+		u.Validate(v, "records", strconv.Itoa(index))
+		if len(v.Validations()) > before {
+			return nil
+		}
+
+		failed = fn(u)
+		return failed
+	}
+
+	var err error
+	switch format {
+	case FormatCSV:
+		err = parseCSV(r, record)
+	default:
+		err = parseJSON(r, record)
+	}
+
+	if failed != nil {
+		return failed
+	} else if err != nil {
+		return wrap(err, index)
+	}
+
+	return v.Err()
+}
+
+/*
+wrap returns the error of a malformed file after a record as a validation error.
+Other errors are returned as is.
+*/
+func wrap(err error, index int) error {
+	if !malformed(err) {
+		return err
+	}
+
+	return &errors.Error{
+		StatusCode: 400,
+		Message:    "Bad Request",
+		Validations: []errors.Validation{
+			{
+				Message: "File is malformed after record " + strconv.Itoa(index) + ": " + err.Error(),
+				Path:    sources.Path("records", strconv.Itoa(index+1)),
+			},
+		},
+	}
+}
+
+/*
+malformed returns whether an error comes from the content of a file, and not from
+the reader of the file. A file ending in the middle of a record is malformed.
+*/
+func malformed(err error) bool {
+	switch err.(type) {
+	case *csv.ParseError, *json.SyntaxError, *json.UnmarshalTypeError, flate.CorruptInputError:
+		return true
+	}
+
+	return err == io.ErrUnexpectedEOF || err == io.EOF || err == gzip.ErrHeader || err == gzip.ErrChecksum
+}
+
+/*
+parseCSV reads the records of a CSV file. The first line must be the header.
+*/
+func parseCSV(r io.Reader, record func(map[string]string) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 0
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		fields := map[string]string{}
+		for i, value := range values {
+			fields[header[i]] = value
+		}
+
+		err = record(fields)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+parseJSON reads the records of a JSON file. It can either be a list of objects,
+or objects separated by new lines.
+*/
+func parseJSON(r io.Reader, record func(map[string]string) error) error {
+	buffered := bufio.NewReader(r)
+	decoder := json.NewDecoder(buffered)
+
+	// Skip the opening bracket of a list, if any.
+	first, err := peek(buffered)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	list := first == '['
+	if list {
+		_, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		if list && !decoder.More() {
+			_, err = decoder.Token()
+			return err
+		}
+
+		var object map[string]interface{}
+		err = decoder.Decode(&object)
+		if err == io.EOF && !list {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		fields := map[string]string{}
+		for key, value := range object {
+			switch value := value.(type) {
+			case string:
+				fields[key] = value
+			case nil:
+			default:
+				fields[key] = fmt.Sprint(value)
+			}
+		}
+
+		err = record(fields)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+peek returns the first byte of a reader which is not a space, without consuming
+it.
+*/
+func peek(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+/*
+user returns the user of a record given the mapping.
+*/
+func (m *Mapping) user(fields map[string]string) *api.User {
+	column := func(name string, fallback string) string {
+		if name == "" {
+			name = fallback
+		}
+
+		return strings.TrimSpace(fields[name])
+	}
+
+	return &api.User{
+		Username:  column(m.Username, "username"),
+		FirstName: column(m.FirstName, "first_name"),
+		LastName:  column(m.LastName, "last_name"),
+		Email:     column(m.Email, "email"),
+	}
+}
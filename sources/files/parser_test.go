@@ -0,0 +1,106 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources/api"
+)
+
+/*
+failing is a reader returning its content, and then an error instead of the end
+of the file, such as a connection reset while reading an object.
+*/
+type failing struct {
+	content io.Reader
+	err     error
+}
+
+func (r *failing) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+
+	return n, err
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]string{
+		"users.csv":    "username,first_name,last_name,email\njdoe,John,Doe,john@example.com\njane,Jane,Doe,jane@example.com\n",
+		"users.ndjson": `{"username":"jdoe","first_name":"John","last_name":"Doe","email":"john@example.com"}` + "\n" + `{"username":"jane","first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`,
+		"users.json":   `[{"username":"jdoe","first_name":"John","last_name":"Doe","email":"john@example.com"},{"username":"jane","first_name":"Jane","last_name":"Doe","email":"jane@example.com"}]`,
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			users := []*api.User{}
+			err := Parse(strings.NewReader(content), name, nil, func(u *api.User) error {
+				users = append(users, u)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(users) != 2 || users[0].Email != "john@example.com" || users[1].FirstName != "Jane" {
+				t.Fatalf("unexpected users: %+v", users)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := map[string]string{
+		"users.csv":    "username,first_name,last_name,email\njdoe,\"John,Doe,john@example.com\n",
+		"users.ndjson": `{"username":"jdoe","first_name":"John","last_name":"Doe","email":"john@example.com"}` + "\n" + `{"username":`,
+		"users.json":   `[{"username":"jdoe","first_name":"John","last_name":"Doe","email":"john@example.com"},`,
+		"users.csv.gz": "not gzip",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := Parse(strings.NewReader(content), name, nil, func(u *api.User) error {
+				return nil
+			})
+
+			fail, ok := err.(*errors.Error)
+			if !ok || fail.StatusCode != 400 {
+				t.Fatalf("expected a 400 error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseReaderFailure(t *testing.T) {
+	reset := io.ErrClosedPipe
+	content := "username,first_name,last_name,email\njdoe,John,Doe,john@example.com\njane,Ja"
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(content))
+	gz.Close()
+
+	tests := map[string]io.Reader{
+		"users.csv":    &failing{content: strings.NewReader(content), err: reset},
+		"users.ndjson": &failing{content: strings.NewReader(`{"username":"jdoe","first_name":"John","last_name":"Doe","email":"john@example.com"}` + "\n" + `{"user`), err: reset},
+		"users.csv.gz": &failing{content: bytes.NewReader(compressed.Bytes()[:compressed.Len()/2]), err: reset},
+	}
+
+	for name, r := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := Parse(r, name, nil, func(u *api.User) error {
+				return nil
+			})
+
+			if err != reset {
+				t.Fatalf("expected the error of the reader, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+	"github.com/nunchistudio/smithy/sources/api"
+)
+
+/*
+Sender sends the batches of users read from files to the gateway, and waits for
+them to be persisted. It is shared by the triggers ingesting files, such as the
+one of this source and the one of the "s3" source.
+
+The data of every batch must have its identifier in its "id" key, so its event
+can be found once persisted.
+*/
+type Sender struct {
+
+	// Source and Trigger are the names of the source and of the trigger sending
+	// the batches, such as "files" and "scan".
+	Source  string
+	Trigger string
+
+	// State tracks the batches dropped by the middlewares of the source.
+	State *sources.Tracker
+
+	// Timeout is the maximum time to wait for the gateway to persist the event of
+	// a batch.
+	//
+	// Default: 1 minute
+	Timeout time.Duration
+}
+
+/*
+BatchID returns the identifier of a part of a file given the hash identifying the
+file, such as the hash of its content.
+*/
+func BatchID(hash string, part int) string {
+	if len(hash) > 32 {
+		hash = hash[:32]
+	}
+
+	return hash + "-" + strconv.Itoa(part)
+}
+
+/*
+Send sends a batch of users to the gateway, unless it has already been persisted,
+and waits for it to be persisted or dropped by a middleware. It returns whether
+the batch has been sent.
+
+Users failing to be mapped are logged, and no flow is run for them.
+*/
+func (s *Sender) Send(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier, id string, batch interface{}, users []*api.User) (bool, error) {
+	stored, err := sources.Stored(s.Source, s.Trigger, "id", id)
+	if err != nil || stored != "" {
+		return false, err
+	}
+
+	c := &sources.Context{}
+	now := time.Now().UTC()
+	flows := []flow.Flow{}
+	for i, u := range users {
+		f, err := u.Flows(c, &now)
+		if err != nil {
+			tk.Logger.Warn(s.Source + "/" + s.Trigger + ": User " + strconv.Itoa(i) + " of batch " + id + " can not be mapped: " + err.Error())
+			continue
+		}
+
+		flows = append(flows, f...)
+	}
+
+	marshaled, err := json.Marshal(c)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return false, err
+	}
+
+	notifier.Payload <- &source.Payload{
+		Context: marshaled,
+		Data:    data,
+		Flows:   flows,
+		SentAt:  &now,
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	return true, s.State.Wait(ctx, s.Source, s.Trigger, id, timeout)
+}
+
+/*
+Dropped records a batch dropped by a middleware, so it is considered as persisted
+and is not sent again. It is meant to be called by the triggers implementing the
+sources.DropObserver interface.
+*/
+func (s *Sender) Dropped(p *source.Payload) {
+	var batch struct {
+		ID string `json:"id"`
+	}
+
+	err := json.Unmarshal(p.Data, &batch)
+	if err != nil || batch.ID == "" {
+		return
+	}
+
+	s.State.Drop(batch.ID)
+}
@@ -0,0 +1,109 @@
+package files
+
+import (
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Source implements the source.Source interface for the "files" source.
+*/
+type Source struct {
+	options *source.Options
+	env     *Options
+	tracker *sources.Tracker
+}
+
+/*
+Options is the options a user can pass to configure the source.
+*/
+type Options struct {
+
+	// Directory is the drop folder scanned for new files. Files are moved to its
+	// "processing", "done", and "failed" sub-directories.
+	Directory string
+
+	// Mapping is the name of the columns, or keys, holding the fields of the users
+	// in the files.
+	Mapping *Mapping
+
+	// MinAge is the minimum time since a file has been modified before it is
+	// processed, so files still being written are skipped.
+	//
+	// Default: 10 seconds
+	MinAge time.Duration
+
+	// BatchSize is the maximum number of users sent within a single event. Files
+	// are split in as many events as needed.
+	//
+	// Default: 500
+	BatchSize int
+
+	// Interval is the interval at which the drop folder is scanned for new files.
+	//
+	// Default: 1 minute
+	Interval time.Duration
+
+	// ConfirmTimeout is the maximum time to wait for the gateway to persist the
+	// event of a batch. Once elapsed, the file is processed again at the next
+	// interval, starting after the last batch persisted.
+	//
+	// Default: 1 minute
+	ConfirmTimeout time.Duration
+
+	// Middlewares is the chain of middlewares every events go through once
+	// extracted, before their flows are run.
+	Middlewares sources.Chain
+}
+
+/*
+New returns a valid Blacksmith source.
+
+The drop folder is scanned every minute by default.
+*/
+func New(options *Options) source.Source {
+	if options == nil {
+		options = &Options{}
+	}
+
+	return &Source{
+		options: &source.Options{
+			DefaultSchedule: &source.Schedule{
+				Interval: "@every 1m",
+			},
+		},
+		env:     options,
+		tracker: &sources.Tracker{},
+	}
+}
+
+/*
+String returns the string representation of the source.
+*/
+func (files *Source) String() string {
+	return "files"
+}
+
+/*
+Options returns common source options. They will be shared across every triggers
+of this source, except when overridden.
+*/
+func (files *Source) Options() *source.Options {
+	return files.options
+}
+
+/*
+Triggers return a list of triggers the source is able to handle. Every triggers
+are wrapped with the middlewares of the source.
+*/
+func (files *Source) Triggers() map[string]source.Trigger {
+	return map[string]source.Trigger{
+		"scan": files.env.Middlewares.Wrap(files.String(), TriggerScan{
+			env:   files.env,
+			state: files.tracker,
+		}),
+	}
+}
@@ -0,0 +1,388 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+	"github.com/nunchistudio/smithy/sources/api"
+)
+
+/*
+TriggerScan is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It scans the drop folder for new files at every interval, and emits the users of
+every file through the "OnRegister" flow. Files are streamed, so they are never
+loaded whole in memory:
+
+ 1. A first read validates every users of the file. A file failing to parse is
+    moved to "failed" along with an error report, and no event is emitted.
+ 2. The file is moved to "processing", and a second read emits the users in
+    batches, each batch being its own event. A batch is only considered as sent
+    once its event has been persisted by the gateway.
+ 3. The file is moved to "done" once every batch has been persisted.
+
+Files left in "processing" are processed again first, skipping the batches
+already persisted. Batches are identified by the hash of the content of the file,
+so a file already ingested is moved to "done" without emitting any event.
+*/
+type TriggerScan struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Batch `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env   *Options
+	state *sources.Tracker
+}
+
+/*
+File is a file of the drop folder being ingested.
+*/
+type File struct {
+	Name    string `json:"name"`
+	Hash    string `json:"hash"`
+	Format  string `json:"format"`
+	Records int    `json:"records"`
+}
+
+/*
+Batch is the data payload specific to this trigger. Parts are numbered from 1.
+*/
+type Batch struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Hash    string `json:"hash"`
+	Format  string `json:"format"`
+	Part    int    `json:"part"`
+	Records int    `json:"records"`
+}
+
+/*
+Report is the error report written next to a file that failed to parse.
+*/
+type Report struct {
+	File  *File         `json:"file"`
+	Error *errors.Error `json:"error"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerScan) String() string {
+	return "scan"
+}
+
+/*
+Mode allows to register the trigger as an ongoing task, so every batch can be
+emitted as its own event. No additional details are needed for this mode.
+*/
+func (t TriggerScan) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It scans the drop folder at every
+interval. The function returns once the gateway is shutting down.
+*/
+func (t TriggerScan) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	interval := t.env.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-notifier.IsShuttingDown
+		cancel()
+	}()
+
+	for {
+		err := t.scan(ctx, tk, notifier)
+		if err != nil && ctx.Err() == nil {
+			notifier.Error <- err
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			notifier.Done <- true
+			return
+		}
+	}
+}
+
+/*
+Dropped implements the sources.DropObserver interface. Batches dropped by a
+middleware are considered as persisted, so they are not sent again.
+*/
+func (t TriggerScan) Dropped(p *source.Payload, dropped *sources.Dropped) {
+	t.sender().Dropped(p)
+}
+
+/*
+sender returns the sender of the batches of the trigger.
+*/
+func (t TriggerScan) sender() *Sender {
+	return &Sender{
+		Source:  "files",
+		Trigger: t.String(),
+		State:   t.state,
+		Timeout: t.env.ConfirmTimeout,
+	}
+}
+
+/*
+scan processes the files left in "processing" first, and then the new files of
+the drop folder from the oldest to the newest.
+*/
+func (t TriggerScan) scan(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier) error {
+	for _, dir := range []string{"processing", "done", "failed"} {
+		err := os.MkdirAll(filepath.Join(t.env.Directory, dir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	minAge := t.env.MinAge
+	if minAge == 0 {
+		minAge = 10 * time.Second
+	}
+
+	for _, dir := range []string{"processing", ""} {
+		entries, err := ioutil.ReadDir(filepath.Join(t.env.Directory, dir))
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].ModTime().Before(entries[j].ModTime())
+		})
+
+		for _, entry := range entries {
+			if format, _ := Detect(entry.Name()); entry.IsDir() || format == "" {
+				continue
+			}
+
+			// Skip the files which may still be written.
+			if dir == "" && time.Since(entry.ModTime()) < minAge {
+				continue
+			}
+
+			err = t.process(ctx, tk, notifier, dir, entry.Name())
+			if err != nil {
+				return err
+			}
+
+			if ctx.Err() != nil {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+process validates a file of a sub-directory of the drop folder, and then sends
+its users in batches.
+*/
+func (t TriggerScan) process(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier, dir string, name string) error {
+	hash, err := hashFile(filepath.Join(t.env.Directory, dir, name))
+	if err != nil {
+		return err
+	}
+
+	format, _ := Detect(name)
+	file := &File{
+		Name:   name,
+		Hash:   hash,
+		Format: format,
+	}
+
+	err = t.read(dir, name, func(u *api.User) error {
+		file.Records++
+		return nil
+	})
+
+	if fail, ok := err.(*errors.Error); ok {
+		tk.Logger.Warn("files/scan: File " + name + " failed to parse")
+		return t.fail(file, dir, fail)
+	} else if err != nil {
+		return err
+	}
+
+	if dir != "processing" {
+		name, err = t.move(name, dir, "processing")
+		if err != nil {
+			return err
+		}
+
+		dir = "processing"
+	}
+
+	size := t.env.BatchSize
+	if size <= 0 {
+		size = 500
+	}
+
+	sender := t.sender()
+	part := 0
+	sent := 0
+	batch := []*api.User{}
+	flush := func() error {
+		part++
+		b := &Batch{
+			ID:      BatchID(file.Hash, part),
+			Name:    file.Name,
+			Hash:    file.Hash,
+			Format:  file.Format,
+			Part:    part,
+			Records: len(batch),
+		}
+
+		ok, err := sender.Send(ctx, tk, notifier, b.ID, b, batch)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			sent++
+		}
+
+		batch = batch[:0]
+		return nil
+	}
+
+	err = t.read(dir, name, func(u *api.User) error {
+		batch = append(batch, u)
+		if len(batch) < size {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	// A file without any user is still emitted so its ingestion is recorded.
+	if len(batch) > 0 || part == 0 {
+		err = flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if sent == 0 {
+		tk.Logger.Info("files/scan: File " + name + " has already been ingested")
+	}
+
+	_, err = t.move(name, dir, "done")
+	return err
+}
+
+/*
+read streams the users of a file of a sub-directory of the drop folder.
+*/
+func (t TriggerScan) read(dir string, name string, fn func(*api.User) error) error {
+	f, err := os.Open(filepath.Join(t.env.Directory, dir, name))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return Parse(f, name, t.env.Mapping, fn)
+}
+
+/*
+fail moves a file to "failed" and writes its error report next to it, named after
+the file such as "users.csv.error.json".
+*/
+func (t TriggerScan) fail(file *File, from string, fail *errors.Error) error {
+	name, err := t.move(file.Name, from, "failed")
+	if err != nil {
+		return err
+	}
+
+	report, err := json.MarshalIndent(&Report{
+		File:  file,
+		Error: fail,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(t.env.Directory, "failed", name+".error.json"), report, 0644)
+}
+
+/*
+move moves a file from a sub-directory of the drop folder to another one, and
+returns its new name. A file already having the same name in the destination is
+never overwritten: the time of the move is added to the name, such as
+"users-1594029600000000000.csv". The modification time of the file is updated so
+it reflects the time it has been moved at.
+*/
+func (t TriggerScan) move(name string, from string, to string) (string, error) {
+	now := time.Now()
+	dest := name
+	if _, err := os.Stat(filepath.Join(t.env.Directory, to, dest)); err == nil {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			i = len(name)
+		}
+
+		dest = name[:i] + "-" + strconv.FormatInt(now.UnixNano(), 10) + name[i:]
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	err := os.Rename(filepath.Join(t.env.Directory, from, name), filepath.Join(t.env.Directory, to, dest))
+	if err != nil {
+		return "", err
+	}
+
+	return dest, os.Chtimes(filepath.Join(t.env.Directory, to, dest), now, now)
+}
+
+/*
+hashFile returns the SHA-256 hash of the content of a file.
+*/
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,181 @@
+package sources
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+/*
+Location contains data about the location of the client, resolved from its IP
+address.
+*/
+type Location struct {
+	Country     string  `json:"country,omitempty"`
+	CountryName string  `json:"country_name,omitempty"`
+	Region      string  `json:"region,omitempty"`
+	RegionName  string  `json:"region_name,omitempty"`
+	City        string  `json:"city,omitempty"`
+	PostalCode  string  `json:"postal_code,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+	Timezone    string  `json:"timezone,omitempty"`
+}
+
+/*
+geoRecord is the record of a MaxMind City database, such as GeoLite2 City.
+*/
+type geoRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+}
+
+/*
+GeoIP resolves the location of the clients from their IP address, using a MaxMind
+database file (MMDB) on disk. It works fully offline.
+
+The file is reloaded whenever it is modified, so it can be updated without
+restarting the gateway. If the file can not be opened, the last database loaded
+is kept and the lookups are skipped until then.
+*/
+type GeoIP struct {
+
+	// Path is the path to the MMDB file, such as "GeoLite2-City.mmdb".
+	Path string
+
+	// CheckEvery is the interval at which the modification time of the file is
+	// checked to reload the database.
+	//
+	// Default: 1 minute
+	CheckEvery time.Duration
+
+	mutex     sync.RWMutex
+	reader    *maxminddb.Reader
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+/*
+Enrich fills the location of the context given its IP address. If the context
+has no timezone, the one of the location is applied. The location is removed if
+the IP address is missing or unknown, so a location sent by the client is never
+taken as resolved on the server side.
+*/
+func (g *GeoIP) Enrich(ctx *Context) {
+	ctx.Location = nil
+	if ctx.IP == nil {
+		return
+	}
+
+	reader := g.load()
+	if reader == nil {
+		return
+	}
+
+	var record geoRecord
+	err := reader.Lookup(ctx.IP, &record)
+	if err != nil || record.Country.ISOCode == "" {
+		return
+	}
+
+	ctx.Location = &Location{
+		Country:     record.Country.ISOCode,
+		CountryName: record.Country.Names["en"],
+		City:        record.City.Names["en"],
+		PostalCode:  record.Postal.Code,
+		Latitude:    record.Location.Latitude,
+		Longitude:   record.Location.Longitude,
+		Timezone:    record.Location.TimeZone,
+	}
+
+	if len(record.Subdivisions) > 0 {
+		ctx.Location.Region = record.Subdivisions[0].ISOCode
+		ctx.Location.RegionName = record.Subdivisions[0].Names["en"]
+	}
+
+	if ctx.Timezone == "" {
+		ctx.Timezone = record.Location.TimeZone
+	}
+}
+
+/*
+Process implements the Middleware interface. It enriches the context of the event
+and the ones of its flows.
+*/
+func (g *GeoIP) Process(tk *source.Toolkit, e *Event) error {
+	for _, ctx := range e.Contexts() {
+		g.Enrich(ctx)
+	}
+
+	return nil
+}
+
+/*
+load returns the database reader, reloading the file if it has been modified
+since the last check.
+*/
+func (g *GeoIP) load() *maxminddb.Reader {
+	checkEvery := g.CheckEvery
+	if checkEvery == 0 {
+		checkEvery = time.Minute
+	}
+
+	g.mutex.RLock()
+	reader, checkedAt := g.reader, g.checkedAt
+	g.mutex.RUnlock()
+
+	if time.Since(checkedAt) < checkEvery {
+		return reader
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// Another goroutine may have reloaded the database in the meantime.
+	if time.Since(g.checkedAt) < checkEvery {
+		return g.reader
+	}
+
+	g.checkedAt = time.Now()
+	info, err := os.Stat(g.Path)
+	if err != nil || (g.reader != nil && !info.ModTime().After(g.modTime)) {
+		return g.reader
+	}
+
+	// Read the whole file in memory instead of using a memory map, so the file
+	// can safely be replaced on disk while lookups are running.
+	b, err := ioutil.ReadFile(g.Path)
+	if err != nil {
+		return g.reader
+	}
+
+	next, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return g.reader
+	}
+
+	g.reader = next
+	g.modTime = info.ModTime()
+	return g.reader
+}
@@ -0,0 +1,372 @@
+package sources
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+)
+
+/*
+Event is the event extracted by a trigger, before its flows are run. It is passed
+to the middlewares of the source so they can change it.
+*/
+type Event struct {
+
+	// Source is the name of the source the event comes from.
+	Source string
+
+	// Trigger is the name of the trigger the event comes from.
+	Trigger string
+
+	// Context is the context of the event.
+	Context *Context
+
+	// Data is the marshaled data of the event.
+	Data []byte
+
+	// Flows is the flows to run for the event.
+	Flows []flow.Flow
+
+	// SentAt is the timestamp the event was sent at, if any.
+	SentAt *time.Time
+
+	dropped *Dropped
+}
+
+/*
+Contexts returns the context of the event and the context of every flows carrying
+their own one. Middlewares changing the context should change all of them.
+*/
+func (e *Event) Contexts() []*Context {
+	contexts := []*Context{e.Context}
+	for _, f := range e.Flows {
+		if contextual, ok := f.(Contextual); ok && contextual.FlowContext() != nil {
+			contexts = append(contexts, contextual.FlowContext())
+		}
+	}
+
+	return contexts
+}
+
+/*
+Drop drops the event. No event will be created and no flows will be run. The
+middlewares following the current one are not run.
+*/
+func (e *Event) Drop(reason string) {
+	e.dropped = &Dropped{
+		Source:  e.Source,
+		Trigger: e.Trigger,
+		Reason:  reason,
+	}
+}
+
+/*
+Dropped is the error returned when a middleware dropped an event.
+*/
+type Dropped struct {
+	Source  string
+	Trigger string
+	Reason  string
+}
+
+/*
+Error returns the reason why the event has been dropped.
+*/
+func (d *Dropped) Error() string {
+	return d.Source + "/" + d.Trigger + ": Event dropped: " + d.Reason
+}
+
+/*
+HTTP returns the error to respond with when an event received over HTTP has been
+dropped. The request succeeded from the client's point of view, so a 202 status
+code is used.
+*/
+func (d *Dropped) HTTP() error {
+	return &errors.Error{
+		StatusCode: 202,
+		Message:    "Event dropped",
+		Validations: []errors.Validation{
+			{
+				Message: d.Reason,
+				Path:    Path(),
+			},
+		},
+	}
+}
+
+/*
+Middleware is the interface used to process the events extracted by the triggers
+before their flows are run. It can change the context and the data of the event,
+add flows, or drop it.
+*/
+type Middleware interface {
+	Process(*source.Toolkit, *Event) error
+}
+
+/*
+MiddlewareFunc allows to use a function as a Middleware.
+*/
+type MiddlewareFunc func(*source.Toolkit, *Event) error
+
+/*
+Process runs the function.
+*/
+func (fn MiddlewareFunc) Process(tk *source.Toolkit, e *Event) error {
+	return fn(tk, e)
+}
+
+/*
+DropObserver is implemented by triggers in CDC mode needing to know when one of
+their events has been dropped by a middleware, such as triggers waiting for their
+events to be persisted before acknowledging them.
+*/
+type DropObserver interface {
+
+	// Dropped is called with the payload sent by the trigger, before it went
+	// through the chain.
+	Dropped(*source.Payload, *Dropped)
+}
+
+/*
+Chain is an ordered list of middlewares. It is configured per source.
+*/
+type Chain []Middleware
+
+/*
+Run runs every middlewares of the chain against the payload extracted by the
+trigger. It returns the payload updated by the middlewares. If the event has been
+dropped, a *Dropped error is returned.
+*/
+func (c Chain) Run(tk *source.Toolkit, s string, trigger string, p *source.Payload) (*source.Payload, error) {
+	if len(c) == 0 || p == nil {
+		return p, nil
+	}
+
+	e := &Event{
+		Source:  s,
+		Trigger: trigger,
+		Context: &Context{},
+		Data:    p.Data,
+		Flows:   p.Flows,
+		SentAt:  p.SentAt,
+	}
+
+	if len(p.Context) > 0 {
+		err := json.Unmarshal(p.Context, &e.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		// The context can be "null" if the event was sent without one.
+		if e.Context == nil {
+			e.Context = &Context{}
+		}
+	}
+
+	for _, m := range c {
+		err := m.Process(tk, e)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.dropped != nil {
+			return nil, e.dropped
+		}
+	}
+
+	ctx, err := json.Marshal(e.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	return &source.Payload{
+		Context: ctx,
+		Data:    e.Data,
+		Flows:   e.Flows,
+		SentAt:  e.SentAt,
+	}, nil
+}
+
+/*
+Wrap returns the trigger wrapped with the chain, so every payload it extracts goes
+through the middlewares. It supports triggers in HTTP, CRON, and CDC modes. Other
+triggers are returned as is.
+*/
+func (c Chain) Wrap(s string, t source.Trigger) source.Trigger {
+	switch trigger := t.(type) {
+	case triggerHTTP:
+		return chainedHTTP{trigger, c, s}
+	case triggerCRON:
+		return chainedCRON{trigger, c, s}
+	case triggerCDC:
+		return chainedCDC{trigger, c, s}
+	}
+
+	return t
+}
+
+/*
+Wrapper is implemented by the triggers wrapping another trigger, such as the
+ones wrapped with a chain.
+*/
+type Wrapper interface {
+	Unwrap() source.Trigger
+}
+
+/*
+Unwrap returns the original trigger wrapped by one or more wrappers, or the
+trigger itself if it has not been wrapped. It allows to inspect the type of the
+original trigger.
+*/
+func Unwrap(t source.Trigger) source.Trigger {
+	for {
+		wrapper, ok := t.(Wrapper)
+		if !ok {
+			return t
+		}
+
+		t = wrapper.Unwrap()
+	}
+}
+
+type triggerHTTP interface {
+	source.Trigger
+	source.TriggerHTTP
+}
+
+type triggerCRON interface {
+	source.Trigger
+	source.TriggerCRON
+}
+
+type triggerCDC interface {
+	source.Trigger
+	source.TriggerCDC
+}
+
+/*
+chainedHTTP is a trigger in HTTP mode wrapped with a chain.
+*/
+type chainedHTTP struct {
+	triggerHTTP
+	chain  Chain
+	source string
+}
+
+/*
+Unwrap returns the trigger wrapped with the chain.
+*/
+func (t chainedHTTP) Unwrap() source.Trigger {
+	return t.triggerHTTP
+}
+
+/*
+Extract runs the chain against the payload extracted by the trigger. A dropped
+event is reported with a 202 status code.
+*/
+func (t chainedHTTP) Extract(tk *source.Toolkit, req *http.Request) (*source.Payload, error) {
+	p, err := t.triggerHTTP.Extract(tk, req)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err = t.chain.Run(tk, t.source, t.String(), p)
+	if dropped, ok := err.(*Dropped); ok {
+		return nil, dropped.HTTP()
+	}
+
+	return p, err
+}
+
+/*
+chainedCRON is a trigger in CRON mode wrapped with a chain.
+*/
+type chainedCRON struct {
+	triggerCRON
+	chain  Chain
+	source string
+}
+
+/*
+Unwrap returns the trigger wrapped with the chain.
+*/
+func (t chainedCRON) Unwrap() source.Trigger {
+	return t.triggerCRON
+}
+
+/*
+Extract runs the chain against the payload extracted by the trigger. A dropped
+event is returned as an error so no event is created.
+*/
+func (t chainedCRON) Extract(tk *source.Toolkit) (*source.Payload, error) {
+	p, err := t.triggerCRON.Extract(tk)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.chain.Run(tk, t.source, t.String(), p)
+}
+
+/*
+chainedCDC is a trigger in CDC mode wrapped with a chain.
+*/
+type chainedCDC struct {
+	triggerCDC
+	chain  Chain
+	source string
+}
+
+/*
+Unwrap returns the trigger wrapped with the chain.
+*/
+func (t chainedCDC) Unwrap() source.Trigger {
+	return t.triggerCDC
+}
+
+/*
+Extract runs the trigger with a notifier of its own. Every payload sent by the
+trigger goes through the chain before being forwarded to the gateway. Dropped
+events are logged and not forwarded. The trigger is notified if it implements the
+DropObserver interface.
+*/
+func (t chainedCDC) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	payloads := make(chan *source.Payload)
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case extracted := <-payloads:
+				p, err := t.chain.Run(tk, t.source, t.String(), extracted)
+				if dropped, ok := err.(*Dropped); ok {
+					tk.Logger.Info(dropped.Error())
+					if observer, ok := t.triggerCDC.(DropObserver); ok {
+						observer.Dropped(extracted, dropped)
+					}
+
+					continue
+				} else if err != nil {
+					notifier.Error <- err
+					continue
+				}
+
+				notifier.Payload <- p
+
+			case <-done:
+				notifier.Done <- true
+				return
+			}
+		}
+	}()
+
+	t.triggerCDC.Extract(tk, &source.Notifier{
+		Payload:        payloads,
+		Error:          notifier.Error,
+		IsShuttingDown: notifier.IsShuttingDown,
+		Done:           done,
+	})
+}
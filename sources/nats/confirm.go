@@ -0,0 +1,137 @@
+package nats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	natsio "github.com/nats-io/nats.go"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+confirmer acknowledges the messages once their event has been stored by the
+gateway. Messages are confirmed in batches by a single goroutine, so handlers
+return right after sending an event and the messages of a subscription are not
+processed one after the other.
+*/
+type confirmer struct {
+	trigger TriggerMessage
+	timeout time.Duration
+	mutex   sync.Mutex
+	pending map[string]*pending
+}
+
+/*
+pending is a message whose event has been sent to the gateway but not stored yet.
+*/
+type pending struct {
+	msg       *natsio.Msg
+	message   *Message
+	jetstream bool
+	deadline  time.Time
+	progress  time.Time
+}
+
+/*
+add adds a message to confirm once its event has been stored.
+*/
+func (c *confirmer) add(msg *natsio.Msg, message *Message, jetstream bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.pending[message.ID] = &pending{
+		msg:       msg,
+		message:   message,
+		jetstream: jetstream,
+		deadline:  now.Add(c.timeout),
+		progress:  now,
+	}
+}
+
+/*
+run confirms the pending messages every 200 milliseconds until the context is
+canceled. Messages still pending at this time are not acknowledged, so JetStream
+redelivers them. They are not stored twice.
+*/
+func (c *confirmer) run(ctx context.Context, notifier *source.Notifier) {
+	for {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+
+		for _, err := range c.confirm() {
+			if ctx.Err() == nil {
+				notifier.Error <- err
+			}
+		}
+	}
+}
+
+/*
+confirm acknowledges the pending messages whose event has been stored or dropped
+by a middleware. JetStream is told the other messages are still being processed,
+so they are not redelivered in the meantime, and messages not stored in time are
+negatively acknowledged so they are redelivered right away. It returns the errors
+encountered, if any.
+*/
+func (c *confirmer) confirm() []error {
+	c.mutex.Lock()
+	ids := make([]string, 0, len(c.pending))
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+
+	c.mutex.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	stored, err := sources.StoredAll("nats", c.trigger.String(), "id", ids)
+	if err != nil {
+		return []error{err}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	failed := []error{}
+	for _, id := range ids {
+		var err error
+		p := c.pending[id]
+		switch {
+		case stored[id] != "" || c.trigger.state.Dropped(id) > 0:
+			c.trigger.state.Forget(id)
+			delete(c.pending, id)
+			err = c.trigger.ack(p.msg, p.message, p.jetstream)
+
+		case now.After(p.deadline):
+			delete(c.pending, id)
+			if p.jetstream {
+				p.msg.Nak()
+			}
+
+			err = &errors.Error{
+				StatusCode: 500,
+				Message:    "nats/message: Message " + id + " has not been stored after " + c.timeout.String(),
+			}
+
+		case p.jetstream && now.Sub(p.progress) > 10*time.Second:
+			p.progress = now
+			err = p.msg.InProgress()
+		}
+
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	return failed
+}
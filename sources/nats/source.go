@@ -0,0 +1,170 @@
+package nats
+
+import (
+	"strings"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Source implements the source.Source interface for the "nats" source.
+*/
+type Source struct {
+	options *source.Options
+	env     *Options
+	tracker *sources.Tracker
+}
+
+/*
+Options is the options a user can pass to configure the source.
+*/
+type Options struct {
+
+	// URL is the URL of the NATS server to subscribe to, such as
+	// "nats://blacksmith_pubsub:4222".
+	URL string
+
+	// Subscriptions is the list of subjects to subscribe to.
+	Subscriptions []*Subscription
+
+	// JetStream enables the JetStream consumers, if JetStream is available on the
+	// server. Messages are then only acknowledged once their event has been stored
+	// by the gateway, and are redelivered otherwise. Subscriptions use core NATS
+	// when JetStream is not available.
+	JetStream bool
+
+	// Routes is the list of routes to match the subjects of the messages against.
+	// The flows of the first route matching the subject of a message are run. A
+	// message not matching any route is still stored, without running any flow.
+	Routes []*Route
+
+	// ConfirmTimeout is the maximum time to wait for the gateway to store the
+	// event of a message. Once elapsed, JetStream messages are redelivered right
+	// away.
+	//
+	// Default: 1 minute
+	ConfirmTimeout time.Duration
+
+	// MinReconnectInterval is the time to wait before connecting again when the
+	// connection to the server can not be established. It is doubled after each
+	// failed attempt.
+	//
+	// Default: 1 second
+	MinReconnectInterval time.Duration
+
+	// MaxReconnectInterval is the maximum time to wait between two attempts to
+	// connect.
+	//
+	// Default: 1 minute
+	MaxReconnectInterval time.Duration
+
+	// Middlewares is the chain of middlewares every events go through once
+	// extracted, before their flows are run.
+	Middlewares sources.Chain
+}
+
+/*
+Subscription is a subscription to a subject.
+*/
+type Subscription struct {
+
+	// Subject is the subject to subscribe to. It can contain wildcards, such as
+	// "users.*" or "users.>".
+	Subject string
+
+	// Queue is the queue group to join. Messages are distributed across the
+	// members of a queue group, so they are consumed only once when running
+	// several gateways.
+	Queue string
+
+	// Durable is the name of the JetStream durable consumer. The position of the
+	// consumer is kept by the server across restarts. It is ignored when JetStream
+	// is not enabled.
+	Durable string
+}
+
+/*
+Route runs flows for the messages whose subject matches its pattern.
+*/
+type Route struct {
+
+	// Subject is the pattern to match the subjects against. It can contain
+	// wildcards, such as "users.*" or "users.>".
+	Subject string
+
+	// Flows returns the flows to run for a message. A message is rejected without
+	// being stored if a 400 *errors.Error is returned, such as when its data is
+	// invalid, so it is not redelivered. It is redelivered on other errors.
+	Flows func(*Message) ([]flow.Flow, error)
+}
+
+/*
+New returns a valid Blacksmith source.
+*/
+func New(options *Options) source.Source {
+	if options == nil {
+		options = &Options{}
+	}
+
+	return &Source{
+		options: &source.Options{
+			DefaultSchedule: &source.Schedule{
+				Interval: "@every 1m",
+			},
+		},
+		env:     options,
+		tracker: &sources.Tracker{},
+	}
+}
+
+/*
+String returns the string representation of the source.
+*/
+func (nats *Source) String() string {
+	return "nats"
+}
+
+/*
+Options returns common source options. They will be shared across every triggers
+of this source, except when overridden.
+*/
+func (nats *Source) Options() *source.Options {
+	return nats.options
+}
+
+/*
+Triggers return a list of triggers the source is able to handle. Every triggers
+are wrapped with the middlewares of the source.
+*/
+func (nats *Source) Triggers() map[string]source.Trigger {
+	return map[string]source.Trigger{
+		"message": nats.env.Middlewares.Wrap(nats.String(), TriggerMessage{
+			env:   nats.env,
+			state: nats.tracker,
+		}),
+	}
+}
+
+/*
+match returns whether a subject matches a pattern. A "*" matches a single token,
+and a ">" matches one or more tokens at the end of the subject.
+*/
+func match(pattern string, subject string) bool {
+	patterns := strings.Split(pattern, ".")
+	subjects := strings.Split(subject, ".")
+	for i, token := range patterns {
+		if token == ">" {
+			return len(subjects) > i
+		}
+
+		if i >= len(subjects) || (token != "*" && token != subjects[i]) {
+			return false
+		}
+	}
+
+	return len(patterns) == len(subjects)
+}
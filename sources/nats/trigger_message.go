@@ -0,0 +1,457 @@
+package nats
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	natsio "github.com/nats-io/nats.go"
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+TriggerMessage is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It consumes the messages published on the subjects subscribed to. Messages must
+be JSON objects with the same keys as the events:
+
+	{
+	  "context": { "locale": "en-US" },
+	  "data": { "email": "jane@example.com" },
+	  "sent_at": "2020-07-27T10:00:00Z"
+	}
+
+A message is acknowledged only once its event has been stored by the gateway.
+JetStream messages are acknowledged to the server, and messages sent as requests
+over core NATS are replied to. Messages are confirmed in batches in the
+background, so a subscription does not wait for the event of a message to be
+stored before consuming the next one. Messages redelivered by JetStream are not
+stored twice.
+
+Messages whose route returns a 400 error, such as invalid users, are rejected so
+they are not redelivered.
+*/
+type TriggerMessage struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Message `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env   *Options
+	state *sources.Tracker
+}
+
+/*
+Message is the data payload specific to this trigger. Stream and Sequence are
+only set for JetStream messages. Context and SentAt are the ones of the event,
+so the flows of the message can rely on them.
+*/
+type Message struct {
+	ID       string           `json:"id"`
+	Subject  string           `json:"subject"`
+	Stream   string           `json:"stream,omitempty"`
+	Sequence uint64           `json:"sequence,omitempty"`
+	Data     json.RawMessage  `json:"data"`
+	Context  *sources.Context `json:"-"`
+	SentAt   *time.Time       `json:"-"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerMessage) String() string {
+	return "message"
+}
+
+/*
+Mode allows to register the trigger as an ongoing task, so every message can be
+emitted as its own event. No additional details are needed for this mode.
+*/
+func (t TriggerMessage) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It subscribes to the subjects and
+consumes their messages until the gateway is shutting down. The connection is
+then drained so the messages being consumed are not lost.
+*/
+func (t TriggerMessage) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	minWait := t.env.MinReconnectInterval
+	if minWait == 0 {
+		minWait = time.Second
+	}
+
+	maxWait := t.env.MaxReconnectInterval
+	if maxWait == 0 {
+		maxWait = time.Minute
+	}
+
+	timeout := t.env.ConfirmTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-notifier.IsShuttingDown
+		cancel()
+	}()
+
+	confirms := &confirmer{
+		trigger: t,
+		timeout: timeout,
+		pending: map[string]*pending{},
+	}
+
+	go confirms.run(ctx, notifier)
+
+	wait := minWait
+	for {
+		closed := make(chan struct{})
+		conn, err := t.subscribe(ctx, tk, notifier, confirms, closed)
+		if err == nil {
+			<-ctx.Done()
+			if conn.Drain() == nil {
+				<-closed
+			}
+
+			notifier.Done <- true
+			return
+		}
+
+		if conn != nil {
+			conn.Close()
+		}
+
+		notifier.Error <- err
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			notifier.Done <- true
+			return
+		}
+
+		wait *= 2
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+/*
+Dropped implements the sources.DropObserver interface. Messages dropped by a
+middleware are acknowledged, since they will never be stored.
+*/
+func (t TriggerMessage) Dropped(p *source.Payload, dropped *sources.Dropped) {
+	var message Message
+	err := json.Unmarshal(p.Data, &message)
+	if err != nil {
+		return
+	}
+
+	t.state.Drop(message.ID)
+}
+
+/*
+subscribe connects to the server and subscribes to every subjects. The client
+reconnects by itself once connected. The closed channel is closed once the
+connection is closed.
+*/
+func (t TriggerMessage) subscribe(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier, confirms *confirmer, closed chan struct{}) (*natsio.Conn, error) {
+	url := t.env.URL
+	if url == "" {
+		url = natsio.DefaultURL
+	}
+
+	conn, err := natsio.Connect(url,
+		natsio.Name("smithy"),
+		natsio.MaxReconnects(-1),
+		natsio.ClosedHandler(func(*natsio.Conn) {
+			close(closed)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var js natsio.JetStreamContext
+	if t.env.JetStream {
+		js, err = conn.JetStream()
+		if err == nil {
+			_, err = js.AccountInfo()
+		}
+
+		if err != nil {
+			tk.Logger.Warn("nats/message: JetStream is not available, using core NATS: " + err.Error())
+			js = nil
+		}
+	}
+
+	for _, sub := range t.env.Subscriptions {
+		jetstream := js != nil
+		handler := func(msg *natsio.Msg) {
+			t.handle(notifier, confirms, msg, jetstream)
+		}
+
+		switch {
+		case jetstream:
+			opts := []natsio.SubOpt{natsio.ManualAck(), natsio.AckExplicit()}
+			if sub.Durable != "" {
+				opts = append(opts, natsio.Durable(sub.Durable))
+			}
+
+			if sub.Queue != "" {
+				_, err = js.QueueSubscribe(sub.Subject, sub.Queue, handler, opts...)
+			} else {
+				_, err = js.Subscribe(sub.Subject, handler, opts...)
+			}
+
+		case sub.Queue != "":
+			_, err = conn.QueueSubscribe(sub.Subject, sub.Queue, handler)
+
+		default:
+			_, err = conn.Subscribe(sub.Subject, handler)
+		}
+
+		if err != nil {
+			return conn, err
+		}
+	}
+
+	return conn, nil
+}
+
+/*
+handle sends the event of a message to the gateway, and adds the message to the
+ones to confirm once the event has been stored. Messages already stored are
+acknowledged right away, and malformed or invalid messages are rejected so they
+are not redelivered.
+*/
+func (t TriggerMessage) handle(notifier *source.Notifier, confirms *confirmer, msg *natsio.Msg, jetstream bool) {
+	message := &Message{
+		Subject: msg.Subject,
+	}
+
+	err := t.identify(msg, message, jetstream)
+	if err != nil {
+		notifier.Error <- err
+		return
+	}
+
+	var incoming struct {
+		Context *sources.Context `json:"context"`
+		Data    json.RawMessage  `json:"data"`
+		SentAt  *time.Time       `json:"sent_at"`
+	}
+
+	err = json.Unmarshal(msg.Data, &incoming)
+	if err != nil || len(incoming.Data) == 0 {
+		if jetstream {
+			msg.Term()
+		}
+
+		notifier.Error <- &errors.Error{
+			StatusCode: 400,
+			Message:    "nats/message: Message " + message.ID + " on subject " + msg.Subject + " is malformed",
+		}
+
+		return
+	}
+
+	// Messages with an invalid context can not be fixed by being redelivered.
+	v := &sources.Validator{}
+	incoming.Context.Validate(v, "context")
+	if len(v.Validations()) > 0 {
+		if jetstream {
+			msg.Term()
+		}
+
+		notifier.Error <- &errors.Error{
+			StatusCode:  400,
+			Message:     "nats/message: Message " + message.ID + " on subject " + msg.Subject + " has an invalid context",
+			Validations: v.Validations(),
+		}
+
+		return
+	}
+
+	message.Data = incoming.Data
+	message.Context = incoming.Context
+	message.SentAt = incoming.SentAt
+	flows, err := t.route(message)
+	if fail, ok := err.(*errors.Error); ok && fail.StatusCode == 400 {
+		if jetstream {
+			msg.Term()
+		}
+
+		notifier.Error <- &errors.Error{
+			StatusCode:  400,
+			Message:     "nats/message: Message " + message.ID + " on subject " + msg.Subject + " is invalid",
+			Validations: fail.Validations,
+		}
+
+		return
+	} else if err != nil {
+		if jetstream {
+			msg.Nak()
+		}
+
+		notifier.Error <- err
+		return
+	}
+
+	stored, err := sources.Stored("nats", t.String(), "id", message.ID)
+	if err != nil {
+		notifier.Error <- err
+		return
+	}
+
+	if stored != "" {
+		err = t.ack(msg, message, jetstream)
+		if err != nil {
+			notifier.Error <- err
+		}
+
+		return
+	}
+
+	err = t.send(notifier, message, flows, incoming.Context, incoming.SentAt)
+	if err != nil {
+		if jetstream {
+			msg.Nak()
+		}
+
+		notifier.Error <- err
+		return
+	}
+
+	confirms.add(msg, message, jetstream)
+}
+
+/*
+route returns the flows of the first route matching the subject of a message.
+*/
+func (t TriggerMessage) route(message *Message) ([]flow.Flow, error) {
+	for _, route := range t.env.Routes {
+		if match(route.Subject, message.Subject) {
+			if route.Flows == nil {
+				break
+			}
+
+			return route.Flows(message)
+		}
+	}
+
+	return []flow.Flow{}, nil
+}
+
+/*
+send sends the event of a message to the gateway with the flows of its route.
+*/
+func (t TriggerMessage) send(notifier *source.Notifier, message *Message, flows []flow.Flow, c *sources.Context, sentAt *time.Time) error {
+	// Only the canary trigger can tag events as canaries.
+	if c == nil {
+		c = &sources.Context{}
+	}
+
+	c.Canary = ""
+
+	marshaled, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	if sentAt == nil {
+		now := time.Now().UTC()
+		sentAt = &now
+	}
+
+	notifier.Payload <- &source.Payload{
+		Context: marshaled,
+		Data:    data,
+		Flows:   flows,
+		SentAt:  sentAt,
+	}
+
+	return nil
+}
+
+/*
+identify sets the identifier of a message. JetStream messages are identified by
+their stream and sequence, so redeliveries share the same identifier. Other
+messages are identified by their "Nats-Msg-Id" header if any, or by a random
+identifier otherwise.
+*/
+func (t TriggerMessage) identify(msg *natsio.Msg, message *Message, jetstream bool) error {
+	if jetstream {
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+
+		message.ID = meta.Stream + "-" + strconv.FormatUint(meta.Sequence.Stream, 10)
+		message.Stream = meta.Stream
+		message.Sequence = meta.Sequence.Stream
+		return nil
+	}
+
+	if msg.Header != nil && msg.Header.Get("Nats-Msg-Id") != "" {
+		message.ID = msg.Header.Get("Nats-Msg-Id")
+		return nil
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+
+	message.ID = hex.EncodeToString(b)
+	return nil
+}
+
+/*
+ack acknowledges a message once its event has been stored. Messages sent as
+requests over core NATS are replied to with the identifier of the message.
+*/
+func (t TriggerMessage) ack(msg *natsio.Msg, message *Message, jetstream bool) error {
+	if jetstream {
+		return msg.Ack()
+	}
+
+	if msg.Reply == "" {
+		return nil
+	}
+
+	reply, err := json.Marshal(map[string]string{
+		"id": message.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return msg.Respond(reply)
+}
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+var (
+	pools      = map[string]*sql.DB{}
+	poolsMutex sync.Mutex
+)
+
+/*
+open returns the connection pool to the database given its connection string. A
+pool is opened only once per connection string and is shared across the triggers
+of the source.
+*/
+func open(connection string) (*sql.DB, error) {
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	if db, exists := pools[connection]; exists {
+		return db, nil
+	}
+
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return nil, err
+	}
+
+	pools[connection] = db
+	return db, nil
+}
+
+/*
+quoteTable quotes the name of a table, optionally prefixed by its schema, such as
+"public.users", so it can safely be used in a query.
+*/
+func quoteTable(table string) string {
+	parts := strings.SplitN(table, ".", 2)
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+/*
+splitTable returns the schema and the name of a table, such as "public" and
+"users" for "public.users". The schema is "public" if missing.
+*/
+func splitTable(table string) (string, string) {
+	parts := strings.SplitN(table, ".", 2)
+	if len(parts) == 1 {
+		return "public", parts[0]
+	}
+
+	return parts[0], parts[1]
+}
@@ -2,6 +2,8 @@ package postgres
 
 import (
 	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
 )
 
 /*
@@ -9,6 +11,46 @@ Source implements the source.Source interface for the "postgres" source.
 */
 type Source struct {
 	options *source.Options
+	env     *Options
+	tracker *sources.Tracker
+}
+
+/*
+Options is the options a user can pass to configure the source.
+*/
+type Options struct {
+
+	// Connection is the connection string to the application's database the
+	// changes are captured from.
+	Connection string
+
+	// Listen enables the "listen" trigger, capturing the changes of tables using
+	// LISTEN / NOTIFY.
+	Listen *Listen
+
+	// Replication enables the "replication" trigger, capturing the changes of
+	// tables using a logical replication slot.
+	Replication *Replication
+
+	// Schema enables the "schema_changed" trigger, detecting the changes of the
+	// columns of tables.
+	Schema *Schema
+
+	// Canary enables the "canary" trigger, sending synthetic events through the
+	// whole pipeline to check it is not stuck.
+	Canary *Canary
+
+	// Replay enables the "replay" trigger, replaying the flows kept while disabled
+	// by the toggles once enabled again.
+	Replay *Replay
+
+	// Syncs is the list of incremental syncs of tables. Each sync is registered as
+	// a trigger in CDC mode named "sync-<name>".
+	Syncs []*Sync
+
+	// Middlewares is the chain of middlewares every events go through once
+	// extracted, before their flows are run.
+	Middlewares sources.Chain
 }
 
 /*
@@ -18,13 +60,19 @@ For the purpose of the demo, we set the interval to every 30 minutes. Which mean
 if not overridden, every trigger in CRON mode of this source will run every 30
 minutes.
 */
-func New() source.Source {
+func New(options *Options) source.Source {
+	if options == nil {
+		options = &Options{}
+	}
+
 	return &Source{
 		options: &source.Options{
 			DefaultSchedule: &source.Schedule{
 				Interval: "@every 30m",
 			},
 		},
+		env:     options,
+		tracker: &sources.Tracker{},
 	}
 }
 
@@ -44,11 +92,64 @@ func (postgres *Source) Options() *source.Options {
 }
 
 /*
-Triggers return a list of triggers the source is able to handle.
+Triggers return a list of triggers the source is able to handle. Every triggers
+are wrapped with the middlewares of the source.
 */
 func (postgres *Source) Triggers() map[string]source.Trigger {
-	return map[string]source.Trigger{
-		"dummy-cron":    TriggerDummyCRON{},
-		"dummy-forever": TriggerDummyCDC{},
+	chain := postgres.env.Middlewares
+	triggers := map[string]source.Trigger{}
+	for _, sync := range postgres.env.Syncs {
+		if sync.Name == "" {
+			sync.Name = sync.Table
+		}
+
+		t := TriggerSync{
+			env:   postgres.env,
+			sync:  sync,
+			state: postgres.tracker,
+		}
+
+		triggers[t.String()] = chain.Wrap(postgres.String(), t)
+	}
+
+	if postgres.env.Listen != nil {
+		triggers["listen"] = chain.Wrap(postgres.String(), TriggerListen{
+			env: postgres.env,
+		})
+	}
+
+	if postgres.env.Replication != nil {
+		triggers["replication"] = chain.Wrap(postgres.String(), TriggerReplication{
+			env:   postgres.env,
+			state: postgres.tracker,
+		})
+
+		if postgres.env.Replication.Snapshot != nil {
+			triggers["snapshot"] = chain.Wrap(postgres.String(), TriggerSnapshot{
+				env:   postgres.env,
+				state: postgres.tracker,
+			})
+		}
 	}
+
+	if postgres.env.Canary != nil {
+		triggers["canary"] = chain.Wrap(postgres.String(), TriggerCanary{
+			env: postgres.env,
+		})
+	}
+
+	if postgres.env.Replay != nil {
+		triggers["replay"] = chain.Wrap(postgres.String(), TriggerReplay{
+			env: postgres.env,
+		})
+	}
+
+	if postgres.env.Schema != nil {
+		triggers["schema_changed"] = chain.Wrap(postgres.String(), TriggerSchema{
+			env:   postgres.env,
+			state: postgres.tracker,
+		})
+	}
+
+	return triggers
 }
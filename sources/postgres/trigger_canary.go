@@ -0,0 +1,327 @@
+package postgres
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/flows"
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Canary is the options of the "canary" trigger.
+*/
+type Canary struct {
+
+	// Schedule is the schedule at which a canary is sent.
+	//
+	// Default: "@every 1m"
+	Schedule *source.Schedule
+
+	// Timeout is the maximum time for the jobs of a canary to succeed. Once
+	// elapsed, the pipeline is considered as stuck and an alert is raised.
+	//
+	// Default: 5 minutes
+	Timeout time.Duration
+
+	// Email is the email address notified when the pipeline is stuck.
+	Email string
+}
+
+/*
+TriggerCanary is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It sends a synthetic register event through the whole pipeline at every run. The
+event is tagged with the "canary" key of its context so destinations mark its
+jobs as succeeded without loading them. Each run then checks the jobs of the
+previous canaries in the store, and records the end-to-end latency of the ones
+whose jobs have all succeeded in the "smithy.canaries" table.
+
+When the jobs of a canary have not succeeded in time, an alert is sent instead of
+a new canary, running the "OnAlert" flow.
+*/
+type TriggerCanary struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Probe `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env *Options
+}
+
+/*
+Probe is the data payload specific to this trigger. Stuck is only set for the
+alerts, and contains the canaries whose jobs have not succeeded in time.
+*/
+type Probe struct {
+	ID    string   `json:"id"`
+	Stuck []*Stuck `json:"stuck,omitempty"`
+}
+
+/*
+Stuck is a canary whose jobs have not succeeded in time, along with the reason.
+*/
+type Stuck struct {
+	ID     string    `json:"id"`
+	SentAt time.Time `json:"sent_at"`
+	Reason string    `json:"reason"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerCanary) String() string {
+	return "canary"
+}
+
+/*
+Mode allows to register the trigger as a CRON task, using the schedule of the
+canary if any.
+*/
+func (t TriggerCanary) Mode() *source.Mode {
+	schedule := t.env.Canary.Schedule
+	if schedule == nil {
+		schedule = &source.Schedule{
+			Interval: "@every 1m",
+		}
+	}
+
+	return &source.Mode{
+		Mode:      source.ModeCRON,
+		UsingCRON: schedule,
+	}
+}
+
+/*
+Extract is the function being run by the gateway everytime the schedule is met.
+It checks the previous canaries, and returns an alert if some are stuck or a new
+canary otherwise.
+*/
+func (t TriggerCanary) Extract(tk *source.Toolkit) (*source.Payload, error) {
+	stuck, err := t.check(tk)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stuck) > 0 {
+		return t.alert(tk, stuck)
+	}
+
+	return t.probe()
+}
+
+/*
+check records the latency of the canaries whose jobs have all succeeded, and
+returns the ones which are stuck. A canary is only reported as stuck once.
+*/
+func (t TriggerCanary) check(tk *source.Toolkit) ([]*Stuck, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := t.env.Canary.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+
+	rows, err := db.Query(`
+		SELECT id, sent_at, alerted_at IS NOT NULL FROM smithy.canaries
+		WHERE succeeded_at IS NULL AND sent_at > NOW() - INTERVAL '1 day'
+		ORDER BY sent_at;
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	type pending struct {
+		id      string
+		sentAt  time.Time
+		alerted bool
+	}
+
+	canaries := []pending{}
+	for rows.Next() {
+		var p pending
+		err = rows.Scan(&p.id, &p.sentAt, &p.alerted)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		canaries = append(canaries, p)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stuck := []*Stuck{}
+	for _, canary := range canaries {
+		eventID, err := sources.Stored("postgres", t.String(), "id", canary.id)
+		if err != nil {
+			return nil, err
+		}
+
+		reason := "Event has not been stored"
+		if eventID != "" {
+			var jobs, succeeded int
+			var at pq.NullTime
+			err = db.QueryRow(`
+				SELECT COUNT(DISTINCT j.id), COUNT(DISTINCT t.job_id), MAX(t.created_at)
+				FROM blacksmith_store.jobs AS j
+				LEFT JOIN blacksmith_store.transitions AS t
+					ON t.job_id = j.id AND t.state_after = 'succeeded'
+				WHERE j.event_id = $1;
+			`, eventID).Scan(&jobs, &succeeded, &at)
+			if err != nil {
+				return nil, err
+			}
+
+			if jobs > 0 && succeeded == jobs {
+				latency := at.Time.Sub(canary.sentAt)
+				_, err = db.Exec(`
+					UPDATE smithy.canaries
+					SET event_id = $2, succeeded_at = $3, latency_ms = $4
+					WHERE id = $1;
+				`, canary.id, eventID, at.Time, latency.Milliseconds())
+				if err != nil {
+					return nil, err
+				}
+
+				tk.Logger.Info("postgres/canary: Canary " + canary.id + " succeeded in " + latency.String())
+				continue
+			}
+
+			reason = strconv.Itoa(succeeded) + " of " + strconv.Itoa(jobs) + " jobs have succeeded"
+		}
+
+		if canary.alerted || time.Since(canary.sentAt) < timeout {
+			continue
+		}
+
+		_, err = db.Exec(`UPDATE smithy.canaries SET event_id = NULLIF($2, ''), alerted_at = NOW() WHERE id = $1;`, canary.id, eventID)
+		if err != nil {
+			return nil, err
+		}
+
+		stuck = append(stuck, &Stuck{
+			ID:     canary.id,
+			SentAt: canary.sentAt,
+			Reason: reason,
+		})
+	}
+
+	return stuck, nil
+}
+
+/*
+probe saves a new canary and returns its synthetic register event.
+*/
+func (t TriggerCanary) probe() (*source.Payload, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	probe := &Probe{
+		ID: strconv.FormatInt(now.UnixNano(), 10),
+	}
+
+	_, err = db.Exec(`INSERT INTO smithy.canaries (id, sent_at) VALUES ($1, $2);`, probe.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sources.Context{
+		Canary: probe.ID,
+	}
+
+	ctx, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(probe)
+	if err != nil {
+		return nil, err
+	}
+
+	return &source.Payload{
+		Context: ctx,
+		Data:    data,
+		Flows: []flow.Flow{
+			&flows.OnRegister{
+				Context:   c,
+				SentAt:    &now,
+				Username:  "canary",
+				FullName:  "Canary SMITHY",
+				FirstName: "Canary",
+				LastName:  "SMITHY",
+				Email:     "canary+" + probe.ID + "@smithy.invalid",
+			},
+		},
+		SentAt: &now,
+	}, nil
+}
+
+/*
+alert returns the event alerting about the stuck canaries. The "OnAlert" flow is
+only run if an email address is set.
+*/
+func (t TriggerCanary) alert(tk *source.Toolkit, stuck []*Stuck) (*source.Payload, error) {
+	now := time.Now().UTC()
+	probe := &Probe{
+		ID:    strconv.FormatInt(now.UnixNano(), 10),
+		Stuck: stuck,
+	}
+
+	reasons := []string{}
+	for _, s := range stuck {
+		reasons = append(reasons, "canary "+s.ID+" sent at "+s.SentAt.Format(time.RFC3339)+": "+s.Reason)
+	}
+
+	message := "Pipeline is stuck: " + strings.Join(reasons, "; ")
+	tk.Logger.Error("postgres/canary: " + message)
+
+	ctx, err := json.Marshal(&sources.Context{})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(probe)
+	if err != nil {
+		return nil, err
+	}
+
+	var toRun []flow.Flow
+	if t.env.Canary.Email != "" {
+		toRun = append(toRun, &flows.OnAlert{
+			Email:   t.env.Canary.Email,
+			Message: message,
+		})
+	}
+
+	return &source.Payload{
+		Context: ctx,
+		Data:    data,
+		Flows:   toRun,
+		SentAt:  &now,
+	}, nil
+}
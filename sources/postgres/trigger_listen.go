@@ -0,0 +1,336 @@
+package postgres
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Listen is the options of the "listen" trigger.
+*/
+type Listen struct {
+
+	// Channels is the list of channels to LISTEN on.
+	//
+	// Default: []string{"smithy_changes"}
+	Channels []string
+
+	// Tables is the list of tables to capture the changes from, such as
+	// "public.users". A trigger is installed on each table to notify the changes
+	// of its rows on the first channel.
+	Tables []string
+
+	// MinReconnectInterval is the time to wait before reconnecting when the
+	// connection to the database is lost. It is doubled after each failed attempt.
+	//
+	// Default: 1 second
+	MinReconnectInterval time.Duration
+
+	// MaxReconnectInterval is the maximum time to wait between two attempts to
+	// reconnect.
+	//
+	// Default: 1 minute
+	MaxReconnectInterval time.Duration
+}
+
+/*
+TriggerListen is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It captures the changes of the application's tables using LISTEN / NOTIFY. Since
+notifications are not persisted by PostgreSQL, changes happening while the gateway
+is down are lost.
+*/
+type TriggerListen struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Change `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env *Options
+}
+
+/*
+Change is the data payload specific to this trigger. It is a change of a row in
+a table. Old is nil for inserts, and New is nil for deletes.
+
+Since notifications are limited to 8000 bytes, the rows are not included if they
+are too large. In this case Truncated is true, and the row can be read again
+given its Key, which contains the columns of its primary key. Key is set for the
+tables having a primary key.
+
+Changes captured by the "replication" trigger also have the LSN of the commit of
+their transaction, and their position within the transaction starting at 1.
+*/
+type Change struct {
+	Schema    string          `json:"schema"`
+	Table     string          `json:"table"`
+	Operation string          `json:"operation"`
+	Old       json.RawMessage `json:"old,omitempty"`
+	New       json.RawMessage `json:"new,omitempty"`
+	Key       json.RawMessage `json:"key,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+	LSN       string          `json:"lsn,omitempty"`
+	Sequence  int             `json:"sequence,omitempty"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerListen) String() string {
+	return "listen"
+}
+
+/*
+Mode allows to register the trigger as an ongoing notification listener. No
+additional details are needed for this mode.
+*/
+func (t TriggerListen) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It opens a dedicated connection
+to the database and LISTENs on the channels. The connection is re-established
+with an exponential backoff when lost.
+
+Every notification is sent as a payload to the gateway. The function returns once
+the gateway is shutting down.
+*/
+func (t TriggerListen) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	options := t.env.Listen
+	channels := options.Channels
+	if len(channels) == 0 {
+		channels = []string{"smithy_changes"}
+	}
+
+	minReconnect := options.MinReconnectInterval
+	if minReconnect == 0 {
+		minReconnect = time.Second
+	}
+
+	maxReconnect := options.MaxReconnectInterval
+	if maxReconnect == 0 {
+		maxReconnect = time.Minute
+	}
+
+	// Install the triggers on the tables. Retry with the same backoff as the
+	// listener until it succeeds or the gateway is shutting down.
+	for wait := minReconnect; ; wait *= 2 {
+		err := install(t.env.Connection, channels[0], options.Tables)
+		if err == nil {
+			break
+		}
+
+		notifier.Error <- err
+		if wait > maxReconnect {
+			wait = maxReconnect
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-notifier.IsShuttingDown:
+			notifier.Done <- true
+			return
+		}
+	}
+
+	listener := pq.NewListener(t.env.Connection, minReconnect, maxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			tk.Logger.Warn("postgres/listen: Connection lost: ", err)
+		case pq.ListenerEventReconnected:
+			tk.Logger.Warn("postgres/listen: Reconnected, changes may have been lost while disconnected")
+		}
+	})
+
+	for _, channel := range channels {
+		err := listener.Listen(channel)
+		if err != nil {
+			notifier.Error <- err
+		}
+	}
+
+	// Make sure the connection is still alive when no notification is received
+	// for a while. The timer is reset after every notification.
+	keepAlive := time.NewTimer(90 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case notification := <-listener.Notify:
+			if !keepAlive.Stop() {
+				<-keepAlive.C
+			}
+
+			keepAlive.Reset(90 * time.Second)
+
+			// A nil notification is received after reconnecting.
+			if notification == nil {
+				continue
+			}
+
+			p, err := t.payload(notification)
+			if err != nil {
+				notifier.Error <- err
+				continue
+			}
+
+			notifier.Payload <- p
+
+		case <-keepAlive.C:
+			keepAlive.Reset(90 * time.Second)
+			go listener.Ping()
+
+		case <-notifier.IsShuttingDown:
+			listener.Close()
+			notifier.Done <- true
+			return
+		}
+	}
+}
+
+/*
+payload returns the payload of a notification. The event is sent at the time of
+the transaction making the change, or when it is received if the notification
+comes from a trigger installed by a previous version.
+*/
+func (t TriggerListen) payload(notification *pq.Notification) (*source.Payload, error) {
+	var notified struct {
+		Change
+		At *time.Time `json:"at"`
+	}
+
+	err := json.Unmarshal([]byte(notification.Extra), &notified)
+	if err != nil {
+		return nil, err
+	}
+
+	change := notified.Change
+
+	ctx, err := json.Marshal(&sources.Context{})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&change)
+	if err != nil {
+		return nil, err
+	}
+
+	sentAt := time.Now().UTC()
+	if notified.At != nil {
+		sentAt = notified.At.UTC()
+	}
+
+	return &source.Payload{
+		Context: ctx,
+		Data:    data,
+		SentAt:  &sentAt,
+	}, nil
+}
+
+/*
+install installs the function notifying the changes and the triggers calling it
+on every tables. It runs in a transaction holding an advisory lock, so several
+gateway instances can install them at the same time.
+
+The first argument of the triggers is the channel to notify, and the next ones
+are the columns of the primary key of the table, so the key of the rows is always
+notified even when the rows are too large.
+*/
+func install(connection string, channel string, tables []string) error {
+	db, err := open(connection)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('smithy_notify_changes'));`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE SCHEMA IF NOT EXISTS smithy;
+
+		CREATE OR REPLACE FUNCTION smithy.notify_changes() RETURNS TRIGGER AS $$
+		DECLARE
+			change JSONB;
+			row_key JSONB;
+		BEGIN
+			change := jsonb_build_object(
+				'schema', TG_TABLE_SCHEMA,
+				'table', TG_TABLE_NAME,
+				'operation', TG_OP,
+				'old', CASE WHEN TG_OP IN ('UPDATE', 'DELETE') THEN to_jsonb(OLD) END,
+				'new', CASE WHEN TG_OP IN ('INSERT', 'UPDATE') THEN to_jsonb(NEW) END,
+				'at', transaction_timestamp()
+			);
+
+			IF TG_NARGS > 1 THEN
+				SELECT jsonb_object_agg(k, v) INTO row_key
+				FROM jsonb_each(CASE WHEN TG_OP = 'DELETE' THEN to_jsonb(OLD) ELSE to_jsonb(NEW) END) AS c(k, v)
+				WHERE k = ANY(TG_ARGV[1:TG_NARGS - 1]);
+
+				IF row_key IS NOT NULL THEN
+					change := change || jsonb_build_object('key', row_key);
+				END IF;
+			END IF;
+
+			IF octet_length(change::TEXT) > 7900 THEN
+				change := change - 'old' - 'new' || jsonb_build_object('truncated', TRUE);
+			END IF;
+
+			PERFORM pg_notify(TG_ARGV[0], change::TEXT);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		keys, err := keyColumns(tx, table)
+		if err != nil {
+			return err
+		}
+
+		args := []string{pq.QuoteLiteral(channel)}
+		for _, key := range keys {
+			args = append(args, pq.QuoteLiteral(key))
+		}
+
+		_, err = tx.Exec(`
+			DROP TRIGGER IF EXISTS smithy_notify_changes ON ` + quoteTable(table) + `;
+			CREATE TRIGGER smithy_notify_changes
+				AFTER INSERT OR UPDATE OR DELETE ON ` + quoteTable(table) + `
+				FOR EACH ROW EXECUTE PROCEDURE smithy.notify_changes(` + strings.Join(args, ", ") + `);
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,348 @@
+package postgres
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/flows"
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Replay is the options of the "replay" trigger.
+*/
+type Replay struct {
+
+	// Schedule is the schedule at which the kept flows are replayed.
+	//
+	// Default: "@every 1m"
+	Schedule *source.Schedule
+
+	// BatchSize is the maximum number of flows replayed per run.
+	//
+	// Default: 100
+	BatchSize int
+
+	// InFlight is the time after which flows whose replay event has not been
+	// persisted by the gateway are replayed again.
+	//
+	// Default: 10 minutes
+	InFlight time.Duration
+}
+
+/*
+TriggerReplay is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It replays the flows kept in the "smithy.kept_flows" table while they, or one of
+their destinations, were disabled by the toggles. Flows are replayed once enabled
+again, within a single event per run.
+
+Flows are marked as replayed only once the event has been persisted by the
+gateway, which is checked at the beginning of the next run. No other flows are
+replayed until then.
+*/
+type TriggerReplay struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Replayed `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env *Options
+}
+
+/*
+Replayed is the data payload specific to this trigger. Kept is the list of IDs of
+the flows replayed in the "smithy.kept_flows" table.
+*/
+type Replayed struct {
+	ID   string  `json:"id"`
+	Kept []int64 `json:"kept"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerReplay) String() string {
+	return "replay"
+}
+
+/*
+Mode allows to register the trigger as a CRON task, using the schedule of the
+replay if any.
+*/
+func (t TriggerReplay) Mode() *source.Mode {
+	schedule := t.env.Replay.Schedule
+	if schedule == nil {
+		schedule = &source.Schedule{
+			Interval: "@every 1m",
+		}
+	}
+
+	return &source.Mode{
+		Mode:      source.ModeCRON,
+		UsingCRON: schedule,
+	}
+}
+
+/*
+Extract is the function being run by the gateway everytime the schedule is met.
+It marks the flows of the previous replay as replayed if its event has been
+persisted, and returns the flows enabled again. No payload is returned if there
+is none, or if the previous replay is still being persisted.
+*/
+func (t TriggerReplay) Extract(tk *source.Toolkit) (*source.Payload, error) {
+	pending, err := t.confirm()
+	if err != nil || pending {
+		return nil, err
+	}
+
+	db, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	enabled, err := t.enabled()
+	if err != nil || len(enabled) == 0 {
+		return nil, err
+	}
+
+	batchSize := t.env.Replay.BatchSize
+	if batchSize == 0 {
+		batchSize = 100
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the flows so several gateway instances do not replay them at the same
+	// time.
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		SELECT id, flow, destination, data, context FROM smithy.kept_flows
+		WHERE replay_id IS NULL AND replayed_at IS NULL AND error IS NULL
+		AND flow || '/' || destination = ANY($1)
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED;
+	`, pq.Array(enabled), batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	type kept struct {
+		id          int64
+		flow        string
+		destination string
+		data        []byte
+		context     []byte
+	}
+
+	list := []kept{}
+	for rows.Next() {
+		var k kept
+		err = rows.Scan(&k.id, &k.flow, &k.destination, &k.data, &k.context)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		list = append(list, k)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	replayed := &Replayed{
+		ID:   strconv.FormatInt(now.UnixNano(), 10),
+		Kept: []int64{},
+	}
+
+	toRun := []flow.Flow{}
+	for _, k := range list {
+		var ctx *sources.Context
+		if len(k.context) > 0 {
+			err = json.Unmarshal(k.context, &ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Flows which can not be replayed are marked with the reason, so they are
+		// not selected again.
+		f, err := flows.Replay(k.flow, k.destination, ctx, k.data)
+		if err != nil {
+			tk.Logger.Error("postgres/replay: Flow " + strconv.FormatInt(k.id, 10) + ": " + err.Error())
+			_, err = tx.Exec(`UPDATE smithy.kept_flows SET error = $2 WHERE id = $1;`, k.id, err.Error())
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		replayed.Kept = append(replayed.Kept, k.id)
+		toRun = append(toRun, f)
+	}
+
+	if len(toRun) > 0 {
+		_, err = tx.Exec(`
+			UPDATE smithy.kept_flows SET replay_id = $1, replay_at = $2
+			WHERE id = ANY($3);
+		`, replayed.ID, now, pq.Array(replayed.Kept))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil || len(toRun) == 0 {
+		return nil, err
+	}
+
+	ctx, err := json.Marshal(&sources.Context{})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(replayed)
+	if err != nil {
+		return nil, err
+	}
+
+	tk.Logger.Info("postgres/replay: Replaying " + strconv.Itoa(len(toRun)) + " flows")
+	return &source.Payload{
+		Context: ctx,
+		Data:    data,
+		Flows:   toRun,
+		SentAt:  &now,
+	}, nil
+}
+
+/*
+confirm marks the flows of the previous replays as replayed if their event has
+been persisted. The flows of a replay not persisted in time are released so they
+are replayed again. It returns whether a replay is still being persisted.
+*/
+func (t TriggerReplay) confirm() (bool, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return false, err
+	}
+
+	inFlight := t.env.Replay.InFlight
+	if inFlight == 0 {
+		inFlight = 10 * time.Minute
+	}
+
+	rows, err := db.Query(`
+		SELECT replay_id, MIN(replay_at) FROM smithy.kept_flows
+		WHERE replay_id IS NOT NULL AND replayed_at IS NULL
+		GROUP BY replay_id;
+	`)
+	if err != nil {
+		return false, err
+	}
+
+	replays := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var at time.Time
+		err = rows.Scan(&id, &at)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+
+		replays[id] = at
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	pending := false
+	for id, at := range replays {
+		eventID, err := sources.Stored("postgres", t.String(), "id", id)
+		if err != nil {
+			return false, err
+		}
+
+		var query string
+		switch {
+		case eventID != "":
+			query = `UPDATE smithy.kept_flows SET replayed_at = NOW() WHERE replay_id = $1;`
+		case time.Since(at) > inFlight:
+			query = `UPDATE smithy.kept_flows SET replay_id = NULL, replay_at = NULL WHERE replay_id = $1;`
+		default:
+			pending = true
+			continue
+		}
+
+		_, err = db.Exec(query, id)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return pending, nil
+}
+
+/*
+enabled returns the flows and destinations having flows kept, written as
+"<flow>/<destination>", which are now enabled by the toggles.
+*/
+func (t TriggerReplay) enabled() ([]string, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT flow, destination FROM smithy.kept_flows
+		WHERE replay_id IS NULL AND replayed_at IS NULL AND error IS NULL;
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	enabled := []string{}
+	for rows.Next() {
+		var name, destination string
+		err = rows.Scan(&name, &destination)
+		if err != nil {
+			return nil, err
+		}
+
+		if !flows.Switches.Enabled(name, "") {
+			continue
+		}
+
+		if destination != "" && !flows.Switches.Enabled(name, destination) {
+			continue
+		}
+
+		enabled = append(enabled, name+"/"+destination)
+	}
+
+	return enabled, rows.Err()
+}
@@ -0,0 +1,714 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Replication is the options of the "replication" trigger.
+*/
+type Replication struct {
+
+	// Slot is the name of the logical replication slot. It is created if it does
+	// not exist.
+	//
+	// Default: "smithy"
+	Slot string
+
+	// Publication is the name of the publication the changes are read from. It is
+	// created if it does not exist.
+	//
+	// Default: "smithy"
+	Publication string
+
+	// Include is the list of tables to capture the changes from, such as
+	// "public.users". The publication is restricted to these tables. When empty,
+	// the publication is created for all tables.
+	Include []string
+
+	// Exclude is the list of tables to ignore the changes from.
+	Exclude []string
+
+	// Snapshot enables the "snapshot" trigger, exporting the rows of the tables
+	// before streaming their changes.
+	Snapshot *Snapshot
+
+	// ConfirmTimeout is the maximum time to wait for the gateway to persist the
+	// events of a transaction. Once elapsed, the replication restarts from the
+	// last checkpoint. Events already persisted are not sent again.
+	//
+	// Default: 1 minute
+	ConfirmTimeout time.Duration
+
+	// MinReconnectInterval is the time to wait before reconnecting when the
+	// replication stopped. It is doubled after each failed attempt.
+	//
+	// Default: 1 second
+	MinReconnectInterval time.Duration
+
+	// MaxReconnectInterval is the maximum time to wait between two attempts to
+	// reconnect.
+	//
+	// Default: 1 minute
+	MaxReconnectInterval time.Duration
+}
+
+/*
+TriggerReplication is the payload structure sent by an event and that will be
+received by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to
+ensure consistency across triggers.
+
+It captures the changes of the application's tables by reading the write-ahead
+log through a logical replication slot, using the "pgoutput" plugin. Unlike the
+"listen" trigger, no change is lost while the gateway is down: the slot retains
+them until they have been confirmed.
+
+The LSN of the last transaction confirmed is stored in the
+"smithy.replication_checkpoints" table. It is only advanced once every events of
+the transaction have been persisted by the gateway, so restarts resume without
+gaps nor duplicates.
+*/
+type TriggerReplication struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Change `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env   *Options
+	state *sources.Tracker
+}
+
+/*
+transaction is the transaction being replicated.
+*/
+type transaction struct {
+	lsn        pglogrepl.LSN
+	committed  time.Time
+	sequence   int
+	sent       int
+	persisted  map[int]bool
+	hasChanges bool
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerReplication) String() string {
+	return "replication"
+}
+
+/*
+Mode allows to register the trigger as an ongoing replication stream. No
+additional details are needed for this mode.
+*/
+func (t TriggerReplication) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It creates the publication and the
+replication slot if needed, and streams the changes from the last checkpoint. The
+replication is restarted with an exponential backoff when it stops.
+
+The function returns once the gateway is shutting down.
+*/
+func (t TriggerReplication) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	options := t.options()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-notifier.IsShuttingDown
+		cancel()
+	}()
+
+	wait := options.MinReconnectInterval
+	for {
+		progressed, err := t.replicate(ctx, tk, notifier, options)
+		if ctx.Err() != nil {
+			notifier.Done <- true
+			return
+		}
+
+		if progressed {
+			wait = options.MinReconnectInterval
+		}
+
+		notifier.Error <- err
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			notifier.Done <- true
+			return
+		}
+
+		wait *= 2
+		if wait > options.MaxReconnectInterval {
+			wait = options.MaxReconnectInterval
+		}
+	}
+}
+
+/*
+Dropped implements the sources.DropObserver interface. Changes dropped by a
+middleware are considered as confirmed, since they will never be persisted.
+*/
+func (t TriggerReplication) Dropped(p *source.Payload, dropped *sources.Dropped) {
+	var change Change
+	err := json.Unmarshal(p.Data, &change)
+	if err != nil {
+		return
+	}
+
+	t.state.Drop(change.LSN)
+}
+
+/*
+options returns the options of the trigger with the default values applied.
+*/
+func (t TriggerReplication) options() *Replication {
+	options := *t.env.Replication
+	if options.Slot == "" {
+		options.Slot = "smithy"
+	}
+
+	if options.Publication == "" {
+		options.Publication = "smithy"
+	}
+
+	if options.ConfirmTimeout == 0 {
+		options.ConfirmTimeout = time.Minute
+	}
+
+	if options.MinReconnectInterval == 0 {
+		options.MinReconnectInterval = time.Second
+	}
+
+	if options.MaxReconnectInterval == 0 {
+		options.MaxReconnectInterval = time.Minute
+	}
+
+	return &options
+}
+
+/*
+replicate runs the replication until it stops. It returns true if at least one
+transaction has been confirmed.
+*/
+func (t TriggerReplication) replicate(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier, options *Replication) (bool, error) {
+	err := setupReplication(ctx, t.env.Connection, options)
+	if err != nil {
+		return false, err
+	}
+
+	checkpoint, err := loadCheckpoint(options.Slot)
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := pgconn.Connect(ctx, replicationConnection(t.env.Connection))
+	if err != nil {
+		return false, err
+	}
+
+	defer conn.Close(context.Background())
+	err = pglogrepl.StartReplication(ctx, conn, options.Slot, checkpoint, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{
+			"proto_version '1'",
+			"publication_names " + pq.QuoteLiteral(options.Publication),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	tk.Logger.Info("postgres/replication: Replicating from LSN ", checkpoint)
+
+	var progressed bool
+	var tx *transaction
+	relations := map[uint32]*pglogrepl.RelationMessage{}
+	nextStatus := time.Time{}
+	for {
+		if time.Now().After(nextStatus) {
+			err = status(ctx, conn, checkpoint)
+			if err != nil {
+				return progressed, err
+			}
+
+			nextStatus = time.Now().Add(10 * time.Second)
+		}
+
+		receiveCtx, cancelReceive := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(receiveCtx)
+		cancelReceive()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+
+			return progressed, err
+		}
+
+		var data []byte
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			data = msg.Data
+		case *pgproto3.ErrorResponse:
+			return progressed, pgconn.ErrorResponseToPgError(msg)
+		default:
+			continue
+		}
+
+		switch data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+			if err != nil {
+				return progressed, err
+			}
+
+			if keepalive.ReplyRequested {
+				nextStatus = time.Time{}
+			}
+
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(data[1:])
+			if err != nil {
+				return progressed, err
+			}
+
+			logical, err := pglogrepl.Parse(xld.WALData)
+			if err != nil {
+				return progressed, err
+			}
+
+			switch m := logical.(type) {
+			case *pglogrepl.RelationMessage:
+				relations[m.RelationID] = m
+
+			case *pglogrepl.BeginMessage:
+				persisted, err := persistedChanges(m.FinalLSN)
+				if err != nil {
+					return progressed, err
+				}
+
+				// Changes dropped while replicating the transaction before a
+				// restart are sent again.
+				t.state.Forget(m.FinalLSN.String())
+
+				tx = &transaction{
+					lsn:       m.FinalLSN,
+					committed: m.CommitTime,
+					persisted: persisted,
+				}
+
+			case *pglogrepl.InsertMessage:
+				err = t.send(notifier, tx, relations[m.RelationID], "INSERT", nil, m.Tuple)
+
+			case *pglogrepl.UpdateMessage:
+				err = t.send(notifier, tx, relations[m.RelationID], "UPDATE", m.OldTuple, m.NewTuple)
+
+			case *pglogrepl.DeleteMessage:
+				err = t.send(notifier, tx, relations[m.RelationID], "DELETE", m.OldTuple, nil)
+
+			case *pglogrepl.TruncateMessage:
+				for _, id := range m.RelationIDs {
+					err = t.send(notifier, tx, relations[id], "TRUNCATE", nil, nil)
+					if err != nil {
+						break
+					}
+				}
+
+			case *pglogrepl.CommitMessage:
+				if tx != nil && tx.hasChanges {
+					err = t.confirm(ctx, conn, tx, checkpoint, options.ConfirmTimeout)
+					if err != nil {
+						return progressed, err
+					}
+
+					err = saveCheckpoint(options.Slot, m.TransactionEndLSN)
+					if err != nil {
+						return progressed, err
+					}
+				}
+
+				tx = nil
+				progressed = true
+				checkpoint = m.TransactionEndLSN
+				nextStatus = time.Time{}
+			}
+
+			if err != nil {
+				return progressed, err
+			}
+		}
+	}
+}
+
+/*
+send sends a change to the gateway, unless its table is not captured or it has
+already been persisted before a restart.
+*/
+func (t TriggerReplication) send(notifier *source.Notifier, tx *transaction, relation *pglogrepl.RelationMessage, operation string, old *pglogrepl.TupleData, new *pglogrepl.TupleData) error {
+	if tx == nil || relation == nil {
+		return &errors.Error{
+			StatusCode: 500,
+			Message:    "postgres/replication: Received a change outside of a transaction or for an unknown relation",
+		}
+	}
+
+	tx.sequence++
+	if !captured(t.env.Replication, relation.Namespace+"."+relation.RelationName) {
+		return nil
+	}
+
+	tx.hasChanges = true
+	if tx.persisted[tx.sequence] {
+		return nil
+	}
+
+	change := &Change{
+		Schema:    relation.Namespace,
+		Table:     relation.RelationName,
+		Operation: operation,
+		Old:       decodeTuple(relation, old),
+		New:       decodeTuple(relation, new),
+		LSN:       tx.lsn.String(),
+		Sequence:  tx.sequence,
+	}
+
+	ctx, err := json.Marshal(&sources.Context{})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	committed := tx.committed.UTC()
+	notifier.Payload <- &source.Payload{
+		Context: ctx,
+		Data:    data,
+		SentAt:  &committed,
+	}
+
+	tx.sent++
+	return nil
+}
+
+/*
+confirm waits for every changes of the transaction to be persisted by the gateway
+or dropped by a middleware. Status updates are still sent to the server while
+waiting so the connection is not closed.
+*/
+func (t TriggerReplication) confirm(ctx context.Context, conn *pgconn.PgConn, tx *transaction, checkpoint pglogrepl.LSN, timeout time.Duration) error {
+	expected := tx.sent + len(tx.persisted)
+	deadline := time.Now().Add(timeout)
+	nextStatus := time.Now().Add(10 * time.Second)
+	for {
+		persisted, err := persistedChanges(tx.lsn)
+		if err != nil {
+			return err
+		}
+
+		if len(persisted)+t.state.Dropped(tx.lsn.String()) >= expected {
+			t.state.Forget(tx.lsn.String())
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return &errors.Error{
+				StatusCode: 500,
+				Message:    "postgres/replication: Events of transaction " + tx.lsn.String() + " have not been persisted after " + timeout.String(),
+			}
+		}
+
+		if time.Now().After(nextStatus) {
+			err = status(ctx, conn, checkpoint)
+			if err != nil {
+				return err
+			}
+
+			nextStatus = time.Now().Add(10 * time.Second)
+		}
+
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+captured returns true if the changes of a table must be captured given the
+include and exclude lists.
+*/
+func captured(options *Replication, table string) bool {
+	for _, excluded := range options.Exclude {
+		if excluded == table {
+			return false
+		}
+	}
+
+	if len(options.Include) == 0 {
+		return true
+	}
+
+	for _, included := range options.Include {
+		if included == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+setupReplication creates the publication and the replication slot if they do not
+exist. The tables of an existing publication are updated given the include list.
+
+When a snapshot is configured, the slot is created by the "snapshot" trigger and
+the function waits for the snapshot to be completed.
+*/
+func setupReplication(ctx context.Context, connection string, options *Replication) error {
+	if options.Snapshot != nil {
+		err := setupPublication(connection, options)
+		if err != nil {
+			return err
+		}
+
+		return waitSnapshot(ctx, options.Slot)
+	}
+
+	err := setupPublication(connection, options)
+	if err != nil {
+		return err
+	}
+
+	db, err := open(connection)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1);`, options.Slot).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		_, err = db.Exec(`SELECT pg_create_logical_replication_slot($1, 'pgoutput');`, options.Slot)
+	}
+
+	return err
+}
+
+/*
+setupPublication creates the publication if it does not exist. The tables of an
+existing publication are updated given the include list.
+*/
+func setupPublication(connection string, options *Replication) error {
+	db, err := open(connection)
+	if err != nil {
+		return err
+	}
+
+	tables := "ALL TABLES"
+	if len(options.Include) > 0 {
+		quoted := []string{}
+		for _, table := range options.Include {
+			quoted = append(quoted, quoteTable(table))
+		}
+
+		tables = "TABLE " + strings.Join(quoted, ", ")
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1);`, options.Publication).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	publication := pq.QuoteIdentifier(options.Publication)
+	if !exists {
+		_, err = db.Exec(`CREATE PUBLICATION ` + publication + ` FOR ` + tables + `;`)
+	} else if len(options.Include) > 0 {
+		_, err = db.Exec(`ALTER PUBLICATION ` + publication + ` SET ` + tables + `;`)
+	}
+
+	return err
+}
+
+/*
+loadCheckpoint returns the LSN of the last transaction confirmed for a slot. It
+returns 0 if none has been confirmed yet, in which case the replication starts
+from the position of the slot.
+*/
+func loadCheckpoint(slot string) (pglogrepl.LSN, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return 0, err
+	}
+
+	var lsn string
+	err = db.QueryRow(`SELECT lsn FROM smithy.replication_checkpoints WHERE slot = $1;`, slot).Scan(&lsn)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if lsn == "" {
+		return 0, nil
+	}
+
+	return pglogrepl.ParseLSN(lsn)
+}
+
+/*
+saveCheckpoint saves the LSN of the last transaction confirmed for a slot.
+*/
+func saveCheckpoint(slot string, lsn pglogrepl.LSN) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO smithy.replication_checkpoints (slot, lsn, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (slot) DO UPDATE SET lsn = $2, updated_at = NOW();
+	`, slot, lsn.String())
+	return err
+}
+
+/*
+persistedChanges returns the position of the changes of a transaction already
+persisted by the gateway.
+*/
+func persistedChanges(lsn pglogrepl.LSN) (map[int]bool, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT (data->>'sequence')::INTEGER FROM blacksmith_store.events
+		WHERE source = 'postgres' AND trigger = 'replication' AND data->>'lsn' = $1;
+	`, lsn.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	persisted := map[int]bool{}
+	for rows.Next() {
+		var sequence int
+		err = rows.Scan(&sequence)
+		if err != nil {
+			return nil, err
+		}
+
+		persisted[sequence] = true
+	}
+
+	return persisted, rows.Err()
+}
+
+/*
+status sends the position of the last transaction confirmed to the server. The
+slot does not retain the write-ahead log before this position anymore.
+*/
+func status(ctx context.Context, conn *pgconn.PgConn, checkpoint pglogrepl.LSN) error {
+	return pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: checkpoint,
+	})
+}
+
+/*
+replicationConnection returns the connection string used to open a replication
+connection. It supports both URLs and key / value connection strings.
+*/
+func replicationConnection(connection string) string {
+	if !strings.Contains(connection, "://") {
+		return connection + " replication=database"
+	}
+
+	if strings.Contains(connection, "?") {
+		return connection + "&replication=database"
+	}
+
+	return connection + "?replication=database"
+}
+
+/*
+decodeTuple returns the JSON object of a row. Values are decoded given the type
+of their column so they match the ones of the "listen" trigger. Unchanged TOASTed
+values are not sent by the server and are therefore omitted.
+*/
+func decodeTuple(relation *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) json.RawMessage {
+	if tuple == nil {
+		return nil
+	}
+
+	row := map[string]json.RawMessage{}
+	for i, column := range tuple.Columns {
+		if i >= len(relation.Columns) {
+			break
+		}
+
+		name := relation.Columns[i].Name
+		switch column.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			row[name] = json.RawMessage("null")
+		case pglogrepl.TupleDataTypeText:
+			row[name] = decodeValue(relation.Columns[i].DataType, string(column.Data))
+		}
+	}
+
+	b, _ := json.Marshal(row)
+	return b
+}
+
+/*
+decodeValue returns the JSON value of a column given the OID of its type and its
+text representation. Types without a JSON equivalent are kept as strings.
+*/
+func decodeValue(oid uint32, text string) json.RawMessage {
+	switch oid {
+
+	// bool
+	case 16:
+		return json.RawMessage(strconv.FormatBool(text == "t"))
+
+	// int8, int2, int4, float4, float8, numeric, json, jsonb
+	case 20, 21, 23, 700, 701, 1700, 114, 3802:
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+	}
+
+	b, _ := json.Marshal(text)
+	return b
+}
@@ -0,0 +1,440 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Schema is the options of the "schema_changed" trigger.
+*/
+type Schema struct {
+
+	// Tables is the list of tables to watch, such as "public.users". When empty,
+	// every tables outside of the system schemas are watched.
+	Tables []string
+
+	// Interval is the interval at which the columns of the tables are compared to
+	// their last known definitions.
+	//
+	// Default: 1 minute
+	Interval time.Duration
+
+	// ConfirmTimeout is the maximum time to wait for the gateway to persist the
+	// event of a change. Once elapsed, the change is detected again at the next
+	// check.
+	//
+	// Default: 1 minute
+	ConfirmTimeout time.Duration
+}
+
+/*
+TriggerSchema is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It detects the changes of the columns of the watched tables by periodically
+diffing "information_schema.columns" against the last known definitions, saved
+in the "smithy.schema_columns" table. Each table changed is emitted as its own
+event. The known definition of a table is only updated once its event has been
+persisted by the gateway.
+
+Definitions are saved without emitting any event the first time the tables are
+watched.
+*/
+type TriggerSchema struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *SchemaChange `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env   *Options
+	state *sources.Tracker
+}
+
+/*
+SchemaChange is the data payload specific to this trigger. Before is empty when
+the table has been created, and After is empty when it has been dropped.
+*/
+type SchemaChange struct {
+	ID      string    `json:"id"`
+	Schema  string    `json:"schema"`
+	Table   string    `json:"table"`
+	Before  []*Column `json:"before"`
+	After   []*Column `json:"after"`
+	Added   []string  `json:"added,omitempty"`
+	Removed []string  `json:"removed,omitempty"`
+	Altered []string  `json:"altered,omitempty"`
+}
+
+/*
+Column is the definition of a column.
+*/
+type Column struct {
+	Name      string  `json:"name"`
+	Position  int     `json:"position"`
+	DataType  string  `json:"data_type"`
+	MaxLength *int    `json:"max_length,omitempty"`
+	Precision *int    `json:"precision,omitempty"`
+	Scale     *int    `json:"scale,omitempty"`
+	Nullable  bool    `json:"nullable"`
+	Default   *string `json:"default,omitempty"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerSchema) String() string {
+	return "schema_changed"
+}
+
+/*
+Mode allows to register the trigger as an ongoing task, so every change can be
+emitted as its own event. No additional details are needed for this mode.
+*/
+func (t TriggerSchema) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It checks the definitions of the
+tables at every interval. The function returns once the gateway is shutting down.
+*/
+func (t TriggerSchema) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	options := t.env.Schema
+	interval := options.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-notifier.IsShuttingDown
+		cancel()
+	}()
+
+	for {
+		err := t.check(ctx, notifier)
+		if err != nil && ctx.Err() == nil {
+			notifier.Error <- err
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			notifier.Done <- true
+			return
+		}
+	}
+}
+
+/*
+Dropped implements the sources.DropObserver interface. Changes dropped by a
+middleware are considered as persisted, so they are not detected again.
+*/
+func (t TriggerSchema) Dropped(p *source.Payload, dropped *sources.Dropped) {
+	var change SchemaChange
+	err := json.Unmarshal(p.Data, &change)
+	if err != nil {
+		return
+	}
+
+	t.state.Drop(change.ID)
+}
+
+/*
+check compares the current definitions of the tables with the known ones, and
+emits an event for every table changed.
+*/
+func (t TriggerSchema) check(ctx context.Context, notifier *source.Notifier) error {
+	current, err := t.columns()
+	if err != nil {
+		return err
+	}
+
+	known, err := knownColumns(t.watched())
+	if err != nil {
+		return err
+	}
+
+	// Save the definitions without emitting any event the first time.
+	if len(known) == 0 {
+		for table, columns := range current {
+			err = saveColumns(table, columns)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	timeout := t.env.Schema.ConfirmTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	tables := map[string]bool{}
+	for table := range current {
+		tables[table] = true
+	}
+
+	for table := range known {
+		tables[table] = true
+	}
+
+	for table := range tables {
+		change := diff(table, known[table], current[table])
+		if change == nil {
+			continue
+		}
+
+		err = t.send(ctx, notifier, change, timeout)
+		if err != nil {
+			return err
+		}
+
+		err = saveColumns(table, current[table])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+send sends a change to the gateway and waits for it to be persisted or dropped
+by a middleware.
+*/
+func (t TriggerSchema) send(ctx context.Context, notifier *source.Notifier, change *SchemaChange, timeout time.Duration) error {
+	marshaled, err := json.Marshal(&sources.Context{})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	notifier.Payload <- &source.Payload{
+		Context: marshaled,
+		Data:    data,
+		SentAt:  &now,
+	}
+
+	return t.state.Wait(ctx, "postgres", t.String(), change.ID, timeout)
+}
+
+/*
+columns returns the current definitions of the columns of the watched tables,
+given their name prefixed by their schema.
+*/
+func (t TriggerSchema) columns() (map[string][]*Column, error) {
+	db, err := open(t.env.Connection)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT table_schema || '.' || table_name, column_name, ordinal_position, data_type,
+			character_maximum_length, numeric_precision, numeric_scale, is_nullable = 'YES', column_default
+		FROM information_schema.columns
+		WHERE table_schema NOT IN ('pg_catalog', 'information_schema', 'smithy', 'blacksmith_store')
+			AND (CARDINALITY($1::TEXT[]) = 0 OR table_schema || '.' || table_name = ANY($1::TEXT[]))
+		ORDER BY table_schema, table_name, ordinal_position;
+	`, pq.Array(t.watched()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	columns := map[string][]*Column{}
+	for rows.Next() {
+		var table string
+		var maxLength, precision, scale sql.NullInt64
+		var def sql.NullString
+		column := &Column{}
+		err = rows.Scan(&table, &column.Name, &column.Position, &column.DataType, &maxLength, &precision, &scale, &column.Nullable, &def)
+		if err != nil {
+			return nil, err
+		}
+
+		column.MaxLength = nullInt(maxLength)
+		column.Precision = nullInt(precision)
+		column.Scale = nullInt(scale)
+		if def.Valid {
+			column.Default = &def.String
+		}
+
+		columns[table] = append(columns[table], column)
+	}
+
+	return columns, rows.Err()
+}
+
+/*
+watched returns the tables to watch, or an empty list if every tables are.
+*/
+func (t TriggerSchema) watched() []string {
+	if t.env.Schema.Tables == nil {
+		return []string{}
+	}
+
+	return t.env.Schema.Tables
+}
+
+/*
+knownColumns returns the last known definitions of the columns of the watched
+tables. Definitions of tables no longer watched are ignored, so they are not
+considered as dropped.
+*/
+func knownColumns(watched []string) (map[string][]*Column, error) {
+	store, err := sources.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.Query(`
+		SELECT table_name, columns FROM smithy.schema_columns
+		WHERE CARDINALITY($1::TEXT[]) = 0 OR table_name = ANY($1::TEXT[]);
+	`, pq.Array(watched))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	known := map[string][]*Column{}
+	for rows.Next() {
+		var table string
+		var b []byte
+		err = rows.Scan(&table, &b)
+		if err != nil {
+			return nil, err
+		}
+
+		var columns []*Column
+		err = json.Unmarshal(b, &columns)
+		if err != nil {
+			return nil, err
+		}
+
+		known[table] = columns
+	}
+
+	return known, rows.Err()
+}
+
+/*
+saveColumns saves the definitions of the columns of a table. The table is removed
+if it has no columns, meaning it has been dropped.
+*/
+func saveColumns(table string, columns []*Column) error {
+	store, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	if len(columns) == 0 {
+		_, err = store.Exec(`DELETE FROM smithy.schema_columns WHERE table_name = $1;`, table)
+		return err
+	}
+
+	b, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Exec(`
+		INSERT INTO smithy.schema_columns (table_name, columns, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (table_name) DO UPDATE SET columns = $2, updated_at = NOW();
+	`, table, b)
+	return err
+}
+
+/*
+diff returns the change between two definitions of a table, or nil if they are
+the same. The position of a column is not considered as a change.
+*/
+func diff(table string, before []*Column, after []*Column) *SchemaChange {
+	previous := map[string]*Column{}
+	for _, column := range before {
+		previous[column.Name] = column
+	}
+
+	change := &SchemaChange{
+		ID:     strconv.FormatInt(time.Now().UnixNano(), 10),
+		Before: before,
+		After:  after,
+	}
+
+	change.Schema, change.Table = splitTable(table)
+	for _, column := range after {
+		old, exists := previous[column.Name]
+		delete(previous, column.Name)
+		if !exists {
+			change.Added = append(change.Added, column.Name)
+			continue
+		}
+
+		position := old.Position
+		old.Position = column.Position
+		if !reflect.DeepEqual(old, column) {
+			change.Altered = append(change.Altered, column.Name)
+		}
+
+		old.Position = position
+	}
+
+	for _, column := range before {
+		if _, removed := previous[column.Name]; removed {
+			change.Removed = append(change.Removed, column.Name)
+		}
+	}
+
+	if len(change.Added)+len(change.Removed)+len(change.Altered) == 0 {
+		return nil
+	}
+
+	if change.Before == nil {
+		change.Before = []*Column{}
+	}
+
+	if change.After == nil {
+		change.After = []*Column{}
+	}
+
+	return change
+}
+
+/*
+nullInt returns a pointer to the value of a nullable integer.
+*/
+func nullInt(i sql.NullInt64) *int {
+	if !i.Valid {
+		return nil
+	}
+
+	value := int(i.Int64)
+	return &value
+}
@@ -0,0 +1,563 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pglogrepl"
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Snapshot is the options of the "snapshot" trigger.
+*/
+type Snapshot struct {
+
+	// ChunkSize is the maximum number of rows exported per event.
+	//
+	// Default: 1000
+	ChunkSize int
+}
+
+/*
+TriggerSnapshot is the payload structure sent by an event and that will be
+received by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to
+ensure consistency across triggers.
+
+It exports the rows of the tables of the publication before their changes are
+streamed by the "replication" trigger. The replication slot is created with an
+exported snapshot, and the tables are read in chunks under this snapshot, ordered
+by their primary key. Once every chunks have been persisted by the gateway, the
+"replication" trigger starts from the exact LSN of the snapshot.
+
+The progress of each table is saved in the "smithy.snapshot_progress" table once
+a chunk has been persisted. Since an exported snapshot does not survive the
+connection which created it, the remaining chunks are read under a new snapshot
+after a crash. The changes made since the LSN of the original snapshot are still
+streamed afterwards, so every row ends up in its latest state.
+*/
+type TriggerSnapshot struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Chunk `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env   *Options
+	state *sources.Tracker
+}
+
+/*
+Chunk is the data payload specific to this trigger. It contains the rows of a
+table following the primary key of the previous chunk, up to Last.
+*/
+type Chunk struct {
+	ID     string            `json:"id"`
+	Schema string            `json:"schema"`
+	Table  string            `json:"table"`
+	LSN    string            `json:"lsn"`
+	Rows   []json.RawMessage `json:"rows"`
+	Last   []string          `json:"last"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerSnapshot) String() string {
+	return "snapshot"
+}
+
+/*
+Mode allows to register the trigger as an ongoing task, so it can hold the
+replication connection exporting the snapshot. No additional details are needed
+for this mode.
+*/
+func (t TriggerSnapshot) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It takes the snapshot if it has not
+been completed yet, and is restarted with an exponential backoff on failure. The
+function returns once the gateway is shutting down.
+*/
+func (t TriggerSnapshot) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	options := TriggerReplication{env: t.env}.options()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-notifier.IsShuttingDown
+		cancel()
+	}()
+
+	wait := options.MinReconnectInterval
+	for {
+		err := t.snapshot(ctx, tk, notifier, options)
+		if err == nil || ctx.Err() != nil {
+			<-ctx.Done()
+			notifier.Done <- true
+			return
+		}
+
+		notifier.Error <- err
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			notifier.Done <- true
+			return
+		}
+
+		wait *= 2
+		if wait > options.MaxReconnectInterval {
+			wait = options.MaxReconnectInterval
+		}
+	}
+}
+
+/*
+Dropped implements the sources.DropObserver interface. Chunks dropped by a
+middleware are considered as persisted, since they will never be.
+*/
+func (t TriggerSnapshot) Dropped(p *source.Payload, dropped *sources.Dropped) {
+	var chunk Chunk
+	err := json.Unmarshal(p.Data, &chunk)
+	if err != nil {
+		return
+	}
+
+	t.state.Drop(chunk.ID)
+}
+
+/*
+snapshot takes the snapshot, or resumes it after a crash. It returns nil once the
+snapshot is completed.
+*/
+func (t TriggerSnapshot) snapshot(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier, options *Replication) error {
+	store, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	var lsn string
+	var completed pq.NullTime
+	started := true
+	err = store.QueryRow(`
+		SELECT lsn, completed_at FROM smithy.snapshots WHERE slot = $1;
+	`, options.Slot).Scan(&lsn, &completed)
+	if err == sql.ErrNoRows {
+		started = false
+	} else if err != nil {
+		return err
+	}
+
+	if completed.Valid {
+		return nil
+	}
+
+	err = setupPublication(t.env.Connection, options)
+	if err != nil {
+		return err
+	}
+
+	db, err := open(t.env.Connection)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1);`, options.Slot).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	// The slot already exists but no snapshot has been started: its changes are
+	// already being streamed so there is nothing to export.
+	if exists && !started {
+		tk.Logger.Info("postgres/snapshot: Slot " + options.Slot + " already exists, skipping the snapshot")
+		return completeSnapshot(options.Slot, "", 0)
+	}
+
+	var name string
+	switch {
+
+	// Create the slot with an exported snapshot. The replication connection must
+	// stay open, and idle, for the snapshot to remain valid. The snapshot is saved
+	// as started beforehand so a crash right after the slot is created does not
+	// skip it.
+	case !exists:
+		_, err = store.Exec(`
+			INSERT INTO smithy.snapshots (slot, lsn) VALUES ($1, '')
+			ON CONFLICT (slot) DO UPDATE SET lsn = '', started_at = NOW(), completed_at = NULL;
+		`, options.Slot)
+		if err != nil {
+			return err
+		}
+
+		_, err = store.Exec(`DELETE FROM smithy.snapshot_progress WHERE slot = $1;`, options.Slot)
+		if err != nil {
+			return err
+		}
+
+		conn, err := pgconn.Connect(ctx, replicationConnection(t.env.Connection))
+		if err != nil {
+			return err
+		}
+
+		defer conn.Close(context.Background())
+		slot, err := pglogrepl.CreateReplicationSlot(ctx, conn, options.Slot, "pgoutput", pglogrepl.CreateReplicationSlotOptions{
+			Mode:           pglogrepl.LogicalReplication,
+			SnapshotAction: "EXPORT_SNAPSHOT",
+		})
+		if err != nil {
+			return err
+		}
+
+		name, lsn = slot.SnapshotName, slot.ConsistentPoint
+		tk.Logger.Info("postgres/snapshot: Exporting snapshot " + name + " at LSN " + lsn)
+
+	// The slot has been created but its LSN has not been saved. Nothing has been
+	// confirmed on the slot yet, so its position is the one of the snapshot.
+	case lsn == "":
+		err = db.QueryRow(`
+			SELECT confirmed_flush_lsn::TEXT FROM pg_replication_slots WHERE slot_name = $1;
+		`, options.Slot).Scan(&lsn)
+		if err != nil {
+			return err
+		}
+
+		tk.Logger.Warn("postgres/snapshot: Resuming snapshot at LSN " + lsn + " under a new snapshot")
+
+	default:
+		tk.Logger.Warn("postgres/snapshot: Resuming snapshot at LSN " + lsn + " under a new snapshot")
+	}
+
+	_, err = store.Exec(`UPDATE smithy.snapshots SET lsn = $2 WHERE slot = $1;`, options.Slot, lsn)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+	if name != "" {
+		_, err = tx.Exec(`SET TRANSACTION SNAPSHOT ` + pq.QuoteLiteral(name) + `;`)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT schemaname, tablename FROM pg_publication_tables
+		WHERE pubname = $1
+		ORDER BY schemaname, tablename;
+	`, options.Publication)
+	if err != nil {
+		return err
+	}
+
+	tables := [][2]string{}
+	for rows.Next() {
+		var table [2]string
+		err = rows.Scan(&table[0], &table[1])
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if captured(options, table[0]+"."+table[1]) {
+			tables = append(tables, table)
+		}
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, table := range tables {
+		exported, err := t.export(ctx, tx, notifier, options, lsn, table[0], table[1])
+		if err != nil {
+			return err
+		}
+
+		total += exported
+	}
+
+	return completeSnapshot(options.Slot, lsn, total)
+}
+
+/*
+export exports the rows of a table in chunks, starting after the last chunk
+persisted. It returns the number of rows exported.
+*/
+func (t TriggerSnapshot) export(ctx context.Context, tx *sql.Tx, notifier *source.Notifier, options *Replication, lsn string, schema string, table string) (int64, error) {
+	store, err := sources.DB()
+	if err != nil {
+		return 0, err
+	}
+
+	name := schema + "." + table
+	_, err = store.Exec(`
+		INSERT INTO smithy.snapshot_progress (slot, table_name) VALUES ($1, $2)
+		ON CONFLICT (slot, table_name) DO NOTHING;
+	`, options.Slot, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var last []string
+	var exported int64
+	var completed pq.NullTime
+	err = store.QueryRow(`
+		SELECT last_key, exported, completed_at FROM smithy.snapshot_progress
+		WHERE slot = $1 AND table_name = $2;
+	`, options.Slot, name).Scan(pq.Array(&last), &exported, &completed)
+	if err != nil {
+		return 0, err
+	}
+
+	if completed.Valid {
+		return exported, nil
+	}
+
+	keys, err := primaryKey(tx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	chunkSize := options.Snapshot.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = 1000
+	}
+
+	quoted := []string{}
+	texts := []string{}
+	params := []string{}
+	for i, key := range keys {
+		quoted = append(quoted, "t."+pq.QuoteIdentifier(key))
+		texts = append(texts, "t."+pq.QuoteIdentifier(key)+"::TEXT")
+		params = append(params, "$"+strconv.Itoa(i+1))
+	}
+
+	for {
+		query := `SELECT to_jsonb(t), ARRAY[` + strings.Join(texts, ", ") + `] FROM ` + quoteTable(name) + ` AS t`
+		args := []interface{}{}
+		if len(last) == len(keys) {
+			query += ` WHERE (` + strings.Join(quoted, ", ") + `) > (` + strings.Join(params, ", ") + `)`
+			for _, value := range last {
+				args = append(args, value)
+			}
+		}
+
+		query += ` ORDER BY ` + strings.Join(quoted, ", ") + ` LIMIT ` + strconv.Itoa(chunkSize) + `;`
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return exported, err
+		}
+
+		chunk := &Chunk{
+			ID:     strconv.FormatInt(time.Now().UnixNano(), 10),
+			Schema: schema,
+			Table:  table,
+			LSN:    lsn,
+			Rows:   []json.RawMessage{},
+		}
+
+		for rows.Next() {
+			var row []byte
+			err = rows.Scan(&row, pq.Array(&chunk.Last))
+			if err != nil {
+				rows.Close()
+				return exported, err
+			}
+
+			chunk.Rows = append(chunk.Rows, row)
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return exported, err
+		}
+
+		if len(chunk.Rows) == 0 {
+			_, err = store.Exec(`
+				UPDATE smithy.snapshot_progress SET completed_at = NOW()
+				WHERE slot = $1 AND table_name = $2;
+			`, options.Slot, name)
+			return exported, err
+		}
+
+		err = t.send(ctx, notifier, chunk, options.ConfirmTimeout)
+		if err != nil {
+			return exported, err
+		}
+
+		last = chunk.Last
+		exported += int64(len(chunk.Rows))
+		_, err = store.Exec(`
+			UPDATE smithy.snapshot_progress SET last_key = $3, exported = $4, updated_at = NOW()
+			WHERE slot = $1 AND table_name = $2;
+		`, options.Slot, name, pq.Array(last), exported)
+		if err != nil {
+			return exported, err
+		}
+	}
+}
+
+/*
+send sends a chunk to the gateway and waits for it to be persisted or dropped by
+a middleware.
+*/
+func (t TriggerSnapshot) send(ctx context.Context, notifier *source.Notifier, chunk *Chunk, timeout time.Duration) error {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+
+	marshaled, err := json.Marshal(&sources.Context{})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	notifier.Payload <- &source.Payload{
+		Context: marshaled,
+		Data:    data,
+		SentAt:  &now,
+	}
+
+	err = t.state.Wait(ctx, "postgres", t.String(), chunk.ID, timeout)
+	if fail, ok := err.(*errors.Error); ok {
+		return &errors.Error{
+			StatusCode: fail.StatusCode,
+			Message:    "postgres/snapshot: Chunk " + chunk.ID + " of " + chunk.Schema + "." + chunk.Table + " has not been persisted after " + timeout.String(),
+		}
+	}
+
+	return err
+}
+
+/*
+primaryKey returns the columns of the primary key of a table. Tables without a
+primary key can not be exported in chunks.
+*/
+func primaryKey(tx *sql.Tx, table string) ([]string, error) {
+	keys, err := keyColumns(tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, &errors.Error{
+			StatusCode: 500,
+			Message:    "postgres/snapshot: Table " + table + " has no primary key",
+		}
+	}
+
+	return keys, nil
+}
+
+/*
+keyColumns returns the columns of the primary key of a table, in the order of the
+key. It is empty if the table has no primary key.
+*/
+func keyColumns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT a.attname FROM pg_index AS i
+		JOIN pg_attribute AS a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::REGCLASS AND i.indisprimary
+		ORDER BY array_position(i.indkey::SMALLINT[], a.attnum);
+	`, quoteTable(table))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+/*
+completeSnapshot marks the snapshot of a slot as completed, and saves its LSN as
+the checkpoint the replication starts from.
+*/
+func completeSnapshot(slot string, lsn string, rows int64) error {
+	store, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Exec(`
+		INSERT INTO smithy.snapshots (slot, lsn, exported, completed_at) VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (slot) DO UPDATE SET exported = $3, completed_at = NOW();
+	`, slot, lsn, rows)
+	if err != nil || lsn == "" {
+		return err
+	}
+
+	checkpoint, err := pglogrepl.ParseLSN(lsn)
+	if err != nil {
+		return err
+	}
+
+	return saveCheckpoint(slot, checkpoint)
+}
+
+/*
+waitSnapshot waits for the snapshot of a slot to be completed.
+*/
+func waitSnapshot(ctx context.Context, slot string) error {
+	store, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	for {
+		var completed bool
+		err = store.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM smithy.snapshots WHERE slot = $1 AND completed_at IS NOT NULL);
+		`, slot).Scan(&completed)
+		if err != nil || completed {
+			return err
+		}
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+Sync is the options of an incremental sync of a table. Each sync is registered as
+a trigger named "sync-<name>".
+*/
+type Sync struct {
+
+	// Name is the name of the sync. It must be unique across the syncs of the
+	// source since the watermark is saved given it.
+	//
+	// Default: the table
+	Name string
+
+	// Table is the table to read the rows from, such as "public.users".
+	Table string
+
+	// Cursor is the column used to read the rows added or updated since the last
+	// run, such as "updated_at" or a serial "id". It must only increase.
+	Cursor string
+
+	// Key is a unique column used to order the rows having the same cursor, such
+	// as "id". It is required if the values of the cursor are not unique, otherwise
+	// rows having the same cursor as the last row of a page would be skipped.
+	Key string
+
+	// PageSize is the maximum number of rows read and emitted per page.
+	//
+	// Default: 500
+	PageSize int
+
+	// Interval is the interval at which the sync runs. Each run reads the pages
+	// until it has caught up with the table or its budget is exhausted.
+	//
+	// Default: 1 minute
+	Interval time.Duration
+
+	// Budget is the maximum time a run keeps reading pages. Once elapsed, the
+	// remaining rows are read by the next run.
+	//
+	// Default: 5 minutes
+	Budget time.Duration
+
+	// ConfirmTimeout is the maximum time to wait for the gateway to persist the
+	// event of a page before reading the next one.
+	//
+	// Default: 1 minute
+	ConfirmTimeout time.Duration
+
+	// InFlight is the time a page is considered as being persisted by the gateway.
+	// If the event of a page has not been persisted once elapsed, the page is read
+	// again.
+	//
+	// Default: 5 minutes
+	InFlight time.Duration
+
+	// Flows returns the flows to run for a page, if any.
+	Flows func(*Page) []flow.Flow
+}
+
+/*
+TriggerSync is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It reads the rows of a table whose cursor is past the last saved watermark, page
+by page, until a page is not full or the budget of the run is exhausted. Each page
+is emitted as its own event, and the watermark is saved in the
+"smithy.sync_watermarks" table only once the event has been persisted by the
+gateway. A page whose event has not been persisted is read again.
+*/
+type TriggerSync struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Page `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env   *Options
+	sync  *Sync
+	state *sources.Tracker
+}
+
+/*
+Page is the data payload specific to this trigger. It contains the rows read
+between two watermarks.
+*/
+type Page struct {
+	ID    string            `json:"id"`
+	Sync  string            `json:"sync"`
+	Table string            `json:"table"`
+	From  *Watermark        `json:"from,omitempty"`
+	To    *Watermark        `json:"to"`
+	Rows  []json.RawMessage `json:"rows"`
+}
+
+/*
+Watermark is the position of the last row read by a sync.
+*/
+type Watermark struct {
+	Cursor string `json:"cursor"`
+	Key    string `json:"key,omitempty"`
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerSync) String() string {
+	return "sync-" + t.sync.Name
+}
+
+/*
+Mode allows to register the trigger as an ongoing task, so every page read by a
+run can be emitted as its own event. No additional details are needed for this
+mode.
+*/
+func (t TriggerSync) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It runs the sync at every interval.
+The function returns once the gateway is shutting down.
+*/
+func (t TriggerSync) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	interval := t.sync.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-notifier.IsShuttingDown
+		cancel()
+	}()
+
+	for {
+		err := t.run(ctx, tk, notifier)
+		if err != nil && ctx.Err() == nil {
+			notifier.Error <- err
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			notifier.Done <- true
+			return
+		}
+	}
+}
+
+/*
+Dropped implements the sources.DropObserver interface. Pages dropped by a
+middleware are considered as persisted, so the sync moves past them.
+*/
+func (t TriggerSync) Dropped(p *source.Payload, dropped *sources.Dropped) {
+	var page Page
+	err := json.Unmarshal(p.Data, &page)
+	if err != nil {
+		return
+	}
+
+	t.state.Drop(page.ID)
+}
+
+/*
+run reads and emits the pages following the watermark, one after the other. The
+watermark is saved after each page has been persisted, so a run interrupted can
+resume from the last page persisted.
+
+The sync is locked with an advisory lock on a dedicated connection rather than by
+a transaction, so several gateway instances do not run it at the same time
+without holding a row lock while waiting for the gateway. The run is skipped if
+another instance holds the lock.
+*/
+func (t TriggerSync) run(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	var locked bool
+	err = conn.QueryRowContext(ctx, `
+		SELECT pg_try_advisory_lock(hashtext('smithy.sync_watermarks'), hashtext($1));
+	`, t.sync.Name).Scan(&locked)
+	if err != nil || !locked {
+		return err
+	}
+
+	defer conn.ExecContext(context.Background(), `
+		SELECT pg_advisory_unlock(hashtext('smithy.sync_watermarks'), hashtext($1));
+	`, t.sync.Name)
+
+	_, err = conn.ExecContext(ctx, `
+		INSERT INTO smithy.sync_watermarks (sync) VALUES ($1)
+		ON CONFLICT (sync) DO NOTHING;
+	`, t.sync.Name)
+	if err != nil {
+		return err
+	}
+
+	var watermark, pending Watermark
+	var pendingID sql.NullString
+	var pendingAt pq.NullTime
+	err = conn.QueryRowContext(ctx, `
+		SELECT cursor, key, pending_id, pending_cursor, pending_key, pending_at
+		FROM smithy.sync_watermarks
+		WHERE sync = $1;
+	`, t.sync.Name).Scan(&watermark.Cursor, &watermark.Key, &pendingID, &pending.Cursor, &pending.Key, &pendingAt)
+	if err != nil {
+		return err
+	}
+
+	// The event of a page may still be persisted by the gateway if the previous
+	// run stopped waiting for it.
+	if pendingID.Valid {
+		id, err := sources.Stored("postgres", t.String(), "id", pendingID.String)
+		if err != nil {
+			return err
+		}
+
+		inFlight := t.sync.InFlight
+		if inFlight == 0 {
+			inFlight = 5 * time.Minute
+		}
+
+		switch {
+		case id != "" || t.state.Dropped(pendingID.String) > 0:
+			t.state.Forget(pendingID.String)
+			watermark = pending
+		case time.Since(pendingAt.Time) < inFlight:
+			return t.error("Page " + pendingID.String + " is still being persisted")
+		default:
+			tk.Logger.Warn("postgres/" + t.String() + ": Page " + pendingID.String + " has not been persisted, reading it again")
+		}
+	}
+
+	budget := t.sync.Budget
+	if budget == 0 {
+		budget = 5 * time.Minute
+	}
+
+	timeout := t.sync.ConfirmTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	deadline := time.Now().Add(budget)
+	for {
+		page, err := t.read(&watermark)
+		if err != nil {
+			return err
+		}
+
+		if page == nil {
+			return t.save(ctx, conn, &watermark, nil)
+		}
+
+		err = t.save(ctx, conn, &watermark, page)
+		if err != nil {
+			return err
+		}
+
+		err = t.send(page, notifier)
+		if err != nil {
+			return err
+		}
+
+		err = t.state.Wait(ctx, "postgres", t.String(), page.ID, timeout)
+		if err != nil {
+			return err
+		}
+
+		watermark = *page.To
+		err = t.save(ctx, conn, &watermark, nil)
+		if err != nil {
+			return err
+		}
+
+		if len(page.Rows) < t.pageSize() || time.Now().After(deadline) || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+/*
+save saves the watermark of the sync, along with the page being persisted if any.
+*/
+func (t TriggerSync) save(ctx context.Context, conn *sql.Conn, watermark *Watermark, page *Page) error {
+	if page == nil {
+		_, err := conn.ExecContext(ctx, `
+			UPDATE smithy.sync_watermarks
+			SET cursor = $2, key = $3, pending_id = NULL, pending_cursor = '', pending_key = '', pending_at = NULL, updated_at = NOW()
+			WHERE sync = $1;
+		`, t.sync.Name, watermark.Cursor, watermark.Key)
+
+		return err
+	}
+
+	_, err := conn.ExecContext(ctx, `
+		UPDATE smithy.sync_watermarks
+		SET cursor = $2, key = $3, pending_id = $4, pending_cursor = $5, pending_key = $6, pending_at = NOW(), updated_at = NOW()
+		WHERE sync = $1;
+	`, t.sync.Name, watermark.Cursor, watermark.Key, page.ID, page.To.Cursor, page.To.Key)
+
+	return err
+}
+
+/*
+send emits the event of a page.
+*/
+func (t TriggerSync) send(page *Page, notifier *source.Notifier) error {
+	ctx, err := json.Marshal(&sources.Context{})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+
+	var flows []flow.Flow
+	if t.sync.Flows != nil {
+		flows = t.sync.Flows(page)
+	}
+
+	now := time.Now().UTC()
+	notifier.Payload <- &source.Payload{
+		Context: ctx,
+		Data:    data,
+		Flows:   flows,
+		SentAt:  &now,
+	}
+
+	return nil
+}
+
+/*
+read returns the page of rows following the watermark, or nil if there is no new
+rows.
+*/
+func (t TriggerSync) read(watermark *Watermark) (*Page, error) {
+	db, err := open(t.env.Connection)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := "t." + pq.QuoteIdentifier(t.sync.Cursor)
+	key := "''"
+	if t.sync.Key != "" {
+		key = "t." + pq.QuoteIdentifier(t.sync.Key)
+	}
+
+	query := `SELECT to_jsonb(t), ` + cursor + `::TEXT, ` + key + `::TEXT FROM ` + quoteTable(t.sync.Table) + ` AS t`
+	args := []interface{}{}
+	switch {
+	case watermark.Cursor == "":
+	case t.sync.Key == "":
+		query += ` WHERE ` + cursor + ` > $1`
+		args = append(args, watermark.Cursor)
+	default:
+		query += ` WHERE (` + cursor + `, ` + key + `) > ($1, $2)`
+		args = append(args, watermark.Cursor, watermark.Key)
+	}
+
+	query += ` ORDER BY ` + cursor
+	if t.sync.Key != "" {
+		query += `, ` + key
+	}
+
+	query += ` LIMIT ` + strconv.Itoa(t.pageSize()) + `;`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	page := &Page{
+		ID:    strconv.FormatInt(time.Now().UnixNano(), 10),
+		Sync:  t.sync.Name,
+		Table: t.sync.Table,
+		To:    &Watermark{},
+		Rows:  []json.RawMessage{},
+	}
+
+	if watermark.Cursor != "" {
+		page.From = watermark
+	}
+
+	for rows.Next() {
+		var row []byte
+		err = rows.Scan(&row, &page.To.Cursor, &page.To.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Rows = append(page.Rows, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Rows) == 0 {
+		return nil, nil
+	}
+
+	return page, nil
+}
+
+/*
+pageSize returns the maximum number of rows per page.
+*/
+func (t TriggerSync) pageSize() int {
+	if t.sync.PageSize == 0 {
+		return 500
+	}
+
+	return t.sync.PageSize
+}
+
+/*
+error returns an error for the sync.
+*/
+func (t TriggerSync) error(message string) error {
+	return &errors.Error{
+		StatusCode: 409,
+		Message:    "postgres/" + t.String() + ": " + message,
+	}
+}
@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+The pagination styles supported.
+*/
+var (
+	PaginationCursor = "cursor"
+	PaginationPage   = "page"
+	PaginationLink   = "link"
+)
+
+/*
+Source implements the source.Source interface for the "rest" source.
+*/
+type Source struct {
+	options *source.Options
+	env     *Options
+}
+
+/*
+Options is the options a user can pass to configure the source.
+*/
+type Options struct {
+
+	// Endpoints is the list of endpoints to poll. Each endpoint is registered as a
+	// trigger in CRON mode named "poll-<name>".
+	Endpoints []*Endpoint
+
+	// Client is the HTTP client used to call the endpoints.
+	//
+	// Default: a client with a timeout of 30 seconds
+	Client *http.Client
+
+	// Middlewares is the chain of middlewares every events go through once
+	// extracted, before their flows are run.
+	Middlewares sources.Chain
+}
+
+/*
+Endpoint is the options of an endpoint listing items.
+*/
+type Endpoint struct {
+
+	// Name is the name of the endpoint. It must be unique across the endpoints of
+	// the source since its cursor is saved given it.
+	Name string
+
+	// URL is the URL of the endpoint, such as "https://api.example.com/v1/users".
+	URL string
+
+	// Headers is the headers sent with every requests, such as the authorization
+	// header.
+	Headers map[string]string
+
+	// Items is the dotted path of the list of items in the body of the responses,
+	// such as "data". The body must be the list itself when empty.
+	Items string
+
+	// Pagination is the pagination style of the endpoint:
+	//   - "cursor": the cursor of the next page is read in the body of the
+	//     responses at CursorPath, and sent as the CursorParam query parameter.
+	//   - "page": pages are numbered from 1 and sent as the PageParam query
+	//     parameter, until a page has no items.
+	//   - "link": the URL of the next page is read in the "Link" header of the
+	//     responses, with the "next" relation.
+	//
+	// Default: "link"
+	Pagination string
+
+	// CursorPath is the dotted path of the cursor of the next page in the body of
+	// the responses, such as "meta.next_cursor". The last page is reached when
+	// it is empty.
+	CursorPath string
+
+	// CursorParam is the query parameter to send the cursor with.
+	//
+	// Default: "cursor"
+	CursorParam string
+
+	// PageParam is the query parameter to send the page number with.
+	//
+	// Default: "page"
+	PageParam string
+
+	// PageSize is the number of items requested per page, sent as the
+	// PageSizeParam query parameter if set.
+	PageSize int
+
+	// PageSizeParam is the query parameter to send the page size with.
+	//
+	// Default: "per_page"
+	PageSizeParam string
+
+	// Timestamp is the dotted path of the timestamp of the items, such as
+	// "updated_at". The last timestamp seen is sent as the SinceParam query
+	// parameter once every pages have been read, so only the items added or
+	// updated since are listed again. Timestamps must be sortable as strings,
+	// such as RFC 3339 timestamps in UTC.
+	Timestamp string
+
+	// SinceParam is the query parameter to send the last timestamp seen with.
+	//
+	// Default: "since"
+	SinceParam string
+
+	// Schedule is the schedule at which the endpoint is polled. Each run reads at
+	// most one page.
+	//
+	// Default: the schedule of the source
+	Schedule *source.Schedule
+
+	// MaxRetryWait is the maximum time to wait before calling the endpoint again
+	// when rate limited. The run fails if the endpoint asks to wait longer.
+	//
+	// Default: 10 seconds
+	MaxRetryWait time.Duration
+
+	// InFlight is the time a page is considered as being persisted by the gateway.
+	// If the event of a page has not been persisted once elapsed, the page is read
+	// again.
+	//
+	// Default: 5 minutes
+	InFlight time.Duration
+
+	// Flows returns the flows to run for an item, if any. Items for which an error
+	// is returned, such as invalid users, are logged and no flow is run for them.
+	Flows func(*Item) ([]flow.Flow, error)
+}
+
+/*
+New returns a valid Blacksmith source.
+
+Endpoints are polled every minute by default.
+*/
+func New(options *Options) source.Source {
+	if options == nil {
+		options = &Options{}
+	}
+
+	if options.Client == nil {
+		options.Client = &http.Client{
+			Timeout: 30 * time.Second,
+		}
+	}
+
+	return &Source{
+		options: &source.Options{
+			DefaultSchedule: &source.Schedule{
+				Interval: "@every 1m",
+			},
+		},
+		env: options,
+	}
+}
+
+/*
+String returns the string representation of the source.
+*/
+func (rest *Source) String() string {
+	return "rest"
+}
+
+/*
+Options returns common source options. They will be shared across every triggers
+of this source, except when overridden.
+*/
+func (rest *Source) Options() *source.Options {
+	return rest.options
+}
+
+/*
+Triggers return a list of triggers the source is able to handle. Every triggers
+are wrapped with the middlewares of the source.
+*/
+func (rest *Source) Triggers() map[string]source.Trigger {
+	triggers := map[string]source.Trigger{}
+	for _, endpoint := range rest.env.Endpoints {
+		t := TriggerPoll{
+			env:      rest.env,
+			endpoint: endpoint,
+		}
+
+		triggers[t.String()] = rest.env.Middlewares.Wrap(rest.String(), t)
+	}
+
+	return triggers
+}
@@ -0,0 +1,627 @@
+package rest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nunchistudio/blacksmith/flow"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+)
+
+/*
+TriggerPoll is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It reads one page of an endpoint per run, following its pagination. Since a
+trigger in CRON mode emits a single event per run, the items of a page are
+emitted within the same event, and the flows of each item are run on its own.
+
+The position of the next page and the last timestamp seen are saved in the
+"smithy.rest_cursors" table only once the event of the page has been persisted
+by the gateway, which is checked at the beginning of the next run. A page whose
+event has not been persisted is read again. The state is not locked while the
+endpoint is called: the page is claimed beforehand instead.
+*/
+type TriggerPoll struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Page `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env      *Options
+	endpoint *Endpoint
+}
+
+/*
+Page is the data payload specific to this trigger.
+*/
+type Page struct {
+	ID       string            `json:"id"`
+	Endpoint string            `json:"endpoint"`
+	URL      string            `json:"url"`
+	Next     string            `json:"next,omitempty"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+/*
+Item is an item of a page, passed to the flows of the endpoint along with the
+context and the timestamp of the event.
+*/
+type Item struct {
+	Endpoint string           `json:"endpoint"`
+	Page     string           `json:"page"`
+	Data     json.RawMessage  `json:"data"`
+	Context  *sources.Context `json:"-"`
+	SentAt   *time.Time       `json:"-"`
+}
+
+/*
+state is the state of an endpoint saved in the "smithy.rest_cursors" table. Next
+is the position of the next page, and is empty when every pages have been read.
+Since is the timestamp sent while reading the pages, and Seen the last timestamp
+seen.
+*/
+type state struct {
+	next  string
+	since string
+	seen  string
+}
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerPoll) String() string {
+	return "poll-" + t.endpoint.Name
+}
+
+/*
+Mode allows to register the trigger as a CRON task, using the schedule of the
+endpoint if any.
+*/
+func (t TriggerPoll) Mode() *source.Mode {
+	return &source.Mode{
+		Mode:      source.ModeCRON,
+		UsingCRON: t.endpoint.Schedule,
+	}
+}
+
+/*
+Extract is the function being run by the gateway everytime the schedule is met.
+It saves the position of the previous page if its event has been persisted, and
+returns the next page. No payload is returned if the page has no items.
+
+An error is returned if the previous page is still being read or persisted, so
+the same items are not emitted twice.
+*/
+func (t TriggerPoll) Extract(tk *source.Toolkit) (*source.Payload, error) {
+	current, id, err := t.claim(tk)
+	if err != nil {
+		return nil, err
+	}
+
+	// The state is not locked while calling the endpoint, which may take a while
+	// when rate limited. The claim prevents other runs from reading the page in
+	// the meantime.
+	page, seen, err := t.fetch(&current)
+	if err != nil {
+		errRelease := t.release(id)
+		if errRelease != nil {
+			tk.Logger.Error("rest/" + t.String() + ": Failed to release page " + id + ": " + errRelease.Error())
+		}
+
+		return nil, err
+	}
+
+	page.ID = id
+	if len(page.Items) == 0 {
+		return nil, t.save(id, advance(current, page.Next, seen), nil, "")
+	}
+
+	err = t.save(id, current, page, seen)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sources.Context{}
+	ctx, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+
+	// Items being invalid are logged along with their validation errors, and no
+	// flow is run for them.
+	now := time.Now().UTC()
+	flows := []flow.Flow{}
+	if t.endpoint.Flows != nil {
+		for i, item := range page.Items {
+			f, err := t.endpoint.Flows(&Item{
+				Endpoint: t.endpoint.Name,
+				Page:     page.ID,
+				Data:     item,
+				Context:  c,
+				SentAt:   &now,
+			})
+			if err != nil {
+				tk.Logger.Warn("rest/" + t.String() + ": Item " + strconv.Itoa(i) + " of page " + page.ID + " is invalid: " + describe(err))
+				continue
+			}
+
+			flows = append(flows, f...)
+		}
+	}
+
+	return &source.Payload{
+		Context: ctx,
+		Data:    data,
+		Flows:   flows,
+		SentAt:  &now,
+	}, nil
+}
+
+/*
+claim returns the current state of the endpoint, and claims the next page by
+saving its identifier as the pending one. The state is only locked while being
+claimed, so several gateway instances do not poll the endpoint at the same time.
+*/
+func (t TriggerPoll) claim(tk *source.Toolkit) (state, string, error) {
+	db, err := sources.DB()
+	if err != nil {
+		return state{}, "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return state{}, "", err
+	}
+
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		INSERT INTO smithy.rest_cursors (endpoint) VALUES ($1)
+		ON CONFLICT (endpoint) DO NOTHING;
+	`, t.endpoint.Name)
+	if err != nil {
+		return state{}, "", err
+	}
+
+	var current, pending state
+	var pendingID sql.NullString
+	var pendingAt pq.NullTime
+	err = tx.QueryRow(`
+		SELECT next, since, seen, pending_id, pending_next, pending_seen, pending_at
+		FROM smithy.rest_cursors
+		WHERE endpoint = $1
+		FOR UPDATE SKIP LOCKED;
+	`, t.endpoint.Name).Scan(&current.next, &current.since, &current.seen, &pendingID, &pending.next, &pending.seen, &pendingAt)
+	if err == sql.ErrNoRows {
+		return state{}, "", t.error(409, "Endpoint is already being polled")
+	} else if err != nil {
+		return state{}, "", err
+	}
+
+	if pendingID.Valid {
+		id, err := sources.Stored("rest", t.String(), "id", pendingID.String)
+		if err != nil {
+			return state{}, "", err
+		}
+
+		current, err = t.resume(current, pending, pendingID.String, id != "", pendingAt.Time)
+		if err != nil {
+			return state{}, "", err
+		}
+
+		if id == "" {
+			tk.Logger.Warn("rest/" + t.String() + ": Page " + pendingID.String + " has not been persisted, reading it again")
+		}
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	_, err = tx.Exec(`
+		UPDATE smithy.rest_cursors
+		SET next = $2, since = $3, seen = $4, pending_id = $5, pending_next = '', pending_seen = '', pending_at = NOW(), updated_at = NOW()
+		WHERE endpoint = $1;
+	`, t.endpoint.Name, current.next, current.since, current.seen, id)
+	if err != nil {
+		return state{}, "", err
+	}
+
+	return current, id, tx.Commit()
+}
+
+/*
+resume returns the state to read the next page from, given the pending page of
+the previous run. The state only advances to the pending one once its page has
+been stored. An error is returned if the pending page may still be read or
+persisted, otherwise it is read again.
+*/
+func (t TriggerPoll) resume(current state, pending state, id string, stored bool, at time.Time) (state, error) {
+	inFlight := t.endpoint.InFlight
+	if inFlight == 0 {
+		inFlight = 5 * time.Minute
+	}
+
+	switch {
+	case stored:
+		return advance(current, pending.next, pending.seen), nil
+	case time.Since(at) < inFlight:
+		return current, t.error(409, "Page "+id+" is still being read or persisted")
+	default:
+		return current, nil
+	}
+}
+
+/*
+save saves the state of the endpoint once the page claimed has been read. If the
+page has items, the position following it is saved as pending until its event
+has been persisted. Otherwise, the state is saved right away.
+
+An error is returned if the page is no longer claimed by this run.
+*/
+func (t TriggerPoll) save(id string, current state, page *Page, seen string) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	var res sql.Result
+	if page == nil {
+		res, err = db.Exec(`
+			UPDATE smithy.rest_cursors
+			SET next = $3, since = $4, seen = $5, pending_id = NULL, pending_next = '', pending_seen = '', pending_at = NULL, updated_at = NOW()
+			WHERE endpoint = $1 AND pending_id = $2;
+		`, t.endpoint.Name, id, current.next, current.since, current.seen)
+	} else {
+		res, err = db.Exec(`
+			UPDATE smithy.rest_cursors
+			SET pending_next = $3, pending_seen = $4, pending_at = NOW(), updated_at = NOW()
+			WHERE endpoint = $1 AND pending_id = $2;
+		`, t.endpoint.Name, id, page.Next, seen)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return t.error(409, "Page "+id+" has been claimed by another run")
+	}
+
+	return nil
+}
+
+/*
+release releases the page claimed, so the next run can read it right away.
+*/
+func (t TriggerPoll) release(id string) error {
+	db, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE smithy.rest_cursors
+		SET pending_id = NULL, pending_next = '', pending_seen = '', pending_at = NULL, updated_at = NOW()
+		WHERE endpoint = $1 AND pending_id = $2;
+	`, t.endpoint.Name, id)
+	return err
+}
+
+/*
+fetch calls the endpoint and returns the page at the current position, along with
+the last timestamp seen. The identifier of the page is not set.
+*/
+func (t TriggerPoll) fetch(current *state) (*Page, string, error) {
+	endpoint, err := t.url(current)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := t.call(endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer res.Body.Close()
+	var body interface{}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	err = decoder.Decode(&body)
+	if err != nil {
+		return nil, "", t.error(502, "Body of the response is not valid JSON: "+err.Error())
+	}
+
+	list, ok := lookup(body, t.endpoint.Items).([]interface{})
+	if !ok {
+		return nil, "", t.error(502, "No list of items found at \""+t.endpoint.Items+"\"")
+	}
+
+	page := &Page{
+		Endpoint: t.endpoint.Name,
+		URL:      endpoint,
+		Items:    []json.RawMessage{},
+	}
+
+	seen := current.seen
+	for _, item := range list {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return nil, "", err
+		}
+
+		page.Items = append(page.Items, b)
+		if t.endpoint.Timestamp != "" {
+			if ts := text(lookup(item, t.endpoint.Timestamp)); ts > seen {
+				seen = ts
+			}
+		}
+	}
+
+	switch t.pagination() {
+	case PaginationCursor:
+		page.Next = text(lookup(body, t.endpoint.CursorPath))
+
+	case PaginationPage:
+		if len(page.Items) > 0 {
+			number, _ := strconv.Atoi(current.next)
+			if number == 0 {
+				number = 1
+			}
+
+			page.Next = strconv.Itoa(number + 1)
+		}
+
+	default:
+		page.Next, err = next(res.Header.Get("Link"), res.Request.URL)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return page, seen, nil
+}
+
+/*
+url returns the URL of the page at the current position.
+*/
+func (t TriggerPoll) url(current *state) (string, error) {
+	if current.next != "" && t.pagination() == PaginationLink {
+		return current.next, nil
+	}
+
+	u, err := url.Parse(t.endpoint.URL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	if current.since != "" {
+		q.Set(fallback(t.endpoint.SinceParam, "since"), current.since)
+	}
+
+	if t.endpoint.PageSize > 0 {
+		q.Set(fallback(t.endpoint.PageSizeParam, "per_page"), strconv.Itoa(t.endpoint.PageSize))
+	}
+
+	switch t.pagination() {
+	case PaginationCursor:
+		if current.next != "" {
+			q.Set(fallback(t.endpoint.CursorParam, "cursor"), current.next)
+		}
+
+	case PaginationPage:
+		q.Set(fallback(t.endpoint.PageParam, "page"), fallback(current.next, "1"))
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+/*
+call calls the endpoint. When rate limited, the endpoint is called again after
+the time asked in the "Retry-After" header of the response, up to 3 times. An
+error is returned if the endpoint asks to wait longer than allowed.
+*/
+func (t TriggerPoll) call(endpoint string) (*http.Response, error) {
+	maxWait := t.endpoint.MaxRetryWait
+	if maxWait == 0 {
+		maxWait = 10 * time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Accept", "application/json")
+		for key, value := range t.endpoint.Headers {
+			req.Header.Set(key, value)
+		}
+
+		res, err := t.env.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode < 300 {
+			return res, nil
+		}
+
+		res.Body.Close()
+		if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+			return nil, t.error(502, "Endpoint responded with status "+strconv.Itoa(res.StatusCode))
+		}
+
+		wait := retryAfter(res.Header.Get("Retry-After"), time.Duration(1<<attempt)*time.Second)
+		if attempt >= 3 || wait > maxWait {
+			return nil, t.error(429, "Endpoint is rate limited, retry after "+wait.String())
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+/*
+pagination returns the pagination style of the endpoint.
+*/
+func (t TriggerPoll) pagination() string {
+	return fallback(t.endpoint.Pagination, PaginationLink)
+}
+
+/*
+error returns an error for the endpoint.
+*/
+func (t TriggerPoll) error(status int, message string) error {
+	return &errors.Error{
+		StatusCode: status,
+		Message:    "rest/" + t.String() + ": " + message,
+	}
+}
+
+/*
+advance returns the state once a page has been read. When every pages have been
+read, the next ones are listed since the last timestamp seen.
+*/
+func advance(current state, next string, seen string) state {
+	current.next = next
+	current.seen = seen
+	if next == "" {
+		current.since = seen
+	}
+
+	return current
+}
+
+/*
+next returns the URL of the next page given the "Link" header of a response, or
+an empty string if it is the last page. Relative URLs are resolved against the
+URL of the request.
+*/
+func next(header string, base *url.URL) (string, error) {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		for _, param := range parts[1:] {
+			param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+			if param != `rel="next"` && param != "rel=next" {
+				continue
+			}
+
+			u, err := base.Parse(target)
+			if err != nil {
+				return "", err
+			}
+
+			return u.String(), nil
+		}
+	}
+
+	return "", nil
+}
+
+/*
+retryAfter returns the time to wait given the "Retry-After" header of a response,
+either in seconds or as a date. The default is returned if the header is not set.
+*/
+func retryAfter(header string, def time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(header); err == nil {
+		return time.Until(at)
+	}
+
+	return def
+}
+
+/*
+lookup returns the value at the dotted path of a JSON value. The value itself is
+returned if the path is empty.
+*/
+func lookup(value interface{}, path string) interface{} {
+	if path == "" {
+		return value
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		value = object[key]
+	}
+
+	return value
+}
+
+/*
+text returns the string representation of a JSON value, or an empty string if
+it is null.
+*/
+func text(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+/*
+fallback returns the value, or the fallback if it is empty.
+*/
+func fallback(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+/*
+describe returns the message of an error along with its validation errors, if
+any.
+*/
+func describe(err error) string {
+	fail, ok := err.(*errors.Error)
+	if !ok {
+		return err.Error()
+	}
+
+	messages := []string{fail.Message}
+	for _, validation := range fail.Validations {
+		messages = append(messages, strings.Join(validation.Path, ".")+": "+validation.Message)
+	}
+
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,262 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+)
+
+/*
+trigger returns a trigger polling the endpoint of a test server.
+*/
+func trigger(srv *httptest.Server, endpoint *Endpoint) TriggerPoll {
+	endpoint.Name = "users"
+	endpoint.URL = srv.URL + "/users"
+	return TriggerPoll{
+		env: &Options{
+			Client: srv.Client(),
+		},
+		endpoint: endpoint,
+	}
+}
+
+func TestFetchCursor(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("per_page") != "2" || r.URL.Query().Get("since") != "2020-07-01T00:00:00Z" {
+			t.Errorf("unexpected query: %s", r.URL.RawQuery)
+		}
+
+		switch r.URL.Query().Get("after") {
+		case "":
+			fmt.Fprint(w, `{"data":[{"id":1,"updated_at":"2020-07-02T00:00:00Z"},{"id":2,"updated_at":"2020-07-03T00:00:00Z"}],"meta":{"next":"c2"}}`)
+		case "c2":
+			fmt.Fprint(w, `{"data":[{"id":3,"updated_at":"2020-07-01T12:00:00Z"}],"meta":{"next":null}}`)
+		default:
+			t.Errorf("unexpected cursor: %s", r.URL.Query().Get("after"))
+		}
+	}))
+	defer srv.Close()
+
+	tr := trigger(srv, &Endpoint{
+		Items:       "data",
+		Pagination:  PaginationCursor,
+		CursorPath:  "meta.next",
+		CursorParam: "after",
+		PageSize:    2,
+		Timestamp:   "updated_at",
+	})
+
+	current := state{since: "2020-07-01T00:00:00Z", seen: "2020-07-01T00:00:00Z"}
+	page, seen, err := tr.fetch(&current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Items) != 2 || page.Next != "c2" || seen != "2020-07-03T00:00:00Z" {
+		t.Fatalf("unexpected first page: %d items, next %q, seen %q", len(page.Items), page.Next, seen)
+	}
+
+	current = advance(current, page.Next, seen)
+	if current.since != "2020-07-01T00:00:00Z" {
+		t.Fatalf("since must not advance before the last page, got %q", current.since)
+	}
+
+	page, seen, err = tr.fetch(&current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Items) != 1 || page.Next != "" || seen != "2020-07-03T00:00:00Z" {
+		t.Fatalf("unexpected last page: %d items, next %q, seen %q", len(page.Items), page.Next, seen)
+	}
+
+	current = advance(current, page.Next, seen)
+	if current.next != "" || current.since != "2020-07-03T00:00:00Z" {
+		t.Fatalf("unexpected state after the last page: %+v", current)
+	}
+}
+
+func TestFetchPage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "1":
+			fmt.Fprint(w, `[{"id":1},{"id":2}]`)
+		case "2":
+			fmt.Fprint(w, `[]`)
+		default:
+			t.Errorf("unexpected page: %s", r.URL.Query().Get("page"))
+		}
+	}))
+	defer srv.Close()
+
+	tr := trigger(srv, &Endpoint{
+		Pagination: PaginationPage,
+	})
+
+	current := state{}
+	page, _, err := tr.fetch(&current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Items) != 2 || page.Next != "2" {
+		t.Fatalf("unexpected first page: %d items, next %q", len(page.Items), page.Next)
+	}
+
+	current = advance(current, page.Next, "")
+	page, _, err = tr.fetch(&current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Items) != 0 || page.Next != "" {
+		t.Fatalf("unexpected last page: %d items, next %q", len(page.Items), page.Next)
+	}
+}
+
+func TestFetchLink(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("offset") {
+		case "":
+			w.Header().Set("Link", `</users?offset=2>; rel="next", </users?offset=4>; rel="last"`)
+			fmt.Fprint(w, `{"data":[{"id":1},{"id":2}]}`)
+		case "2":
+			w.Header().Set("Link", `</users>; rel="first"`)
+			fmt.Fprint(w, `{"data":[{"id":3}]}`)
+		default:
+			t.Errorf("unexpected offset: %s", r.URL.Query().Get("offset"))
+		}
+	}))
+	defer srv.Close()
+
+	tr := trigger(srv, &Endpoint{
+		Items: "data",
+	})
+
+	current := state{}
+	page, _, err := tr.fetch(&current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Items) != 2 || page.Next != srv.URL+"/users?offset=2" {
+		t.Fatalf("unexpected first page: %d items, next %q", len(page.Items), page.Next)
+	}
+
+	current = advance(current, page.Next, "")
+	page, _, err = tr.fetch(&current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Items) != 1 || page.Next != "" {
+		t.Fatalf("unexpected last page: %d items, next %q", len(page.Items), page.Next)
+	}
+}
+
+func TestCallRetryAfter(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		fmt.Fprint(w, `[]`)
+	}))
+	defer srv.Close()
+
+	tr := trigger(srv, &Endpoint{})
+	res, err := tr.call(srv.URL + "/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestCallRetryAfterTooLong(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	tr := trigger(srv, &Endpoint{
+		MaxRetryWait: 10 * time.Second,
+	})
+
+	_, err := tr.call(srv.URL + "/users")
+	fail, ok := err.(*errors.Error)
+	if !ok || fail.StatusCode != 429 || !strings.Contains(fail.Message, "2m0s") {
+		t.Fatalf("expected a 429 error, got %v", err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestResume(t *testing.T) {
+	tr := TriggerPoll{
+		endpoint: &Endpoint{
+			Name:     "users",
+			InFlight: time.Minute,
+		},
+	}
+
+	current := state{next: "c1", since: "2020-07-01", seen: "2020-07-02"}
+	pending := state{next: "", seen: "2020-07-03"}
+
+	tests := map[string]struct {
+		stored   bool
+		at       time.Time
+		expected state
+		status   int
+	}{
+		"stored": {
+			stored:   true,
+			at:       time.Now(),
+			expected: state{next: "", since: "2020-07-03", seen: "2020-07-03"},
+		},
+		"in flight": {
+			at:       time.Now().Add(-30 * time.Second),
+			expected: current,
+			status:   409,
+		},
+		"not persisted in time": {
+			at:       time.Now().Add(-2 * time.Minute),
+			expected: current,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resumed, err := tr.resume(current, pending, "42", test.stored, test.at)
+			if test.status != 0 {
+				fail, ok := err.(*errors.Error)
+				if !ok || fail.StatusCode != test.status {
+					t.Fatalf("expected a %d error, got %v", test.status, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resumed != test.expected {
+				t.Fatalf("expected state %+v, got %+v", test.expected, resumed)
+			}
+		})
+	}
+}
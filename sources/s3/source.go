@@ -0,0 +1,119 @@
+package s3
+
+import (
+	"time"
+
+	"github.com/nunchistudio/blacksmith/flow/source"
+
+	"github.com/nunchistudio/smithy/sources"
+	"github.com/nunchistudio/smithy/sources/files"
+)
+
+/*
+Source implements the source.Source interface for the "s3" source.
+*/
+type Source struct {
+	options *source.Options
+	env     *Options
+	tracker *sources.Tracker
+}
+
+/*
+Options is the options a user can pass to configure the source.
+*/
+type Options struct {
+
+	// Endpoint is the host of the S3-compatible service, such as "s3.amazonaws.com"
+	// or "localhost:9000" for a local MinIO server.
+	Endpoint string
+
+	// AccessKeyID and SecretAccessKey are the credentials used to access the bucket.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Secure indicates if the service must be accessed over HTTPS.
+	Secure bool
+
+	// Region is the region of the bucket. It is detected by the service when empty.
+	Region string
+
+	// Bucket is the name of the bucket to poll.
+	Bucket string
+
+	// Prefix is the prefix of the objects to ingest, such as "partners/". Every
+	// objects of the bucket are ingested when empty.
+	Prefix string
+
+	// Mapping is the name of the columns, or keys, holding the fields of the users
+	// in the objects.
+	Mapping *files.Mapping
+
+	// BatchSize is the maximum number of users sent within a single event. Objects
+	// are split in as many events as needed.
+	//
+	// Default: 500
+	BatchSize int
+
+	// Interval is the interval at which the bucket is listed for new objects.
+	//
+	// Default: 1 minute
+	Interval time.Duration
+
+	// ConfirmTimeout is the maximum time to wait for the gateway to persist the
+	// event of a batch. Once elapsed, the object is processed again at the next
+	// interval, starting after the last batch persisted.
+	//
+	// Default: 1 minute
+	ConfirmTimeout time.Duration
+
+	// Middlewares is the chain of middlewares every events go through once
+	// extracted, before their flows are run.
+	Middlewares sources.Chain
+}
+
+/*
+New returns a valid Blacksmith source.
+*/
+func New(options *Options) source.Source {
+	if options == nil {
+		options = &Options{}
+	}
+
+	return &Source{
+		options: &source.Options{
+			DefaultSchedule: &source.Schedule{
+				Interval: "@every 1m",
+			},
+		},
+		env:     options,
+		tracker: &sources.Tracker{},
+	}
+}
+
+/*
+String returns the string representation of the source.
+*/
+func (s3 *Source) String() string {
+	return "s3"
+}
+
+/*
+Options returns common source options. They will be shared across every triggers
+of this source, except when overridden.
+*/
+func (s3 *Source) Options() *source.Options {
+	return s3.options
+}
+
+/*
+Triggers return a list of triggers the source is able to handle. Every triggers
+are wrapped with the middlewares of the source.
+*/
+func (s3 *Source) Triggers() map[string]source.Trigger {
+	return map[string]source.Trigger{
+		"poll": s3.env.Middlewares.Wrap(s3.String(), TriggerPoll{
+			env:   s3.env,
+			state: s3.tracker,
+		}),
+	}
+}
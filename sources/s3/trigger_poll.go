@@ -0,0 +1,376 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/nunchistudio/blacksmith/flow/source"
+	"github.com/nunchistudio/blacksmith/helper/errors"
+
+	"github.com/nunchistudio/smithy/sources"
+	"github.com/nunchistudio/smithy/sources/api"
+	"github.com/nunchistudio/smithy/sources/files"
+)
+
+/*
+TriggerPoll is the payload structure sent by an event and that will be received
+by the gateway. Blacksmith needs "Context", "Data", and "SentAt" keys to ensure
+consistency across triggers.
+
+It lists the objects of the bucket under the prefix at every interval, and emits
+the users of every new object through the "OnRegister" flow. Objects are parsed
+with the same parsers as the "files" source and are streamed, so they are never
+loaded whole in memory:
+
+ 1. A first read validates every users of the object. An object failing to parse
+    is marked as failed along with an error report, and no event is emitted.
+ 2. A second read emits the users in batches, each batch being its own event. A
+    batch is only considered as sent once its event has been persisted by the
+    gateway.
+
+Objects are identified by their key and ETag, saved in the "smithy.s3_objects"
+table along with the number of batches persisted. An object is ingested again
+if its content changes.
+*/
+type TriggerPoll struct {
+
+	// Context is a shared context across events. It is used to save common properties
+	// about events such as timezone, location, language, IP address, etc.
+	Context *sources.Context `json:"context"`
+
+	// Data is the data specific to this trigger.
+	Data *Batch `json:"data"`
+
+	// SentAt is the registered timestamp the event was sent at.
+	SentAt *time.Time `json:"sent_at"`
+
+	env   *Options
+	state *sources.Tracker
+}
+
+/*
+Batch is the data payload specific to this trigger. Parts are numbered from 1.
+*/
+type Batch struct {
+	ID      string `json:"id"`
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	ETag    string `json:"etag"`
+	Part    int    `json:"part"`
+	Records int    `json:"records"`
+}
+
+/*
+Object is an object of the bucket being ingested.
+*/
+type Object struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	ETag    string `json:"etag"`
+	Size    int64  `json:"size"`
+	Format  string `json:"format"`
+	Records int    `json:"records"`
+}
+
+/*
+Report is the error report saved for an object that failed to parse.
+*/
+type Report struct {
+	Object *Object       `json:"object"`
+	Error  *errors.Error `json:"error"`
+}
+
+/*
+The status of the objects saved in the "smithy.s3_objects" table.
+*/
+var (
+	StatusProcessing = "processing"
+	StatusDone       = "done"
+	StatusFailed     = "failed"
+)
+
+/*
+String returns the string representation of the trigger.
+*/
+func (t TriggerPoll) String() string {
+	return "poll"
+}
+
+/*
+Mode allows to register the trigger as an ongoing task, so every batch can be
+emitted as its own event. No additional details are needed for this mode.
+*/
+func (t TriggerPoll) Mode() *source.Mode {
+	return &source.Mode{
+		Mode: source.ModeCDC,
+	}
+}
+
+/*
+Extract is function being run by the gateway. It polls the bucket at every
+interval. The function returns once the gateway is shutting down.
+*/
+func (t TriggerPoll) Extract(tk *source.Toolkit, notifier *source.Notifier) {
+	interval := t.env.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-notifier.IsShuttingDown
+		cancel()
+	}()
+
+	for {
+		err := t.poll(ctx, tk, notifier)
+		if err != nil && ctx.Err() == nil {
+			notifier.Error <- err
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			notifier.Done <- true
+			return
+		}
+	}
+}
+
+/*
+Dropped implements the sources.DropObserver interface. Batches dropped by a
+middleware are considered as persisted, so they are not sent again.
+*/
+func (t TriggerPoll) Dropped(p *source.Payload, dropped *sources.Dropped) {
+	t.sender().Dropped(p)
+}
+
+/*
+sender returns the sender of the batches of the trigger.
+*/
+func (t TriggerPoll) sender() *files.Sender {
+	return &files.Sender{
+		Source:  "s3",
+		Trigger: t.String(),
+		State:   t.state,
+		Timeout: t.env.ConfirmTimeout,
+	}
+}
+
+/*
+poll lists the objects under the prefix, and ingests the ones not already done
+or failed.
+*/
+func (t TriggerPoll) poll(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier) error {
+	client, err := minio.New(t.env.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(t.env.AccessKeyID, t.env.SecretAccessKey, ""),
+		Secure: t.env.Secure,
+		Region: t.env.Region,
+	})
+	if err != nil {
+		return err
+	}
+
+	listed := client.ListObjects(ctx, t.env.Bucket, minio.ListObjectsOptions{
+		Prefix:    t.env.Prefix,
+		Recursive: true,
+	})
+
+	for info := range listed {
+		if info.Err != nil {
+			return info.Err
+		}
+
+		format, _ := files.Detect(info.Key)
+		if format == "" || strings.HasSuffix(info.Key, "/") {
+			continue
+		}
+
+		object := &Object{
+			Bucket: t.env.Bucket,
+			Key:    info.Key,
+			ETag:   strings.Trim(info.ETag, `"`),
+			Size:   info.Size,
+			Format: format,
+		}
+
+		status, parts, err := loadObject(object)
+		if err != nil {
+			return err
+		}
+
+		if status == StatusDone || status == StatusFailed {
+			continue
+		}
+
+		err = t.ingest(ctx, tk, notifier, client, object, parts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ingest validates an object and then sends its users in batches, starting after
+the given number of batches already persisted.
+*/
+func (t TriggerPoll) ingest(ctx context.Context, tk *source.Toolkit, notifier *source.Notifier, client *minio.Client, object *Object, parts int) error {
+	err := t.read(ctx, client, object, func(u *api.User) error {
+		object.Records++
+		return nil
+	})
+
+	if fail, ok := err.(*errors.Error); ok {
+		tk.Logger.Warn("s3/poll: Object " + object.Key + " failed to parse")
+		return saveObject(object, StatusFailed, parts, &Report{
+			Object: object,
+			Error:  fail,
+		})
+	} else if err != nil {
+		return err
+	}
+
+	err = saveObject(object, StatusProcessing, parts, nil)
+	if err != nil {
+		return err
+	}
+
+	size := t.env.BatchSize
+	if size <= 0 {
+		size = 500
+	}
+
+	// Batches are identified by the key and the ETag of the object, so they are
+	// not sent again as long as its content does not change.
+	h := sha256.New()
+	h.Write([]byte(object.Bucket + "/" + object.Key + "@" + object.ETag))
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	sender := t.sender()
+	part := 0
+	batch := []*api.User{}
+	flush := func() error {
+		part++
+		if part <= parts || len(batch) == 0 {
+			batch = batch[:0]
+			return nil
+		}
+
+		b := &Batch{
+			ID:      files.BatchID(hash, part),
+			Bucket:  object.Bucket,
+			Key:     object.Key,
+			ETag:    object.ETag,
+			Part:    part,
+			Records: len(batch),
+		}
+
+		_, err := sender.Send(ctx, tk, notifier, b.ID, b, batch)
+		if err != nil {
+			return err
+		}
+
+		batch = batch[:0]
+		return saveObject(object, StatusProcessing, part, nil)
+	}
+
+	err = t.read(ctx, client, object, func(u *api.User) error {
+		batch = append(batch, u)
+		if len(batch) < size {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		err = flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return saveObject(object, StatusDone, part, nil)
+}
+
+/*
+read streams the users of an object. The ETag of the object must still match so
+both reads are done on the same content.
+*/
+func (t TriggerPoll) read(ctx context.Context, client *minio.Client, object *Object, fn func(*api.User) error) error {
+	opts := minio.GetObjectOptions{}
+	err := opts.SetMatchETag(object.ETag)
+	if err != nil {
+		return err
+	}
+
+	reader, err := client.GetObject(ctx, object.Bucket, object.Key, opts)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+	return files.Parse(reader, object.Key, t.env.Mapping, fn)
+}
+
+/*
+loadObject returns the status of an object and the number of its batches already
+persisted. The status is empty if the object has never been seen.
+*/
+func loadObject(object *Object) (string, int, error) {
+	store, err := sources.DB()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var status string
+	var parts int
+	err = store.QueryRow(`
+		SELECT status, parts FROM smithy.s3_objects
+		WHERE bucket = $1 AND key = $2 AND etag = $3;
+	`, object.Bucket, object.Key, object.ETag).Scan(&status, &parts)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+
+	return status, parts, err
+}
+
+/*
+saveObject saves the status of an object along with the number of its batches
+persisted, and its error report if it failed to parse.
+*/
+func saveObject(object *Object, status string, parts int, report *Report) error {
+	store, err := sources.DB()
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	if report != nil {
+		b, err = json.Marshal(report)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = store.Exec(`
+		INSERT INTO smithy.s3_objects (bucket, key, etag, status, parts, records, report, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (bucket, key, etag) DO UPDATE
+		SET status = $4, parts = $5, records = $6, report = $7, updated_at = NOW();
+	`, object.Bucket, object.Key, object.ETag, status, parts, object.Records, b)
+	return err
+}
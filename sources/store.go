@@ -0,0 +1,93 @@
+package sources
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+var (
+	db     *sql.DB
+	dbErr  error
+	dbOnce sync.Once
+)
+
+/*
+DB returns the connection pool to the PostgreSQL database used by the store. It
+is shared across sources, flows, and destinations needing to persist their own
+state next to the "blacksmith_store" schema.
+
+The connection string is read from the "POSTGRES_STORE_URL" environment variable,
+the same one used by the store adapter. The pool is opened only once.
+*/
+func DB() (*sql.DB, error) {
+	dbOnce.Do(func() {
+		db, dbErr = sql.Open("postgres", os.Getenv("POSTGRES_STORE_URL"))
+	})
+
+	return db, dbErr
+}
+
+/*
+Stored returns the ID of the event of a source's trigger stored with the given
+value for a key of its data, or an empty string if none has been stored yet. It
+allows triggers to know when the gateway has persisted an event they extracted.
+*/
+func Stored(s string, trigger string, key string, value string) (string, error) {
+	db, err := DB()
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	err = db.QueryRow(`
+		SELECT id FROM blacksmith_store.events
+		WHERE source = $1 AND trigger = $2 AND data->>$3 = $4
+		LIMIT 1;
+	`, s, trigger, key, value).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	return id, nil
+}
+
+/*
+StoredAll is the same as Stored for several values at once. It returns the ID of
+the events stored given their value, so triggers waiting for many events can
+check them with a single query.
+*/
+func StoredAll(s string, trigger string, key string, values []string) (map[string]string, error) {
+	stored := map[string]string{}
+	if len(values) == 0 {
+		return stored, nil
+	}
+
+	db, err := DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT ON (data->>$3) data->>$3, id FROM blacksmith_store.events
+		WHERE source = $1 AND trigger = $2 AND data->>$3 = ANY($4::TEXT[]);
+	`, s, trigger, key, pq.Array(values))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var value, id string
+		err = rows.Scan(&value, &id)
+		if err != nil {
+			return nil, err
+		}
+
+		stored[value] = id
+	}
+
+	return stored, rows.Err()
+}
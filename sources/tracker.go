@@ -0,0 +1,89 @@
+package sources
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+)
+
+/*
+Tracker tracks the events dropped by the middlewares of a source. It is shared
+between the triggers in CDC mode and the chain they are wrapped with, so they can
+wait for their events to be persisted before acknowledging them.
+
+The zero value is ready to use.
+*/
+type Tracker struct {
+	mutex   sync.Mutex
+	dropped map[string]int
+}
+
+/*
+Drop records an event as dropped given its identifier. It is meant to be called
+by the triggers implementing the DropObserver interface.
+*/
+func (tr *Tracker) Drop(id string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if tr.dropped == nil {
+		tr.dropped = map[string]int{}
+	}
+
+	tr.dropped[id]++
+}
+
+/*
+Dropped returns the number of events dropped with the given identifier.
+*/
+func (tr *Tracker) Dropped(id string) int {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return tr.dropped[id]
+}
+
+/*
+Forget forgets the events dropped with the given identifier.
+*/
+func (tr *Tracker) Forget(id string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	delete(tr.dropped, id)
+}
+
+/*
+Wait waits for the event of a source's trigger having the given "id" in its data
+to be persisted by the gateway, or dropped by a middleware. It returns an error
+if it is neither once the timeout elapsed.
+*/
+func (tr *Tracker) Wait(ctx context.Context, s string, trigger string, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		stored, err := Stored(s, trigger, "id", id)
+		if err != nil {
+			return err
+		}
+
+		if stored != "" || tr.Dropped(id) > 0 {
+			tr.Forget(id)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return &errors.Error{
+				StatusCode: 500,
+				Message:    s + "/" + trigger + ": Event " + id + " has not been persisted after " + timeout.String(),
+			}
+		}
+
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package sources
+
+import (
+	"regexp"
+	"strings"
+)
+
+/*
+UserAgent contains data about the user agent of the client making the request.
+*/
+type UserAgent struct {
+	Raw            string `json:"raw,omitempty"`
+	Browser        string `json:"browser,omitempty"`
+	BrowserVersion string `json:"browser_version,omitempty"`
+	OS             string `json:"os,omitempty"`
+	OSVersion      string `json:"os_version,omitempty"`
+	Device         string `json:"device,omitempty"`
+}
+
+/*
+The device types a user agent can be parsed into.
+*/
+var (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+/*
+userAgentRule is a rule used to detect a browser or an operating system. The
+version is the first group of the expression, if any.
+*/
+type userAgentRule struct {
+	name string
+	expr *regexp.Regexp
+}
+
+/*
+browsers is the list of browsers detected, in order of precedence. The order
+matters since most browsers include the name of others for compatibility.
+*/
+var browsers = []userAgentRule{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+}
+
+/*
+systems is the list of operating systems detected, in order of precedence.
+*/
+var systems = []userAgentRule{
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*OS ([\d_]+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X ([\d_.]+)`)},
+	{"Android", regexp.MustCompile(`Android ([\d.]+)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ ([\d.]+)`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+/*
+botRegexp detects the user agents of crawlers and other automated clients.
+*/
+var botRegexp = regexp.MustCompile(`(?i)bot|crawler|spider|slurp|curl|wget|python-requests|go-http-client`)
+
+/*
+ParseUserAgent parses the raw user agent of a request. The parsing is based on
+well-known patterns and does not aim to be exhaustive. It returns nil if the raw
+user agent is empty.
+*/
+func ParseUserAgent(raw string) *UserAgent {
+	if raw == "" {
+		return nil
+	}
+
+	ua := &UserAgent{
+		Raw:    raw,
+		Device: DeviceDesktop,
+	}
+
+	for _, rule := range browsers {
+		if match := rule.expr.FindStringSubmatch(raw); match != nil {
+			ua.Browser = rule.name
+			ua.BrowserVersion = match[1]
+			break
+		}
+	}
+
+	for _, rule := range systems {
+		if match := rule.expr.FindStringSubmatch(raw); match != nil {
+			ua.OS = rule.name
+			ua.OSVersion = strings.Replace(match[1], "_", ".", -1)
+			break
+		}
+	}
+
+	switch {
+	case botRegexp.MatchString(raw):
+		ua.Device = DeviceBot
+	case strings.Contains(raw, "iPad") || strings.Contains(raw, "Tablet"):
+		ua.Device = DeviceTablet
+	case ua.OS == "Android" && !strings.Contains(raw, "Mobile"):
+		ua.Device = DeviceTablet
+	case strings.Contains(raw, "Mobile") || strings.Contains(raw, "iPhone"):
+		ua.Device = DeviceMobile
+	}
+
+	return ua
+}
@@ -0,0 +1,129 @@
+package sources
+
+import (
+	"net/mail"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/nunchistudio/blacksmith/helper/errors"
+)
+
+/*
+usernameRegexp is the set of characters allowed in a username.
+*/
+var usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+/*
+Path returns the path of a field inside the payload of a request. It follows the
+same format than the one used by the destinations' actions, such as:
+
+	[]string{"request", "payload", "data", "email"}
+*/
+func Path(keys ...string) []string {
+	return append([]string{"request", "payload"}, keys...)
+}
+
+/*
+Validator collects the validation errors of a payload. It allows triggers to check
+every fields and to report all the violations together instead of one at a time.
+*/
+type Validator struct {
+	validations []errors.Validation
+}
+
+/*
+Add adds a validation error for the field at the given path.
+*/
+func (v *Validator) Add(path []string, message string) {
+	v.validations = append(v.validations, errors.Validation{
+		Message: message,
+		Path:    path,
+	})
+}
+
+/*
+Required ensures the value is not empty. It returns false if a validation error
+has been added.
+*/
+func (v *Validator) Required(path []string, value string) bool {
+	if value == "" {
+		v.Add(path, "Field is required")
+		return false
+	}
+
+	return true
+}
+
+/*
+MaxLength ensures the value does not exceed the given number of characters. It
+returns false if a validation error has been added.
+*/
+func (v *Validator) MaxLength(path []string, value string, max int) bool {
+	if utf8.RuneCountInString(value) > max {
+		v.Add(path, "Field must not exceed "+strconv.Itoa(max)+" characters")
+		return false
+	}
+
+	return true
+}
+
+/*
+Email ensures the value is a valid email address, without any display name. An
+empty value is considered valid, use Required to enforce a value. It returns false
+if a validation error has been added.
+*/
+func (v *Validator) Email(path []string, value string) bool {
+	if value == "" {
+		return true
+	}
+
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		v.Add(path, "Field must be a valid email address")
+		return false
+	}
+
+	return true
+}
+
+/*
+Username ensures the value only contains letters, digits, dots, dashes, and
+underscores. An empty value is considered valid, use Required to enforce a value.
+It returns false if a validation error has been added.
+*/
+func (v *Validator) Username(path []string, value string) bool {
+	if value == "" {
+		return true
+	}
+
+	if !usernameRegexp.MatchString(value) {
+		v.Add(path, "Field must only contain letters, digits, '.', '-', and '_'")
+		return false
+	}
+
+	return true
+}
+
+/*
+Validations returns the validation errors collected so far.
+*/
+func (v *Validator) Validations() []errors.Validation {
+	return v.validations
+}
+
+/*
+Err returns an error with a 400 status code including every validation errors
+collected. It returns nil if the payload is valid.
+*/
+func (v *Validator) Err() error {
+	if len(v.validations) == 0 {
+		return nil
+	}
+
+	return &errors.Error{
+		StatusCode:  400,
+		Message:     "Bad Request",
+		Validations: v.validations,
+	}
+}